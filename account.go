@@ -0,0 +1,67 @@
+package snpersist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"strings"
+)
+
+// Account records the account a DB holds the items of, so it is not synced with a session for another
+type Account struct {
+	ID          int `storm:"id"`
+	Fingerprint string
+}
+
+// there is only ever one account per DB
+const accountRecordID = 1
+
+// AccountFingerprint returns the identifier recorded for the account with the given email on the given server
+// it is a hash so the email is not stored in the DB
+func AccountFingerprint(email, server string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	server = strings.ToLower(strings.TrimRight(strings.TrimSpace(server), "/"))
+
+	sum := sha256.Sum256([]byte(email + "\n" + server))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// GetAccount returns the fingerprint of the account recorded in the DB, or an empty string if none is
+func GetAccount(db *storm.DB) (fingerprint string, err error) {
+	var account Account
+
+	err = db.One("ID", accountRecordID, &account)
+	if errors.Is(err, storm.ErrNotFound) {
+		return "", nil
+	}
+
+	return account.Fingerprint, err
+}
+
+// checkAccount returns ErrAccountMismatch if the DB belongs to a different account to the input's Email and session
+// the account is recorded by the first sync with an Email, nothing is checked without one
+func (si SyncInput) checkAccount(db *storm.DB) (err error) {
+	if si.Email == "" {
+		return nil
+	}
+
+	fingerprint := AccountFingerprint(si.Email, si.Session.Server)
+
+	var stored string
+
+	if stored, err = GetAccount(db); err != nil {
+		return
+	}
+
+	switch stored {
+	case "":
+		return db.Save(&Account{ID: accountRecordID, Fingerprint: fingerprint})
+	case fingerprint:
+		return nil
+	}
+
+	return fmt.Errorf("%w: DB was created for another account or server", ErrAccountMismatch)
+}
@@ -0,0 +1,43 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncAccountMismatch(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	session := offlineSession()
+
+	so, err := Sync(SyncInput{
+		Session: session,
+		Email:   "a@example.com",
+		DBPath:  tempDBPath,
+		Syncer:  &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token"}}},
+	})
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	fingerprint, err := GetAccount(so.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, AccountFingerprint("A@example.com ", session.Server+"/"), fingerprint)
+
+	// the same account can sync again
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token"}}}
+	_, err = Sync(SyncInput{Session: session, Email: "a@example.com", DB: so.DB, Syncer: fs})
+	assert.NoError(t, err)
+
+	// but not another
+	_, err = Sync(SyncInput{Session: session, Email: "b@example.com", DB: so.DB, Syncer: fs})
+	assert.True(t, errors.Is(err, ErrAccountMismatch))
+
+	other := session
+	other.Server = "https://notes.example.com"
+	_, err = Sync(SyncInput{Session: other, Email: "a@example.com", DB: so.DB, Syncer: fs})
+	assert.True(t, errors.Is(err, ErrAccountMismatch))
+
+	assert.Len(t, fs.inputs, 1)
+}
@@ -0,0 +1,116 @@
+package snpersist
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// extension of each account's DB within an accounts directory
+	accountDBExt = ".db"
+	// file within an accounts directory recording the account in use
+	currentAccountFile = "current-account"
+)
+
+// AccountDBPath returns the path of the DB of the account with the given ID within the accounts directory dir
+// IDs, e.g. emails, are escaped so any ID can be used
+func AccountDBPath(dir, accountID string) string {
+	return filepath.Join(dir, url.QueryEscape(accountID)+accountDBExt)
+}
+
+// ListAccounts returns the IDs of the accounts with a DB in the accounts directory dir, in order
+func ListAccounts(dir string) (ids []string, err error) {
+	var files []os.FileInfo
+
+	files, err = ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), accountDBExt) {
+			continue
+		}
+
+		var id string
+
+		if id, err = url.QueryUnescape(strings.TrimSuffix(f.Name(), accountDBExt)); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return
+}
+
+// RemoveAccount deletes the DB of the account with the given ID from the accounts directory dir
+// the DB must not be open, if it is the current account then no account is current afterwards
+func RemoveAccount(dir, accountID string) (err error) {
+	path := AccountDBPath(dir, accountID)
+
+	if err = os.Remove(path); err != nil {
+		return
+	}
+
+	_ = os.Remove(path + lockFileSuffix)
+
+	var current string
+
+	if current, err = CurrentAccount(dir); err != nil || current != accountID {
+		return
+	}
+
+	return SetCurrentAccount(dir, "")
+}
+
+// SetCurrentAccount records the account in use within the accounts directory dir, so it can be restored
+// with CurrentAccount, e.g. when an application restarts, an empty ID clears it
+func SetCurrentAccount(dir, accountID string) error {
+	path := filepath.Join(dir, currentAccountFile)
+
+	if accountID == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(accountID), 0600)
+}
+
+// CurrentAccount returns the ID of the account recorded as in use within the accounts directory dir,
+// or an empty string if none is
+func CurrentAccount(dir string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, currentAccountFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	return string(b), err
+}
+
+// dbPath returns the path of the DB the input opens, which is within DBPath if the input has an AccountID
+func (si SyncInput) dbPath() string {
+	if si.AccountID == "" {
+		return si.DBPath
+	}
+
+	return AccountDBPath(si.DBPath, si.AccountID)
+}
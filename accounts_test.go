@@ -0,0 +1,57 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAccounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snpersist-accounts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// each account is synced to its own DB within the directory
+	for _, id := range []string{"b@example.com", "a/example"} {
+		so, err := Sync(SyncInput{
+			Session:   offlineSession(),
+			DBPath:    dir,
+			AccountID: id,
+			Syncer:    &fakeSyncer{outputs: []gosn.SyncOutput{{Items: gosn.EncryptedItems{{UUID: id, ContentType: "Note"}}, SyncToken: id}}},
+		})
+		assert.NoError(t, err)
+
+		var all []Item
+		assert.NoError(t, so.DB.All(&all))
+		assert.Len(t, all, 1)
+		assert.Equal(t, id, all[0].UUID)
+		assert.NoError(t, so.DB.Close())
+	}
+
+	ids, err := ListAccounts(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/example", "b@example.com"}, ids)
+
+	current, err := CurrentAccount(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, current)
+
+	assert.NoError(t, SetCurrentAccount(dir, "a/example"))
+
+	current, err = CurrentAccount(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "a/example", current)
+
+	// removing the current account leaves none current
+	assert.NoError(t, RemoveAccount(dir, "a/example"))
+
+	ids, err = ListAccounts(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b@example.com"}, ids)
+
+	current, err = CurrentAccount(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, current)
+}
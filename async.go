@@ -0,0 +1,55 @@
+package snpersist
+
+import (
+	"context"
+)
+
+// SyncHandle is a sync running in the background, started by SyncAsync
+type SyncHandle struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	so     SyncOutput
+	err    error
+}
+
+// SyncAsync starts a sync in the background and returns a handle to wait for, or cancel, it
+func SyncAsync(si SyncInput) *SyncHandle {
+	return SyncAsyncWithContext(context.Background(), si)
+}
+
+// SyncAsyncWithContext is SyncAsync with the sync also cancelled when ctx is
+func SyncAsyncWithContext(ctx context.Context, si SyncInput) *SyncHandle {
+	ctx, cancel := context.WithCancel(ctx)
+
+	h := &SyncHandle{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(h.done)
+		defer cancel()
+
+		h.so, h.err = SyncWithContext(ctx, si)
+	}()
+
+	return h
+}
+
+// Done returns a channel that is closed when the sync finishes
+func (h *SyncHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Result waits for the sync to finish and returns its output
+func (h *SyncHandle) Result() (SyncOutput, error) {
+	<-h.done
+
+	return h.so, h.err
+}
+
+// Cancel stops the sync at its next check for cancellation, pages already persisted are kept
+// Result returns the context's error if the sync was stopped
+func (h *SyncHandle) Cancel() {
+	h.cancel()
+}
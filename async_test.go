@@ -0,0 +1,50 @@
+package snpersist
+
+import (
+	"context"
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncAsync(t *testing.T) {
+	release := make(chan struct{})
+
+	si := SyncInput{
+		Session: offlineSession(),
+		Store:   NewMemoryStore(),
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			<-release
+
+			return gosn.SyncOutput{SyncToken: "token-1"}, nil
+		}),
+	}
+
+	h := SyncAsync(si)
+
+	select {
+	case <-h.Done():
+		t.Fatal("sync finished before SN responded")
+	default:
+	}
+
+	release <- struct{}{}
+	<-h.Done()
+
+	// cancelling a finished sync has no effect
+	h.Cancel()
+
+	so, err := h.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", so.Stats.SyncTokenOut)
+
+	// a sync cancelled before calling SN stops without calling it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	h = SyncAsyncWithContext(ctx, si)
+
+	_, err = h.Result()
+	assert.True(t, errors.Is(err, context.Canceled))
+}
@@ -0,0 +1,80 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonhadfield/gosn-v2"
+	"net/http"
+	"strings"
+)
+
+// messages of errors returned by Syncers when SN rejects the session's token
+// gosn does not report the response status so only HTTPSyncer and custom Syncers are recognised
+var authErrors = []string{
+	"unauthorized",
+	"invalid token",
+	"invalid_token",
+	"token expired",
+}
+
+// IsAuthError reports whether an error returned by a Syncer is due to SN rejecting the session,
+// e.g. as it has expired, rather than a network or server failure
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusUnauthorized
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, ae := range authErrors {
+		if strings.Contains(msg, ae) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renewSession replaces the input's session, rejected by SN with authErr, using RefreshSession
+// or, if that is not provided or fails, ReauthFunc
+// the new session is saved to the input's SessionStore, if it has one
+// authErr is returned if the input cannot renew its session
+func (si *SyncInput) renewSession(authErr error) (err error) {
+	var session gosn.Session
+
+	err = authErr
+
+	if si.RefreshSession != nil {
+		si.infof("snpersist | Sync | refreshing session: %v", authErr)
+
+		if session, err = si.RefreshSession(si.Session); err != nil {
+			err = fmt.Errorf("failed to refresh session: %w", err)
+		}
+	}
+
+	if err != nil && si.ReauthFunc != nil {
+		si.infof("snpersist | Sync | re-authenticating: %v", err)
+
+		if session, err = si.ReauthFunc(err); err != nil {
+			err = fmt.Errorf("failed to re-authenticate: %w", err)
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	si.Session = session
+
+	if si.SessionStore != nil {
+		if err = si.SessionStore.SaveSession(si.Email, session); err != nil {
+			si.warnf("snpersist | Sync | failed to save refreshed session: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestIsAuthError(t *testing.T) {
+	assert.True(t, IsAuthError(&HTTPError{StatusCode: http.StatusUnauthorized}))
+	assert.True(t, IsAuthError(errors.New("invalid_token: token expired")))
+	assert.False(t, IsAuthError(&HTTPError{StatusCode: http.StatusInternalServerError}))
+	assert.False(t, IsAuthError(errors.New("connection reset")))
+	assert.False(t, IsAuthError(nil))
+}
+
+func TestSyncRefreshesSession(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	var tokens []string
+
+	si := SyncInput{
+		Session:      session,
+		Email:        "a@example.com",
+		DB:           db,
+		SessionStore: DBSessionStore{DB: db, Passphrase: "secret"},
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			tokens = append(tokens, input.Session.Token)
+
+			if input.Session.Token != "refreshed" {
+				return gosn.SyncOutput{}, &HTTPError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+			}
+
+			return gosn.SyncOutput{SyncToken: "token"}, nil
+		}),
+	}
+
+	// without a way to refresh the session the error is returned
+	_, err = Sync(si)
+	assert.True(t, IsAuthError(err))
+	assert.Equal(t, []string{session.Token}, tokens)
+
+	tokens = nil
+
+	si.RefreshSession = func(s gosn.Session) (gosn.Session, error) {
+		s.Token = "refreshed"
+		return s, nil
+	}
+
+	so, err := Sync(si)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{session.Token, "refreshed"}, tokens)
+	assert.Equal(t, "refreshed", so.Session.Token)
+
+	// the refreshed session is saved
+	email, saved, err := LoadSession(db, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "a@example.com", email)
+	assert.Equal(t, so.Session, saved)
+
+	// a failed refresh is returned
+	si.RefreshSession = func(s gosn.Session) (gosn.Session, error) {
+		return s, errors.New("refresh token expired")
+	}
+
+	_, err = Sync(si)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to refresh session")
+}
+
+func TestSyncReauth(t *testing.T) {
+	session := offlineSession()
+
+	var reasons []error
+
+	si := SyncInput{
+		Session: session,
+		Store:   NewMemoryStore(),
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			if input.Session.Token != "signed in" {
+				return gosn.SyncOutput{}, &HTTPError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+			}
+
+			return gosn.SyncOutput{SyncToken: "token"}, nil
+		}),
+		RefreshSession: func(s gosn.Session) (gosn.Session, error) {
+			return s, errors.New("session revoked")
+		},
+		ReauthFunc: func(reason error) (gosn.Session, error) {
+			reasons = append(reasons, reason)
+
+			s := session
+			s.Token = "signed in"
+
+			return s, nil
+		},
+	}
+
+	// a session that cannot be refreshed is replaced by signing in again
+	so, err := Sync(si)
+	assert.NoError(t, err)
+	assert.Equal(t, "signed in", so.Session.Token)
+	assert.Len(t, reasons, 1)
+	assert.Contains(t, reasons[0].Error(), "session revoked")
+
+	// failing to sign in again is returned
+	si.ReauthFunc = func(reason error) (gosn.Session, error) {
+		return gosn.Session{}, errors.New("cancelled by user")
+	}
+
+	_, err = Sync(si)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to re-authenticate: cancelled by user")
+}
@@ -0,0 +1,505 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// AuthParams holds the key derivation parameters of the account the cached items belong to
+type AuthParams struct {
+	ID            int    `storm:"id" json:"-"`
+	Identifier    string `json:"identifier"`
+	PasswordSalt  string `json:"pw_salt,omitempty"`
+	PasswordCost  int64  `json:"pw_cost"`
+	PasswordNonce string `json:"pw_nonce"`
+	Version       string `json:"version"`
+}
+
+// there is only ever one set of auth params per DB
+const authParamsID = 1
+
+// snBackup is the structure of a Standard Notes encrypted backup file
+// 003 backups hold the account's auth params and 004 backups hold the same values as key params
+type snBackup struct {
+	Items      gosn.EncryptedItems `json:"items"`
+	AuthParams *AuthParams         `json:"auth_params,omitempty"`
+	KeyParams  *AuthParams         `json:"keyParams,omitempty"`
+}
+
+// params returns the auth params or key params of the backup, or nil if it has neither
+func (b snBackup) params() *AuthParams {
+	if b.AuthParams != nil {
+		return b.AuthParams
+	}
+
+	return b.KeyParams
+}
+
+// snDecryptedBackup is the structure of a Standard Notes decrypted backup file
+type snDecryptedBackup struct {
+	Items []snDecryptedItem `json:"items"`
+}
+
+// snDecryptedItem is an item in a Standard Notes decrypted backup file, its content held as plain JSON
+type snDecryptedItem struct {
+	UUID        string          `json:"uuid"`
+	ContentType string          `json:"content_type"`
+	Content     json.RawMessage `json:"content"`
+	CreatedAt   string          `json:"created_at"`
+	UpdatedAt   string          `json:"updated_at"`
+}
+
+// SaveAuthParams stores the account's auth params so they can be included in backups
+func SaveAuthParams(db *storm.DB, ap AuthParams) error {
+	ap.ID = authParamsID
+
+	return db.Save(&ap)
+}
+
+// GetAuthParams returns the stored auth params or nil if none have been saved
+func GetAuthParams(db *storm.DB) (ap *AuthParams, err error) {
+	var stored AuthParams
+
+	err = db.One("ID", authParamsID, &stored)
+	if err != nil {
+		if errors.Is(err, storm.ErrNotFound) {
+			err = nil
+		}
+
+		return
+	}
+
+	return &stored, err
+}
+
+// backupAuthParams returns the auth params saved with SaveAuthParams or, if there are none, those of the key params
+// saved by syncs with SyncInput.KeyParams, or nil if neither have been saved
+func backupAuthParams(db *storm.DB) (ap *AuthParams, err error) {
+	if ap, err = GetAuthParams(db); err != nil || ap != nil {
+		return
+	}
+
+	var kp *KeyParams
+
+	if kp, err = GetKeyParams(db); err != nil || kp == nil {
+		return
+	}
+
+	return &AuthParams{
+		Identifier:    kp.Identifier,
+		PasswordCost:  kp.PasswordCost,
+		PasswordNonce: kp.Nonce,
+		Version:       kp.Version,
+	}, nil
+}
+
+// ExportSNBackup writes the cached items in the Standard Notes encrypted backup format
+// SN needs the account's auth params to import the backup so ErrNoAuthParams is returned if neither auth params
+// nor key params are stored
+func ExportSNBackup(db *storm.DB, w io.Writer) (err error) {
+	var ap *AuthParams
+
+	if ap, err = backupAuthParams(db); err != nil {
+		return
+	}
+
+	if ap == nil {
+		return ErrNoAuthParams
+	}
+
+	var all []Item
+
+	err = db.All(&all)
+	if err != nil {
+		return
+	}
+
+	backup := snBackup{
+		Items: gosn.EncryptedItems{},
+	}
+
+	// deleted items are not included in official backups
+	for _, i := range all {
+		if i.Deleted {
+			continue
+		}
+
+		backup.Items = append(backup.Items, gosn.EncryptedItem{
+			UUID:        i.UUID,
+			Content:     i.Content,
+			ContentType: i.ContentType,
+			EncItemKey:  i.EncItemKey,
+			Deleted:     i.Deleted,
+			CreatedAt:   i.CreatedAt,
+			UpdatedAt:   i.UpdatedAt,
+		})
+	}
+
+	if ap.Version == protocol004 {
+		backup.KeyParams = ap
+	} else {
+		backup.AuthParams = ap
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err = enc.Encode(backup); err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+
+	return
+}
+
+// ExportBackup writes the cached items as a file that can be imported with Standard Notes' Import Backup,
+// in the encrypted layout of ExportSNBackup or, if encrypted is false, the decrypted layout with each item's
+// content decrypted with the session's keys
+// items keys are not included in decrypted backups as there is nothing left for them to decrypt
+func ExportBackup(db *storm.DB, session gosn.Session, w io.Writer, encrypted bool) (err error) {
+	if encrypted {
+		return ExportSNBackup(db, w)
+	}
+
+	if !session.Valid() {
+		return ErrInvalidSession
+	}
+
+	var all []Item
+
+	if err = db.All(&all); err != nil {
+		return
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	backup := snDecryptedBackup{
+		Items: []snDecryptedItem{},
+	}
+
+	for _, i := range all {
+		if i.Deleted || i.ContentType == itemsKeyContentType {
+			continue
+		}
+
+		var content string
+
+		if content, err = decryptStored(i, session, keys); err != nil {
+			return ItemError{UUID: i.UUID, ContentType: i.ContentType, Err: err}
+		}
+
+		if !json.Valid([]byte(content)) {
+			return ItemError{UUID: i.UUID, ContentType: i.ContentType, Err: errors.New("decrypted content is not valid JSON")}
+		}
+
+		backup.Items = append(backup.Items, snDecryptedItem{
+			UUID:        i.UUID,
+			ContentType: i.ContentType,
+			Content:     json.RawMessage(content),
+			CreatedAt:   i.CreatedAt,
+			UpdatedAt:   i.UpdatedAt,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err = enc.Encode(backup); err != nil {
+		return fmt.Errorf("failed to write backup: %v", err)
+	}
+
+	return
+}
+
+// ImportSNBackup upserts the items from a Standard Notes encrypted backup into the DB, marking them dirty
+// so the next sync pushes them, and returns the number of items imported
+// existing items are only replaced if the backup's copy is newer
+func ImportSNBackup(db *storm.DB, r io.Reader, session gosn.Session) (imported int, err error) {
+	if !session.Valid() {
+		err = ErrInvalidSession
+		return
+	}
+
+	var backup snBackup
+	if err = json.NewDecoder(r).Decode(&backup); err != nil {
+		err = fmt.Errorf("failed to parse backup: %v", err)
+		return
+	}
+
+	if err = checkBackupCompatible(db, backup, session); err != nil {
+		return
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	// the imported items are indexed as the DB's items are, decrypting them with the backup's items keys if needed
+	var si SyncInput
+
+	if si, err = storedIndexes(db, session, append(decryptItemsKeys(backup.Items, session), keys...)); err != nil {
+		return
+	}
+
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var saved gosn.EncryptedItems
+
+	for _, bi := range backup.Items {
+		var existing Item
+
+		err = tx.One("UUID", bi.UUID, &existing)
+
+		switch {
+		case err == nil:
+			if !isNewer(bi.UpdatedAt, existing.UpdatedAt) {
+				continue
+			}
+		case !errors.Is(err, storm.ErrNotFound):
+			return
+		}
+
+		item := Item{
+			UUID:        bi.UUID,
+			Content:     bi.Content,
+			ContentType: bi.ContentType,
+			EncItemKey:  bi.EncItemKey,
+			Deleted:     bi.Deleted,
+			CreatedAt:   bi.CreatedAt,
+			UpdatedAt:   bi.UpdatedAt,
+			Dirty:       true,
+			DirtiedDate: time.Now(),
+		}
+
+		if err = (stormTx{node: tx}).SaveItem(item); err != nil {
+			return
+		}
+
+		saved = append(saved, bi)
+	}
+
+	if err = updateIndexes(stormTx{node: tx}, si, saved); err != nil {
+		return
+	}
+
+	imported = len(saved)
+	err = tx.Commit()
+
+	return
+}
+
+// checkBackupCompatible ensures the backup was produced by the same account as the DB and session
+func checkBackupCompatible(db *storm.DB, backup snBackup, session gosn.Session) (err error) {
+	if params := backup.params(); params != nil {
+		var stored *AuthParams
+
+		stored, err = backupAuthParams(db)
+		if err != nil {
+			return
+		}
+
+		if stored != nil && (stored.Identifier != params.Identifier ||
+			stored.PasswordNonce != params.PasswordNonce ||
+			stored.Version != params.Version) {
+			return fmt.Errorf("%w: auth params do not match those of the DB", ErrBackupIncompatible)
+		}
+	}
+
+	// the session's keys, or for 004 items the items keys they decrypt, must be able to decrypt every one of
+	// the backup's items, as a backup mixing keys would otherwise fail part way through the import
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	keys = append(decryptItemsKeys(backup.Items, session), keys...)
+
+	for _, bi := range backup.Items {
+		if bi.EncItemKey == "" {
+			continue
+		}
+
+		item := ConvertItemsToPersistItems(gosn.EncryptedItems{bi})[0]
+
+		if ProtocolVersion(item) == protocol003 && (strings.Count(bi.EncItemKey, ":") < 4 || strings.Count(bi.Content, ":") < 4) {
+			return fmt.Errorf("backup item %s is malformed", bi.UUID)
+		}
+
+		if _, err = decryptStored(item, session, keys); err != nil {
+			return wrapError(ErrBackupIncompatible, err)
+		}
+	}
+
+	return
+}
+
+// isNewer returns true if timestamp a is after timestamp b
+// an unparseable or empty b is treated as older
+func isNewer(a, b string) bool {
+	bt, err := time.Parse(time.RFC3339Nano, b)
+	if err != nil {
+		return true
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, a)
+	if err != nil {
+		return false
+	}
+
+	return at.After(bt)
+}
+
+// dbBackup is the structure of a JSON export of the DB
+type dbBackup struct {
+	Items     []Item     `json:"items"`
+	SyncToken *SyncToken `json:"sync_token,omitempty"`
+}
+
+// Export writes all items, including dirty and deleted, and the current sync token as JSON
+// items remain encrypted so the output is safe to store as-is
+func Export(db *storm.DB, w io.Writer) (err error) {
+	var backup dbBackup
+
+	err = db.All(&backup.Items)
+	if err != nil {
+		return
+	}
+
+	var st SyncToken
+
+	st, err = getSyncToken(db)
+	if err != nil {
+		return
+	}
+
+	if st.SyncToken != "" {
+		backup.SyncToken = &st
+	}
+
+	if err = json.NewEncoder(w).Encode(backup); err != nil {
+		return fmt.Errorf("failed to write export: %v", err)
+	}
+
+	return
+}
+
+// Import restores an export created by Export, upserting items by UUID
+// if the DB already contains items then overwrite must be true
+func Import(db *storm.DB, r io.Reader, overwrite bool) (err error) {
+	var backup dbBackup
+	if err = json.NewDecoder(r).Decode(&backup); err != nil {
+		return fmt.Errorf("failed to parse export: %v", err)
+	}
+
+	if !overwrite {
+		var count int
+
+		count, err = db.Count(&Item{})
+		if err != nil {
+			return
+		}
+
+		if count > 0 {
+			return fmt.Errorf("%w: DB already contains %d items", ErrDBNotEmpty, count)
+		}
+	}
+
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for x := range backup.Items {
+		// backups taken before the derived fields were added lack them
+		backup.Items[x].derive()
+
+		if err = tx.Save(&backup.Items[x]); err != nil {
+			return
+		}
+	}
+
+	if backup.SyncToken != nil {
+		if err = saveSyncToken(tx, *backup.SyncToken); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+
+	return
+}
+
+// Backup writes a consistent copy of the bolt file to w, returning the number of bytes written
+// it is taken within a read transaction so the DB can be backed up whilst open and syncing
+func Backup(db *storm.DB, w io.Writer) (n int64, err error) {
+	err = db.Bolt.View(func(tx *bolt.Tx) (err error) {
+		n, err = tx.WriteTo(w)
+
+		return
+	})
+
+	return
+}
+
+// BackupFile writes a copy of the bolt file to path, as Backup does, replacing any existing file only once
+// the copy is complete
+func BackupFile(db *storm.DB, path string) (n int64, err error) {
+	tmpPath := path + ".tmp"
+
+	var f *os.File
+
+	if f, err = os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
+		return
+	}
+
+	if n, err = Backup(db, f); err == nil {
+		err = f.Sync()
+	}
+
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+
+	return
+}
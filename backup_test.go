@@ -0,0 +1,280 @@
+package snpersist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportSNBackup(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", Content: "003:a", EncItemKey: "003:ka"}))
+	assert.NoError(t, db.Save(&Item{UUID: "b", ContentType: "Note", Deleted: true}))
+	assert.NoError(t, SaveAuthParams(db, AuthParams{Identifier: "me@example.com", PasswordCost: 110000, PasswordNonce: "n", Version: "003"}))
+
+	var buf bytes.Buffer
+	assert.NoError(t, ExportSNBackup(db, &buf))
+
+	var backup snBackup
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &backup))
+	assert.Len(t, backup.Items, 1)
+	assert.Equal(t, "a", backup.Items[0].UUID)
+	assert.Equal(t, "003:ka", backup.Items[0].EncItemKey)
+	assert.NotNil(t, backup.AuthParams)
+	assert.Equal(t, "me@example.com", backup.AuthParams.Identifier)
+	assert.Equal(t, "003", backup.AuthParams.Version)
+}
+
+func TestExportSNBackupKeyParams(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", Content: "004:a", EncItemKey: "004:ka"}))
+
+	// SN cannot import a backup without the account's params
+	var buf bytes.Buffer
+	assert.Equal(t, ErrNoAuthParams, ExportSNBackup(db, &buf))
+
+	// the params of the keys recorded by sync are used in their place
+	assert.NoError(t, SaveKeyParams(db, KeyParams{Identifier: "me@example.com", Version: "004", Nonce: "n"}, session))
+
+	buf.Reset()
+	assert.NoError(t, ExportSNBackup(db, &buf))
+
+	var backup snBackup
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &backup))
+	assert.Nil(t, backup.AuthParams)
+	assert.NotNil(t, backup.KeyParams)
+	assert.Equal(t, "me@example.com", backup.KeyParams.Identifier)
+	assert.Equal(t, "n", backup.KeyParams.PasswordNonce)
+
+	assert.NoError(t, SaveKeyParams(db, KeyParams{Identifier: "me@example.com", Version: "003", Nonce: "n", PasswordCost: 110000}, session))
+
+	buf.Reset()
+	assert.NoError(t, ExportSNBackup(db, &buf))
+
+	backup = snBackup{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &backup))
+	assert.NotNil(t, backup.AuthParams)
+	assert.Equal(t, int64(110000), backup.AuthParams.PasswordCost)
+}
+
+func TestExportBackup(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	newNote, _ := createNote("exported", "text")
+	dItems := gosn.Items{&newNote}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	eItems = append(eItems, items004(t, session)...)
+	assert.NoError(t, SaveItems(db, eItems))
+
+	var buf bytes.Buffer
+	assert.NoError(t, ExportBackup(db, session, &buf, false))
+
+	var backup struct {
+		Items []struct {
+			UUID        string `json:"uuid"`
+			ContentType string `json:"content_type"`
+			Content     struct {
+				Title string `json:"title"`
+			} `json:"content"`
+		} `json:"items"`
+	}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &backup))
+
+	// the items key is omitted
+	titles := map[string]string{}
+	for _, i := range backup.Items {
+		assert.Equal(t, "Note", i.ContentType)
+		titles[i.UUID] = i.Content.Title
+	}
+
+	assert.Equal(t, map[string]string{newNote.UUID: "exported", "note": "004 note"}, titles)
+
+	// the encrypted layout is that of ExportSNBackup
+	assert.NoError(t, SaveKeyParams(db, KeyParams{Identifier: "me@example.com", Version: "004", Nonce: "n"}, session))
+
+	buf.Reset()
+	assert.NoError(t, ExportBackup(db, session, &buf, true))
+
+	var encrypted snBackup
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &encrypted))
+	assert.Len(t, encrypted.Items, 3)
+
+	// items another session cannot decrypt fail the export
+	assert.Error(t, ExportBackup(db, offlineSession(), &buf, false))
+}
+
+func TestImportSNBackup(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	newNote, _ := createNote("test", "")
+	dItems := gosn.Items{&newNote}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, json.NewEncoder(&buf).Encode(snBackup{Items: eItems}))
+	backup := buf.Bytes()
+
+	var imported int
+	imported, err = ImportSNBackup(db, bytes.NewReader(backup), session)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, imported)
+
+	var dirty []Item
+	assert.NoError(t, db.Find("Dirty", true, &dirty))
+	assert.Len(t, dirty, 1)
+	assert.Equal(t, newNote.UUID, dirty[0].UUID)
+	assert.NotZero(t, dirty[0].DirtiedDate)
+
+	// importing the same backup again should not replace the existing copy
+	imported, err = ImportSNBackup(db, bytes.NewReader(backup), session)
+	assert.NoError(t, err)
+	assert.Zero(t, imported)
+
+	// a session with different keys cannot import the backup
+	_, err = ImportSNBackup(db, bytes.NewReader(backup), offlineSession())
+	assert.Error(t, err)
+}
+
+func TestImportSNBackup004(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	var buf bytes.Buffer
+	assert.NoError(t, json.NewEncoder(&buf).Encode(snBackup{Items: items004(t, session)}))
+	backup := buf.Bytes()
+
+	// a session that cannot decrypt the items key cannot import the backup
+	_, err = ImportSNBackup(db, bytes.NewReader(backup), offlineSession())
+	assert.True(t, errors.Is(err, ErrBackupIncompatible))
+
+	// nor can a backup with an item encrypted by an items key that is not available
+	var mixed bytes.Buffer
+	assert.NoError(t, json.NewEncoder(&mixed).Encode(snBackup{Items: append(items004(t, session),
+		encrypt004(t, "other", "Note", `{"title":"other","text":"","references":[]}`, randomKey(t)))}))
+
+	_, err = ImportSNBackup(db, &mixed, session)
+	assert.True(t, errors.Is(err, ErrBackupIncompatible))
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Empty(t, all)
+
+	imported, err := ImportSNBackup(db, bytes.NewReader(backup), session)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, imported)
+
+	note, err := GetNote(db, session, "note")
+	assert.NoError(t, err)
+	assert.Equal(t, "004 note", note.Content.Title)
+}
+
+func TestExportImport(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", Content: "003:a", Dirty: true}))
+	assert.NoError(t, db.Save(&Item{UUID: "b", ContentType: "Tag", Content: "003:b"}))
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token"}))
+
+	var buf bytes.Buffer
+	assert.NoError(t, Export(db, &buf))
+	assert.NoError(t, db.Close())
+	removeDB(tempDBPath)
+
+	db, err = storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	export := buf.Bytes()
+	assert.NoError(t, Import(db, bytes.NewReader(export), false))
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 2)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "a", &stored))
+	assert.True(t, stored.Dirty)
+
+	var st SyncToken
+	st, err = getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "token", st.SyncToken)
+
+	// importing into a populated DB requires overwrite
+	assert.Error(t, Import(db, bytes.NewReader(export), false))
+	assert.NoError(t, Import(db, bytes.NewReader(export), true))
+}
+
+func TestBackup(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", Content: "content"}))
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token-1"}))
+
+	var buf bytes.Buffer
+	n, err := Backup(db, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	dir, err := ioutil.TempDir("", "snpersist-backup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the DB remains open and usable whilst backed up
+	path := filepath.Join(dir, "backup.db")
+	_, err = BackupFile(db, path)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Save(&Item{UUID: "b", ContentType: "Note"}))
+
+	backup, err := Open(path)
+	assert.NoError(t, err)
+	defer backup.Close()
+
+	var all []Item
+	assert.NoError(t, backup.All(&all))
+	assert.Len(t, all, 1)
+	assert.Equal(t, "content", all[0].Content)
+
+	st, err := getSyncToken(backup)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", st.SyncToken)
+}
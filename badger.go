@@ -0,0 +1,398 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dgraph-io/badger/v2"
+	"strings"
+	"time"
+)
+
+// prefixes of the keys used to store values in a BadgerStore
+// the type and dirty keys are indexes, holding no value, so their items can be found with a prefix iteration
+const (
+	badgerItemPrefix       = "item/"
+	badgerTypePrefix       = "type/"
+	badgerDirtyPrefix      = "dirty/"
+	badgerTitlePrefix      = "title/"
+	badgerRefPrefix        = "ref/"
+	badgerRefToPrefix      = "refto/"
+	badgerSearchPrefix     = "search/"
+	badgerSearchTermPrefix = "searchterm/"
+	badgerQuarantinePrefix = "quarantine/"
+	badgerSyncToken        = "synctoken"
+	badgerDirtySeq         = "dirtyseq"
+)
+
+// BadgerStore is a Store backed by a Badger DB, suited to accounts too large for a single bolt file
+type BadgerStore struct {
+	db *badger.DB
+}
+
+// OpenBadgerStore opens, or creates, a Badger DB in the provided directory and returns a Store
+func OpenBadgerStore(dir string) (*BadgerStore, error) {
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBadgerStore(db), nil
+}
+
+// NewBadgerStore returns a Store for an open Badger DB
+func NewBadgerStore(db *badger.DB) *BadgerStore {
+	return &BadgerStore{db: db}
+}
+
+// DB returns the underlying Badger DB
+func (s *BadgerStore) DB() *badger.DB {
+	return s.db
+}
+
+func (s *BadgerStore) AllItems() (items []Item, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		return iterateBadger(txn, badgerItemPrefix, true, func(key string, value []byte) error {
+			var item Item
+			if err := json.Unmarshal(value, &item); err != nil {
+				return err
+			}
+
+			items = append(items, item)
+
+			return nil
+		})
+	})
+
+	return
+}
+
+func (s *BadgerStore) DirtyItems() ([]Item, error) {
+	return s.indexedItems(badgerDirtyPrefix)
+}
+
+// ItemsOfType returns the items of the given content type
+func (s *BadgerStore) ItemsOfType(contentType string) ([]Item, error) {
+	return s.indexedItems(badgerTypePrefix + contentType + "/")
+}
+
+// indexedItems returns the items referenced by the index keys with the given prefix
+func (s *BadgerStore) indexedItems(prefix string) (items []Item, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		tx := badgerTx{txn: txn}
+
+		return iterateBadger(txn, prefix, false, func(key string, _ []byte) error {
+			item, err := tx.Item(key[len(prefix):])
+			if err != nil {
+				return err
+			}
+
+			items = append(items, item)
+
+			return nil
+		})
+	})
+
+	return
+}
+
+func (s *BadgerStore) SyncToken() (st SyncToken, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		i, err := txn.Get([]byte(badgerSyncToken))
+		if err != nil {
+			return err
+		}
+
+		return i.Value(func(value []byte) error {
+			if err := json.Unmarshal(value, &st); err != nil {
+				return wrapError(ErrSyncTokenCorrupt, err)
+			}
+
+			return nil
+		})
+	})
+
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+func (s *BadgerStore) Quarantined() (quarantined []QuarantinedItem, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		return iterateBadger(txn, badgerQuarantinePrefix, true, func(key string, value []byte) error {
+			var q QuarantinedItem
+			if err := json.Unmarshal(value, &q); err != nil {
+				return err
+			}
+
+			quarantined = append(quarantined, q)
+
+			return nil
+		})
+	})
+
+	return
+}
+
+func (s *BadgerStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTx{txn: txn})
+	})
+}
+
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+// badgerTx implements StoreTx for a Badger transaction
+type badgerTx struct {
+	txn *badger.Txn
+}
+
+func (t badgerTx) Item(uuid string) (item Item, err error) {
+	err = t.get(badgerItemPrefix+uuid, &item)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		err = ErrItemNotFound
+	}
+
+	return
+}
+
+func (t badgerTx) SaveItem(item Item) (err error) {
+	// remove the index keys of the existing copy in case its type or dirty flag has changed
+	if err = t.DeleteItem(item.UUID); err != nil {
+		return
+	}
+
+	item.derive()
+
+	if err = item.sequence(t.nextDirtySeq); err != nil {
+		return
+	}
+
+	if err = t.set(badgerItemPrefix+item.UUID, item); err != nil {
+		return
+	}
+
+	if err = t.txn.Set([]byte(badgerTypePrefix+item.ContentType+"/"+item.UUID), nil); err != nil {
+		return
+	}
+
+	if item.Dirty {
+		err = t.txn.Set([]byte(badgerDirtyPrefix+item.UUID), nil)
+	}
+
+	return
+}
+
+func (t badgerTx) DeleteItem(uuid string) (err error) {
+	var existing Item
+
+	existing, err = t.Item(uuid)
+	if errors.Is(err, ErrItemNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, key := range []string{
+		badgerItemPrefix + uuid,
+		badgerTypePrefix + existing.ContentType + "/" + uuid,
+		badgerDirtyPrefix + uuid,
+	} {
+		if err = t.txn.Delete([]byte(key)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (t badgerTx) SaveSyncToken(st SyncToken) error {
+	st.SavedAt = time.Now()
+
+	return t.set(badgerSyncToken, st)
+}
+
+func (t badgerTx) SaveTitle(entry TitleEntry) error {
+	return t.set(badgerTitlePrefix+entry.UUID, entry)
+}
+
+func (t badgerTx) DeleteTitle(uuid string) error {
+	return t.txn.Delete([]byte(badgerTitlePrefix + uuid))
+}
+
+func (t badgerTx) SetReferences(parent string, refs []Reference) (err error) {
+	var existing []Reference
+
+	err = iterateBadger(t.txn, badgerRefPrefix+parent+"/", true, func(key string, value []byte) error {
+		var r Reference
+		if err := json.Unmarshal(value, &r); err != nil {
+			return err
+		}
+
+		existing = append(existing, r)
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, r := range existing {
+		if err = t.txn.Delete([]byte(badgerRefPrefix + r.Parent + "/" + r.Child)); err != nil {
+			return
+		}
+
+		if err = t.txn.Delete([]byte(badgerRefToPrefix + r.Child + "/" + r.Parent)); err != nil {
+			return
+		}
+	}
+
+	for _, r := range refs {
+		if err = t.set(badgerRefPrefix+r.Parent+"/"+r.Child, r); err != nil {
+			return
+		}
+
+		if err = t.txn.Set([]byte(badgerRefToPrefix+r.Child+"/"+r.Parent), nil); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (t badgerTx) DeleteReferencesTo(child string) (err error) {
+	prefix := badgerRefToPrefix + child + "/"
+
+	var parents []string
+
+	err = iterateBadger(t.txn, prefix, false, func(key string, _ []byte) error {
+		parents = append(parents, strings.TrimPrefix(key, prefix))
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, parent := range parents {
+		if err = t.txn.Delete([]byte(badgerRefPrefix + parent + "/" + child)); err != nil {
+			return
+		}
+
+		if err = t.txn.Delete([]byte(prefix + parent)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (t badgerTx) SetSearchTerms(uuid string, terms map[string]int) (err error) {
+	var existing []string
+
+	prefix := badgerSearchPrefix + uuid + "/"
+
+	err = iterateBadger(t.txn, prefix, false, func(key string, _ []byte) error {
+		existing = append(existing, key[len(prefix):])
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, term := range existing {
+		if err = t.txn.Delete([]byte(prefix + term)); err != nil {
+			return
+		}
+
+		if err = t.txn.Delete([]byte(badgerSearchTermPrefix + term + "/" + uuid)); err != nil {
+			return
+		}
+	}
+
+	for term, count := range terms {
+		if err = t.set(prefix+term, count); err != nil {
+			return
+		}
+
+		if err = t.txn.Set([]byte(badgerSearchTermPrefix+term+"/"+uuid), nil); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (t badgerTx) Quarantine(q QuarantinedItem) error {
+	return t.set(badgerQuarantinePrefix+q.UUID, q)
+}
+
+func (t badgerTx) Unquarantine(uuid string) error {
+	return t.txn.Delete([]byte(badgerQuarantinePrefix + uuid))
+}
+
+// get decodes the JSON value stored under key into v
+func (t badgerTx) get(key string, v interface{}) error {
+	i, err := t.txn.Get([]byte(key))
+	if err != nil {
+		return err
+	}
+
+	return i.Value(func(value []byte) error {
+		return json.Unmarshal(value, v)
+	})
+}
+
+// nextDirtySeq increments and returns the store's dirty sequence number
+func (t badgerTx) nextDirtySeq() (seq uint64, err error) {
+	if err = t.get(badgerDirtySeq, &seq); err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return
+	}
+
+	seq++
+
+	return seq, t.set(badgerDirtySeq, seq)
+}
+
+// set stores v under key as JSON
+func (t badgerTx) set(key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return t.txn.Set([]byte(key), value)
+}
+
+// iterateBadger calls fn with each key with the given prefix and, if withValues is set, its value
+func iterateBadger(txn *badger.Txn, prefix string, withValues bool, fn func(key string, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = withValues
+	opts.Prefix = []byte(prefix)
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		var value []byte
+
+		if withValues {
+			var err error
+			if value, err = it.Item().ValueCopy(nil); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(string(it.Item().Key()), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
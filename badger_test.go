@@ -0,0 +1,31 @@
+package snpersist
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBadgerStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snpersist-badger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var store *BadgerStore
+	store, err = OpenBadgerStore(dir)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	testStore(t, store)
+
+	var notes, tags []Item
+	notes, err = store.ItemsOfType("Note")
+	assert.NoError(t, err)
+	assert.Len(t, notes, 2)
+
+	tags, err = store.ItemsOfType("Tag")
+	assert.NoError(t, err)
+	assert.Len(t, tags, 1)
+	assert.Equal(t, "c", tags[0].UUID)
+}
@@ -0,0 +1,165 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// CachedItem holds the decrypted title and text of an item so lists can be rendered without decrypting every item
+// WARNING: cached content is stored unencrypted, reducing the security of the DB at rest
+// entries are only written by ReadCachedItems so the cache is never populated unless it is used
+type CachedItem struct {
+	Key         string `storm:"id"` // UUID and content hash, so an item that has changed is no longer matched
+	UUID        string `storm:"index"`
+	ContentType string `storm:"index"`
+	UpdatedAt   string
+	Title       string
+	Text        string
+}
+
+// cacheKey returns the key of an item's cache entry
+// local edits keep the updated_at SN gave the item so the content hash is used to find changes
+func cacheKey(uuid, contentHash string) string {
+	return uuid + "/" + contentHash
+}
+
+// ReadCachedItems returns the decrypted title and text of the non-deleted items of the given content type
+// items that are not cached, or have changed since they were, are decrypted and cached and entries for
+// items that have since been changed or deleted are removed
+// if contentType is empty then items of all types are returned
+func ReadCachedItems(db *storm.DB, session gosn.Session, contentType string) (cached []CachedItem, err error) {
+	var existing []CachedItem
+
+	var persisted Items
+
+	if contentType == "" {
+		err = db.All(&persisted)
+		if err == nil {
+			err = db.All(&existing)
+		}
+	} else {
+		err = db.Find("ContentType", contentType, &persisted)
+		if err == nil || errors.Is(err, storm.ErrNotFound) {
+			err = db.Find("ContentType", contentType, &existing)
+		}
+	}
+
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	hits := make(map[string]CachedItem, len(existing))
+	for _, e := range existing {
+		hits[e.Key] = e
+	}
+
+	live := make(map[string]bool, len(persisted))
+	keys := make(map[string]string, len(persisted))
+
+	var misses gosn.EncryptedItems
+
+	for _, p := range persisted {
+		if p.Deleted {
+			continue
+		}
+
+		key := cacheKey(p.UUID, p.contentHash())
+		live[key] = true
+		keys[p.UUID] = key
+
+		if hit, ok := hits[key]; ok {
+			cached = append(cached, hit)
+			continue
+		}
+
+		misses = append(misses, gosn.EncryptedItem{
+			UUID:        p.UUID,
+			Content:     p.Content,
+			ContentType: p.ContentType,
+			EncItemKey:  p.EncItemKey,
+			CreatedAt:   p.CreatedAt,
+			UpdatedAt:   p.UpdatedAt,
+		})
+	}
+
+	var decrypted gosn.DecryptedItems
+
+	if len(misses) > 0 {
+		var itemsKeys []ItemsKey
+
+		if itemsKeys, err = ItemsKeys(db, session); err != nil {
+			return
+		}
+
+		decrypted, err = decryptItems(misses, session, itemsKeys)
+		if err != nil {
+			return
+		}
+	}
+
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			cached = nil
+		}
+	}()
+
+	for _, d := range decrypted {
+		var content struct {
+			Title string `json:"title"`
+			Text  string `json:"text"`
+		}
+
+		_ = json.Unmarshal([]byte(d.Content), &content)
+
+		entry := CachedItem{
+			Key:         keys[d.UUID],
+			UUID:        d.UUID,
+			ContentType: d.ContentType,
+			UpdatedAt:   d.UpdatedAt,
+			Title:       content.Title,
+			Text:        content.Text,
+		}
+
+		if err = tx.Save(&entry); err != nil {
+			return
+		}
+
+		cached = append(cached, entry)
+	}
+
+	// remove entries for previous versions of items and for deleted items
+	for x := range existing {
+		if live[existing[x].Key] {
+			continue
+		}
+
+		if err = tx.DeleteStruct(&existing[x]); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+
+	return
+}
+
+// ClearCache removes every entry from the decrypted cache
+func ClearCache(db *storm.DB) (err error) {
+	err = db.Drop(&CachedItem{})
+	if errors.Is(err, bolt.ErrBucketNotFound) {
+		err = nil
+	}
+
+	return
+}
@@ -0,0 +1,57 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReadCachedItems(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	// clearing an unused cache is not an error
+	assert.NoError(t, ClearCache(db))
+
+	one, err := CreateNote(db, session, "one", "text one")
+	assert.NoError(t, err)
+	two, err := CreateNote(db, session, "two", "text two")
+	assert.NoError(t, err)
+	_, err = CreateTag(db, session, "tag")
+	assert.NoError(t, err)
+
+	var cached []CachedItem
+	cached, err = ReadCachedItems(db, session, "Note")
+	assert.NoError(t, err)
+	assert.Len(t, cached, 2)
+
+	var entries []CachedItem
+	assert.NoError(t, db.All(&entries))
+	assert.Len(t, entries, 2)
+
+	// a changed item is decrypted again and its previous entry replaced
+	_, err = UpdateNoteText(db, session, one.UUID, "changed")
+	assert.NoError(t, err)
+	assert.NoError(t, DeleteItem(db, two.UUID))
+
+	cached, err = ReadCachedItems(db, session, "Note")
+	assert.NoError(t, err)
+	assert.Len(t, cached, 1)
+	assert.Equal(t, "one", cached[0].Title)
+	assert.Equal(t, "changed", cached[0].Text)
+
+	cached, err = ReadCachedItems(db, session, "")
+	assert.NoError(t, err)
+	assert.Len(t, cached, 2)
+
+	assert.NoError(t, db.All(&entries))
+	assert.Len(t, entries, 2)
+
+	assert.NoError(t, ClearCache(db))
+	assert.NoError(t, db.All(&entries))
+	assert.Empty(t, entries)
+}
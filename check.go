@@ -0,0 +1,186 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// CheckReport describes the problems found, and repaired, by CheckDB
+type CheckReport struct {
+	// inconsistencies found in the bolt file, which cannot be repaired in place so nothing else is checked
+	Corruption []string
+	// types whose storm indexes were rebuilt
+	Reindexed []string
+	// sync tokens removed as a later token has been saved, only the latest is used
+	OrphanTokens int
+	// title, reference, search and cache entries removed as the items they index no longer exist
+	DanglingEntries int
+}
+
+// Corrupt returns true if the bolt file is inconsistent, the DB should then be restored from a backup or removed
+// and populated again
+func (r CheckReport) Corrupt() bool {
+	return len(r.Corruption) > 0
+}
+
+// indexedTypes are the types whose storm indexes are rebuilt by CheckDB
+var indexedTypes = []struct {
+	name string
+	data interface{}
+}{
+	{"Item", &Item{}},
+	{"SyncToken", &SyncToken{}},
+	{"TitleEntry", &TitleEntry{}},
+	{"Reference", &Reference{}},
+	{"CachedItem", &CachedItem{}},
+	{"searchPosting", &searchPosting{}},
+}
+
+// CheckDB checks the consistency of the bolt file and repairs what is left inconsistent by a process that was
+// killed part way through a series of writes: storm indexes are rebuilt, sync tokens superseded by a later one
+// are removed and index entries for items that no longer exist are removed
+func CheckDB(db *storm.DB) (report CheckReport, err error) {
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		for cErr := range tx.Check() {
+			report.Corruption = append(report.Corruption, cErr.Error())
+		}
+
+		return nil
+	})
+	if err != nil || report.Corrupt() {
+		return
+	}
+
+	for _, t := range indexedTypes {
+		if err = db.ReIndex(t.data); err != nil {
+			if errors.Is(err, storm.ErrNotFound) {
+				continue
+			}
+
+			return
+		}
+
+		report.Reindexed = append(report.Reindexed, t.name)
+	}
+
+	if report.OrphanTokens, err = removeOrphanTokens(db); err != nil {
+		return
+	}
+
+	report.DanglingEntries, err = removeDanglingEntries(db)
+
+	return
+}
+
+// removeOrphanTokens removes every sync token but the latest, as getSyncToken does, returning the number removed
+func removeOrphanTokens(db *storm.DB) (removed int, err error) {
+	var before, after int
+
+	if before, err = db.Count(&SyncToken{}); err != nil {
+		return
+	}
+
+	if _, err = getSyncToken(db); err != nil {
+		return
+	}
+
+	if after, err = db.Count(&SyncToken{}); err != nil {
+		return
+	}
+
+	return before - after, nil
+}
+
+// removeDanglingEntries removes the index and cache entries of items that are not in the DB
+func removeDanglingEntries(db *storm.DB) (removed int, err error) {
+	var items []Item
+
+	if err = db.All(&items); err != nil {
+		return
+	}
+
+	live := make(map[string]bool, len(items))
+	for _, i := range items {
+		live[i.UUID] = !i.Deleted
+	}
+
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var titles []TitleEntry
+
+	if err = tx.All(&titles); err != nil {
+		return
+	}
+
+	for x := range titles {
+		if !live[titles[x].UUID] {
+			if err = tx.DeleteStruct(&titles[x]); err != nil {
+				return
+			}
+
+			removed++
+		}
+	}
+
+	var refs []Reference
+
+	if err = tx.All(&refs); err != nil {
+		return
+	}
+
+	for x := range refs {
+		if !live[refs[x].Parent] {
+			if err = tx.DeleteStruct(&refs[x]); err != nil {
+				return
+			}
+
+			removed++
+		}
+	}
+
+	var docs []searchDoc
+
+	if err = tx.All(&docs); err != nil {
+		return
+	}
+
+	for _, d := range docs {
+		if !live[d.UUID] {
+			if err = (stormTx{node: tx}).SetSearchTerms(d.UUID, nil); err != nil {
+				return
+			}
+
+			removed++
+		}
+	}
+
+	var cached []CachedItem
+
+	if err = tx.All(&cached); err != nil {
+		return
+	}
+
+	for x := range cached {
+		if !live[cached[x].UUID] {
+			if err = tx.DeleteStruct(&cached[x]); err != nil {
+				return
+			}
+
+			removed++
+		}
+	}
+
+	return removed, tx.Commit()
+}
@@ -0,0 +1,47 @@
+package snpersist
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCheckDB(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, db.Save(&Item{UUID: "live", ContentType: "Note"}))
+	assert.NoError(t, db.Save(&TitleEntry{UUID: "live", ContentType: "Note", Title: "live"}))
+
+	// entries left behind for an item that has since been removed
+	assert.NoError(t, db.Save(&TitleEntry{UUID: "gone", ContentType: "Note", Title: "gone"}))
+	assert.NoError(t, db.Save(&Reference{ID: "gone/live", Parent: "gone", Child: "live", ContentType: "Note"}))
+	assert.NoError(t, (stormTx{node: db}).SetSearchTerms("gone", map[string]int{"gone": 1}))
+
+	// a superseded sync token that was not removed
+	assert.NoError(t, db.Save(&SyncToken{SyncToken: "old", SavedAt: time.Now().Add(-time.Hour)}))
+	assert.NoError(t, db.Save(&SyncToken{SyncToken: "new", SavedAt: time.Now()}))
+
+	report, err := CheckDB(db)
+	assert.NoError(t, err)
+	assert.False(t, report.Corrupt())
+	assert.Contains(t, report.Reindexed, "Item")
+	assert.Equal(t, 1, report.OrphanTokens)
+	assert.Equal(t, 3, report.DanglingEntries)
+
+	st, err := getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", st.SyncToken)
+
+	entries, err := SearchTitles(db, "")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// everything is now consistent
+	report, err = CheckDB(db)
+	assert.NoError(t, err)
+	assert.Zero(t, report.OrphanTokens)
+	assert.Zero(t, report.DanglingEntries)
+}
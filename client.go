@@ -0,0 +1,138 @@
+package snpersist
+
+import (
+	"context"
+	"github.com/asdine/storm/v3"
+	"sync"
+	"time"
+)
+
+// Client owns the DB, or store, described by a SyncInput for the lifetime of an application
+// a DB opened from DBPath is closed by Close, whereas a DB or Store provided by the caller is left open
+type Client struct {
+	input  SyncInput
+	ownsDB bool
+
+	// held for reading whilst the DB is in use and for writing whilst it is closed
+	mu     sync.RWMutex
+	closed bool
+
+	// guards the input's session, which is replaced by one refreshed by a sync
+	sessionMu sync.Mutex
+}
+
+// NewClient returns a client for the input, opening the DB at DBPath if one is provided
+func NewClient(si SyncInput) (c *Client, err error) {
+	if si.DB != nil && si.DBPath != "" || si.Store != nil && (si.DB != nil || si.DBPath != "") {
+		return nil, ErrConflictingDBArgs
+	}
+
+	if si.Store == nil && si.DB == nil && si.DBPath == "" {
+		return nil, ErrNoDB
+	}
+
+	c = &Client{}
+
+	if si.DBPath != "" {
+		var db *storm.DB
+
+		db, err = si.openDB()
+		if err != nil {
+			return nil, err
+		}
+
+		si.DB = db
+		si.DBPath = ""
+		c.ownsDB = true
+	}
+
+	c.input = si
+
+	return c, nil
+}
+
+// DB returns the client's DB, or nil if it was created with a Store
+func (c *Client) DB() *storm.DB {
+	return c.input.DB
+}
+
+// Store returns the client's store, wrapping its DB unless it was created with a Store
+func (c *Client) Store() Store {
+	if c.input.Store != nil {
+		return c.input.Store
+	}
+
+	return &StormStore{db: c.input.DB}
+}
+
+// Sync syncs the client's DB with SN
+func (c *Client) Sync() (SyncOutput, error) {
+	return c.SyncWithContext(context.Background())
+}
+
+// SyncWithContext is Sync with cancellation checked before each call to SN and each DB update
+func (c *Client) SyncWithContext(ctx context.Context) (so SyncOutput, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return so, ErrClosed
+	}
+
+	c.sessionMu.Lock()
+	si := c.input
+	c.sessionMu.Unlock()
+
+	so, err = SyncWithContext(ctx, si)
+
+	// a refreshed session is kept for later syncs so they do not refresh it again
+	if so.Session.Valid() {
+		c.sessionMu.Lock()
+		c.input.Session = so.Session
+		c.sessionMu.Unlock()
+	}
+
+	return
+}
+
+// Close closes the DB if the client opened it, later syncs return ErrClosed and later calls to Close do nothing
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.close()
+}
+
+// FlushAndClose pushes the dirty items, as Flush, before closing the client
+// the client is closed even if the flush fails, remaining is the number of dirty items left in the DB
+func (c *Client) FlushAndClose(timeout time.Duration) (remaining int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	remaining, err = Flush(c.input, timeout)
+
+	if cErr := c.close(); err == nil {
+		err = cErr
+	}
+
+	return
+}
+
+// close closes the DB, if owned, the first time it is called and must be called with mu held
+func (c *Client) close() error {
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+
+	if c.ownsDB {
+		return c.input.DB.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-1"},
+		{SavedItems: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-2"},
+	}}
+
+	c, err := NewClient(SyncInput{Session: offlineSession(), DBPath: tempDBPath, Syncer: fs})
+	assert.NoError(t, err)
+	assert.NotNil(t, c.DB())
+
+	so, err := c.Sync()
+	assert.NoError(t, err)
+	assert.Equal(t, c.DB(), so.DB)
+
+	assert.NoError(t, MarkDirty(c.DB(), []string{"a"}))
+
+	// closing flushes the dirty items and closes the DB the client opened
+	remaining, err := c.FlushAndClose(time.Minute)
+	assert.NoError(t, err)
+	assert.Zero(t, remaining)
+	assert.Len(t, fs.inputs, 2)
+	assert.Len(t, fs.inputs[1].Items, 1)
+
+	_, err = c.Sync()
+	assert.True(t, errors.Is(err, ErrClosed))
+	assert.NoError(t, c.Close())
+
+	// the DB can be reopened once closed
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// a DB provided by the caller is left open
+	c, err = NewClient(SyncInput{Session: offlineSession(), DB: db, Syncer: fs})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 1)
+}
+
+func TestClientKeepsRefreshedSession(t *testing.T) {
+	var refreshes int
+
+	c, err := NewClient(SyncInput{
+		Session: offlineSession(),
+		Store:   NewMemoryStore(),
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			if input.Session.Token != "refreshed" {
+				return gosn.SyncOutput{}, &HTTPError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+			}
+
+			return gosn.SyncOutput{SyncToken: "token"}, nil
+		}),
+		RefreshSession: func(s gosn.Session) (gosn.Session, error) {
+			refreshes++
+			s.Token = "refreshed"
+
+			return s, nil
+		},
+	})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	for x := 0; x < 2; x++ {
+		_, err = c.Sync()
+		assert.NoError(t, err)
+	}
+
+	// the second sync uses the session refreshed by the first
+	assert.Equal(t, 1, refreshes)
+}
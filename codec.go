@@ -0,0 +1,158 @@
+package snpersist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/codec"
+	stormjson "github.com/asdine/storm/v3/codec/json"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// name of the bucket storm uses to record, amongst other things, the codec a bucket was written with
+const stormMetadataBucket = "__storm_metadata"
+
+// GzipCodec stores values as gzip compressed JSON
+// the codec is fixed when a DB is created so a DB created with it must always be opened with it
+var GzipCodec codec.MarshalUnmarshaler = gzipJSONCodec{}
+
+type gzipJSONCodec struct{}
+
+func (c gzipJSONCodec) Marshal(v interface{}) (b []byte, err error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+
+	if err = json.NewEncoder(zw).Encode(v); err != nil {
+		return
+	}
+
+	if err = zw.Close(); err != nil {
+		return
+	}
+
+	return buf.Bytes(), err
+}
+
+func (c gzipJSONCodec) Unmarshal(b []byte, v interface{}) (err error) {
+	var zr *gzip.Reader
+
+	zr, err = gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("value was not written with the %s codec: %v", c.Name(), err)
+	}
+
+	var raw []byte
+
+	raw, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return
+	}
+
+	return json.Unmarshal(raw, v)
+}
+
+func (c gzipJSONCodec) Name() string {
+	return "gzip-json"
+}
+
+// OpenCompressed opens, or creates, a DB at the provided path with values stored using GzipCodec
+func OpenCompressed(dbPath string, options ...func(*storm.Options) error) (*storm.DB, error) {
+	return openWithCodec(dbPath, GzipCodec, options...)
+}
+
+// openWithCodec opens, or creates, a DB at the provided path using the codec, or JSON if nil
+// an existing DB created with a different codec is rejected before storm opens it
+// and an existing DB with an older schema version is migrated
+// a DB held by another process is waited for up to openTimeout, or the timeout set by storm.BoltOptions,
+// before returning a DBLockedError
+func openWithCodec(dbPath string, c codec.MarshalUnmarshaler, options ...func(*storm.Options) error) (db *storm.DB, err error) {
+	if c == nil {
+		c = stormjson.Codec
+	}
+
+	if err = checkCodec(dbPath, c, boltTimeout(options...)); err != nil {
+		return nil, lockedError(dbPath, err)
+	}
+
+	defaults := []func(*storm.Options) error{storm.Codec(c), storm.BoltOptions(0600, &bolt.Options{Timeout: openTimeout})}
+
+	db, err = storm.Open(dbPath, append(defaults, options...)...)
+	if err != nil {
+		return nil, lockedError(dbPath, err)
+	}
+
+	if err = writeLockFile(dbPath); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if err = migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return
+}
+
+// checkCodec ensures the buckets of an existing DB were written with the provided codec
+// waiting up to timeout for another process to release the DB
+func checkCodec(dbPath string, c codec.MarshalUnmarshaler, timeout time.Duration) (err error) {
+	if _, err = os.Stat(dbPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	var bdb *bolt.DB
+
+	bdb, err = bolt.Open(dbPath, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout})
+	if err != nil {
+		return
+	}
+
+	defer bdb.Close()
+
+	return bdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			meta := b.Bucket([]byte(stormMetadataBucket))
+			if meta == nil {
+				return nil
+			}
+
+			if got := string(meta.Get([]byte("codec"))); got != "" && got != c.Name() {
+				return fmt.Errorf("%w: DB was created with the %s codec but opened with the %s codec", ErrCodecMismatch, got, c.Name())
+			}
+
+			return nil
+		})
+	})
+}
+
+// storedCodec returns the codec the DB at dbPath was created with, GzipCodec or nil for JSON
+// waiting up to timeout for another process to release the DB
+func storedCodec(dbPath string, timeout time.Duration) (c codec.MarshalUnmarshaler, err error) {
+	var bdb *bolt.DB
+
+	bdb, err = bolt.Open(dbPath, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout})
+	if err != nil {
+		return nil, lockedError(dbPath, err)
+	}
+
+	defer bdb.Close()
+
+	err = bdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if meta := b.Bucket([]byte(stormMetadataBucket)); meta != nil && string(meta.Get([]byte("codec"))) == GzipCodec.Name() {
+				c = GzipCodec
+			}
+
+			return nil
+		})
+	})
+
+	return
+}
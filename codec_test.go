@@ -0,0 +1,28 @@
+package snpersist
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOpenCompressed(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	db, err := OpenCompressed(tempDBPath)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", Content: "003:a"}))
+	assert.NoError(t, db.Close())
+
+	// reopening with the default codec should fail rather than corrupt the DB
+	_, err = Open(tempDBPath)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "gzip-json")
+
+	db, err = OpenCompressed(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "a", &stored))
+	assert.Equal(t, "003:a", stored.Content)
+}
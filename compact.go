@@ -0,0 +1,178 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+	"os"
+)
+
+// compactSuffix is appended to a DB's path to name the file it is compacted into
+const compactSuffix = ".compact"
+
+// Compact copies the live data of the DB at dbPath into a new file, which then replaces it, returning the number
+// of bytes reclaimed
+// bolt files never shrink, so this recovers the space left free after removing items
+// the DB must not be open, ErrDBLocked is returned if another process holds it for longer than openTimeout,
+// or the timeout set by storm.BoltOptions amongst the options
+func Compact(dbPath string, options ...func(*storm.Options) error) (reclaimed int64, err error) {
+	var info os.FileInfo
+
+	if info, err = os.Stat(dbPath); err != nil {
+		return
+	}
+
+	var src *bolt.DB
+
+	if src, err = bolt.Open(dbPath, info.Mode(), &bolt.Options{Timeout: boltTimeout(options...)}); err != nil {
+		return 0, lockedError(dbPath, err)
+	}
+
+	defer func() {
+		if src != nil {
+			_ = src.Close()
+		}
+	}()
+
+	tmpPath := dbPath + compactSuffix
+
+	if err = os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	var dst *bolt.DB
+
+	if dst, err = bolt.Open(tmpPath, info.Mode(), nil); err != nil {
+		return
+	}
+
+	if err = copyBolt(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmpPath)
+
+		return
+	}
+
+	if err = dst.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+
+		return
+	}
+
+	// the source is held until the copy is complete so it cannot change in the meantime
+	err = src.Close()
+	src = nil
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+
+		return
+	}
+
+	var compacted os.FileInfo
+
+	if compacted, err = os.Stat(tmpPath); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmpPath, dbPath); err != nil {
+		return
+	}
+
+	return info.Size() - compacted.Size(), nil
+}
+
+// copyBolt copies every bucket of src into dst, one top level bucket per transaction
+func copyBolt(dst, src *bolt.DB) error {
+	return src.View(func(srcTx *bolt.Tx) error {
+		return srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return dst.Update(func(dstTx *bolt.Tx) error {
+				nb, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+
+				return copyBucket(nb, b)
+			})
+		})
+	})
+}
+
+// copyBucket copies the keys, nested buckets and sequence of src into dst
+func copyBucket(dst, src *bolt.Bucket) (err error) {
+	// pack pages completely, later writes split them as usual
+	dst.FillPercent = 1
+
+	if err = dst.SetSequence(src.Sequence()); err != nil {
+		return
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		// nested buckets have no value
+		if v == nil {
+			nb, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+
+			return copyBucket(nb, src.Bucket(k))
+		}
+
+		return dst.Put(k, v)
+	})
+}
+
+// FreeRatio returns the proportion, from 0 to 1, of the DB's file that is free pages, which Compact reclaims
+func FreeRatio(db *storm.DB) (ratio float64, err error) {
+	return freeRatio(db.Bolt)
+}
+
+// freeRatio returns the proportion of the bolt file that is free pages
+func freeRatio(db *bolt.DB) (ratio float64, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		size := tx.Size()
+		if size == 0 {
+			return nil
+		}
+
+		stats := db.Stats()
+		free := int64(stats.FreePageN+stats.PendingPageN) * int64(db.Info().PageSize)
+		ratio = float64(free) / float64(size)
+
+		return nil
+	})
+
+	return
+}
+
+// compactIfFree compacts the DB at dbPath, if it exists, when the proportion of it that is free exceeds threshold
+// the DB is opened with the timeout set by the options, see Compact
+func compactIfFree(dbPath string, threshold float64, options ...func(*storm.Options) error) (err error) {
+	var info os.FileInfo
+
+	if info, err = os.Stat(dbPath); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+
+		return
+	}
+
+	var db *bolt.DB
+
+	if db, err = bolt.Open(dbPath, info.Mode(), &bolt.Options{Timeout: boltTimeout(options...)}); err != nil {
+		return lockedError(dbPath, err)
+	}
+
+	ratio, err := freeRatio(db)
+	if cErr := db.Close(); err == nil {
+		err = cErr
+	}
+
+	if err != nil || ratio <= threshold {
+		return
+	}
+
+	_, err = Compact(dbPath, options...)
+
+	return
+}
@@ -0,0 +1,152 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+
+	fillAndEmpty(t, db)
+
+	// an open DB cannot be compacted, and is waited for as long as the options set
+	start := time.Now()
+	_, err = Compact(tempDBPath, storm.BoltOptions(0600, &bolt.Options{Timeout: 10 * time.Millisecond}))
+	assert.True(t, errors.Is(err, ErrDBLocked))
+	assert.True(t, time.Since(start) < openTimeout/2)
+
+	assert.NoError(t, db.Close())
+
+	reclaimed, err := Compact(tempDBPath)
+	assert.NoError(t, err)
+	assert.True(t, reclaimed > 0)
+
+	db, err = Open(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 1)
+	assert.Equal(t, strings.Repeat("x", 1000), all[0].Content)
+
+	// the DB's indexes were copied
+	var notes []Item
+	assert.NoError(t, db.Find("ContentType", "Note", &notes))
+	assert.Len(t, notes, 1)
+}
+
+// fillAndEmpty saves many items to the DB and removes all but the first, leaving most of the file free
+func fillAndEmpty(t *testing.T, db *storm.DB) {
+	content := strings.Repeat("x", 1000)
+
+	for x := 0; x < 500; x++ {
+		assert.NoError(t, db.Save(&Item{UUID: fmt.Sprintf("item-%d", x), ContentType: "Note", Content: content}))
+	}
+
+	for x := 1; x < 500; x++ {
+		assert.NoError(t, db.DeleteStruct(&Item{UUID: fmt.Sprintf("item-%d", x)}))
+	}
+}
+
+func TestSyncCompactsOnOpen(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+
+	fillAndEmpty(t, db)
+
+	ratio, err := FreeRatio(db)
+	assert.NoError(t, err)
+	assert.True(t, ratio > 0.5)
+	assert.NoError(t, db.Close())
+
+	before, err := os.Stat(tempDBPath)
+	assert.NoError(t, err)
+
+	so, err := Sync(SyncInput{DBPath: tempDBPath, Offline: true, CompactThreshold: 0.5})
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	after, err := os.Stat(tempDBPath)
+	assert.NoError(t, err)
+	assert.True(t, after.Size() < before.Size())
+	assert.Len(t, so.Items, 1)
+}
+
+func TestSyncRunnerCompacts(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token-1"}}}
+
+	r, err := NewSyncRunner(SyncInput{Session: offlineSession(), DBPath: tempDBPath, Syncer: fs, CompactThreshold: 0.5}, time.Hour)
+	assert.NoError(t, err)
+
+	opened := r.DB()
+	fillAndEmpty(t, opened)
+
+	_, err = r.Sync()
+	assert.NoError(t, err)
+
+	// the DB was compacted and reopened
+	assert.NotEqual(t, opened, r.DB())
+
+	ratio, err := FreeRatio(r.DB())
+	assert.NoError(t, err)
+	assert.True(t, ratio < 0.5)
+
+	var all []Item
+	assert.NoError(t, r.DB().All(&all))
+	assert.Len(t, all, 1)
+
+	assert.NoError(t, r.Stop())
+}
+
+func TestSyncRunnerStopsWhenReopenFails(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token-1"}}}
+
+	r, err := NewSyncRunner(SyncInput{Session: offlineSession(), DBPath: tempDBPath, Syncer: fs, CompactThreshold: 0.5}, time.Hour)
+	assert.NoError(t, err)
+
+	fillAndEmpty(t, r.DB())
+
+	// reopening with another codec fails
+	r.opened.Codec = GzipCodec
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		// the DB can be read whilst it is replaced
+		for x := 0; x < 100; x++ {
+			_ = r.DB()
+		}
+	}()
+
+	_, err = r.Sync()
+	assert.NoError(t, err)
+
+	<-done
+
+	assert.Nil(t, r.DB())
+	assert.Error(t, r.ctx.Err())
+
+	_, err = r.Sync()
+	assert.Equal(t, ErrClosed, err)
+
+	assert.NoError(t, r.Stop())
+}
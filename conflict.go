@@ -0,0 +1,220 @@
+package snpersist
+
+import (
+	"fmt"
+	"github.com/jonhadfield/gosn-v2"
+	"time"
+)
+
+// ConflictPolicy determines what happens when an item retrieved from SN collides with a dirty local copy
+type ConflictPolicy int
+
+const (
+	// NewestWins keeps whichever of the local and retrieved copies was updated most recently, the local copy
+	// being updated when it was last made dirty
+	NewestWins ConflictPolicy = iota
+	// ServerWins replaces the local copy with the retrieved copy, discarding the local changes
+	ServerWins
+	// ClientWins keeps the local copy so it is pushed with the next sync
+	ClientWins
+	// DuplicateLocal saves the retrieved copy and keeps the local changes as a new dirty item
+	DuplicateLocal
+	// Callback calls SyncInput.ConflictFunc to decide the outcome
+	Callback
+	// ConflictCopy saves the retrieved copy and keeps the local changes as a new dirty item titled as a conflicted copy
+	ConflictCopy
+	// Merge merges notes changed on both sides using the last synced copy as the base
+	// items that cannot be merged, such as notes whose changes overlap, are resolved as ConflictCopy
+	Merge
+	// MergeConcurrent is an experimental variant of Merge that never creates conflicted copies of notes
+	// overlapping changes to the text or title keep both versions, one after the other, in an order that does not
+	// depend on which side is local, so devices editing the same note offline converge whichever of them merges
+	// no operation log is kept, as only the notes themselves are synced, so the versions are not interleaved
+	MergeConcurrent
+)
+
+// prefix of the title given to the local copy of a note kept by ConflictCopy
+const conflictedCopyTitle = "Conflicted copy"
+
+// ConflictFunc resolves a collision between a dirty local item and the copy retrieved from SN
+// the returned item is saved in place of both, and should be marked dirty if it needs to be pushed
+type ConflictFunc func(local, remote Item) (resolved Item, err error)
+
+// ConflictResolution describes how a conflict was resolved
+type ConflictResolution int
+
+const (
+	// Unresolved means SN refused to save the local item, which remains dirty
+	Unresolved ConflictResolution = iota
+	// KeptLocal means the local item was kept, to be pushed with the next sync, and the retrieved copy discarded
+	KeptLocal
+	// KeptRemote means the retrieved copy replaced the local item, discarding the local changes
+	KeptRemote
+	// Duplicated means the retrieved copy replaced the local item and the local changes were saved as a new item
+	Duplicated
+	// Merged means the local and retrieved copies were merged into a note to be pushed with the next sync
+	Merged
+	// Resolved means SyncInput.ConflictFunc returned the item saved in place of both copies
+	Resolved
+)
+
+func (r ConflictResolution) String() string {
+	switch r {
+	case Unresolved:
+		return "Unresolved"
+	case KeptLocal:
+		return "KeptLocal"
+	case KeptRemote:
+		return "KeptRemote"
+	case Duplicated:
+		return "Duplicated"
+	case Merged:
+		return "Merged"
+	case Resolved:
+		return "Resolved"
+	default:
+		return "Unknown"
+	}
+}
+
+// savesRemote reports whether the retrieved copy is then saved in place of the local item
+func (r ConflictResolution) savesRemote() bool {
+	return r == KeptRemote || r == Duplicated
+}
+
+// Conflict describes a dirty local item that SN refused to save or that collided with a retrieved item
+type Conflict struct {
+	Local      Item // the dirty local item
+	Remote     Item // the copy retrieved from SN, zero if the conflict is Unresolved
+	Resolution ConflictResolution
+}
+
+// resolveConflict applies the input's conflict policy to a retrieved item that collides with a dirty local item
+func resolveConflict(tx StoreTx, si SyncInput, local Item, remote gosn.EncryptedItem) (resolution ConflictResolution, err error) {
+	switch si.ConflictPolicy {
+	case ServerWins:
+		return KeptRemote, nil
+	case ClientWins:
+		return KeptLocal, keepLocal(tx, local, remote)
+	case DuplicateLocal:
+		return Duplicated, duplicateItem(tx, si, local, false)
+	case ConflictCopy:
+		return Duplicated, duplicateItem(tx, si, local, true)
+	case Merge, MergeConcurrent:
+		var merged bool
+		if merged, err = mergeNote(tx, si, local, remote, si.ConflictPolicy == MergeConcurrent); err != nil || merged {
+			return Merged, err
+		}
+
+		return Duplicated, duplicateItem(tx, si, local, true)
+	case Callback:
+		if si.ConflictFunc == nil {
+			return Unresolved, ErrNoConflictFunc
+		}
+
+		var resolved Item
+
+		resolved, err = si.ConflictFunc(local, ConvertItemsToPersistItems(gosn.EncryptedItems{remote})[0])
+		if err != nil {
+			return
+		}
+
+		return Resolved, tx.SaveItem(resolved)
+	default:
+		if localUpdate(local).After(remoteUpdate(remote)) {
+			return KeptLocal, keepLocal(tx, local, remote)
+		}
+
+		return KeptRemote, nil
+	}
+}
+
+// localUpdate returns the time of the last local change to a dirty item
+// items keep the updated_at SN gave them, so this is when the item was last made dirty, if recorded
+func localUpdate(local Item) time.Time {
+	if !local.DirtiedDate.IsZero() {
+		return local.DirtiedDate
+	}
+
+	updated, _ := time.Parse(time.RFC3339Nano, local.UpdatedAt)
+
+	return updated
+}
+
+// remoteUpdate returns the time SN last saved a retrieved item, or the zero time if it cannot be parsed
+// so the local copy is kept
+func remoteUpdate(remote gosn.EncryptedItem) time.Time {
+	updated, _ := time.Parse(time.RFC3339Nano, remote.UpdatedAt)
+
+	return updated
+}
+
+// keepLocal keeps a dirty local item in place of the retrieved copy, adopting the retrieved copy's timestamp
+// SN refuses items pushed with an updated_at other than that of its own copy, so without it the local item
+// would be returned as unsaved by every sync
+func keepLocal(tx StoreTx, local Item, remote gosn.EncryptedItem) error {
+	local.UpdatedAt = remote.UpdatedAt
+
+	// the retrieved copy is now the last synced copy
+	local.BaseContent = remote.Content
+	local.BaseEncItemKey = remote.EncItemKey
+
+	return tx.SaveItem(local)
+}
+
+// duplicateItem saves a copy of a local item under a new UUID, marked dirty so it is pushed with the next sync
+// the item's content is bound to its UUID so the copy must be decrypted and encrypted again, as a 004 item
+// if the sync has an items key
+// a conflicted copy of a note is retitled and records the UUID of the item it was copied from
+func duplicateItem(tx StoreTx, si SyncInput, local Item, conflicted bool) (err error) {
+	session := si.Session
+
+	var keys []ItemsKey
+
+	if keys, err = si.keys(); err != nil {
+		return
+	}
+
+	var items gosn.Items
+
+	items, err = Items{local}.ToItems(session, keys...)
+	if err != nil {
+		return
+	}
+
+	if len(items) != 1 {
+		return fmt.Errorf("failed to decrypt item %s", local.UUID)
+	}
+
+	items[0].SetUUID(gosn.GenUUID())
+
+	if note, ok := items[0].(*gosn.Note); ok && conflicted {
+		note.Content.SetTitle(conflictedTitle(note.Content.GetTitle()))
+	}
+
+	var eItems gosn.EncryptedItems
+
+	eItems, err = encryptItems(items, session, keys)
+	if err != nil {
+		return
+	}
+
+	dup := ConvertItemsToPersistItems(eItems)[0]
+	dup.Dirty = true
+	dup.DirtiedDate = time.Now()
+
+	if conflicted {
+		dup.ConflictOf = local.UUID
+	}
+
+	return tx.SaveItem(dup)
+}
+
+// conflictedTitle returns the title of a conflicted copy of a note with the given title
+func conflictedTitle(title string) string {
+	if title == "" {
+		return conflictedCopyTitle
+	}
+
+	return fmt.Sprintf("%s of %s", conflictedCopyTitle, title)
+}
@@ -0,0 +1,261 @@
+package snpersist
+
+import (
+	"context"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// setupConflict saves a dirty local note and returns a newer copy of it as if retrieved from SN
+func setupConflict(t *testing.T, db *storm.DB, session gosn.Session) (local Item, remote gosn.EncryptedItem) {
+	note, _ := createNote("local", "")
+	note.UpdatedAt = "2020-05-19T10:00:00.000Z"
+	dItems := gosn.Items{&note}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	local = ConvertItemsToPersistItems(eItems)[0]
+	local.Dirty = true
+	// the local change was made before the retrieved copy was saved by SN
+	local.DirtiedDate = time.Date(2020, 5, 19, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, db.Save(&local))
+
+	note.Content.Title = "remote"
+	note.UpdatedAt = "2020-05-20T10:00:00.000Z"
+	eItems, err = dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	return local, eItems[0]
+}
+
+func TestConflictPolicies(t *testing.T) {
+	session := offlineSession()
+
+	for _, policy := range []ConflictPolicy{NewestWins, ServerWins, ClientWins, DuplicateLocal, Callback, ConflictCopy} {
+		db, err := storm.Open(tempDBPath)
+		assert.NoError(t, err)
+
+		local, remote := setupConflict(t, db, session)
+
+		si := SyncInput{
+			DB:             db,
+			Session:        session,
+			ConflictPolicy: policy,
+			ConflictFunc: func(local, remote Item) (Item, error) {
+				local.Content = "merged"
+				return local, nil
+			},
+		}
+
+		var conflicts []Conflict
+		conflicts, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, si, nil, gosn.SyncOutput{Items: gosn.EncryptedItems{remote}, SyncToken: "after"})
+		assert.NoError(t, err)
+		assert.Len(t, conflicts, 1)
+		assert.Equal(t, local.UUID, conflicts[0].Local.UUID)
+		assert.Equal(t, local.Content, conflicts[0].Local.Content)
+		assert.Equal(t, remote.Content, conflicts[0].Remote.Content)
+
+		var stored Item
+		assert.NoError(t, db.One("UUID", local.UUID, &stored))
+
+		var all []Item
+		assert.NoError(t, db.All(&all))
+
+		switch policy {
+		case NewestWins, ServerWins:
+			assert.Equal(t, KeptRemote, conflicts[0].Resolution)
+			assert.Equal(t, remote.Content, stored.Content)
+			assert.False(t, stored.Dirty)
+			assert.Len(t, all, 1)
+		case ClientWins:
+			assert.Equal(t, KeptLocal, conflicts[0].Resolution)
+			assert.Equal(t, local.Content, stored.Content)
+			assert.True(t, stored.Dirty)
+		case DuplicateLocal:
+			assert.Equal(t, Duplicated, conflicts[0].Resolution)
+			assert.Equal(t, remote.Content, stored.Content)
+			assert.Len(t, all, 2)
+
+			var items gosn.Items
+			items, err = ReadItems(db, session, "Note")
+			assert.NoError(t, err)
+
+			var titles []string
+			for _, n := range items.Notes() {
+				titles = append(titles, n.Content.Title)
+			}
+			assert.ElementsMatch(t, []string{"local", "remote"}, titles)
+		case Callback:
+			assert.Equal(t, Resolved, conflicts[0].Resolution)
+			assert.Equal(t, "merged", stored.Content)
+			assert.True(t, stored.Dirty)
+		case ConflictCopy:
+			assert.Equal(t, Duplicated, conflicts[0].Resolution)
+			assert.Equal(t, remote.Content, stored.Content)
+			assert.Len(t, all, 2)
+
+			for _, i := range all {
+				if i.UUID != local.UUID {
+					assert.Equal(t, local.UUID, i.ConflictOf)
+					assert.True(t, i.Dirty)
+				}
+			}
+
+			var items gosn.Items
+			items, err = ReadItems(db, session, "Note")
+			assert.NoError(t, err)
+
+			var titles []string
+			for _, n := range items.Notes() {
+				titles = append(titles, n.Content.Title)
+			}
+			assert.ElementsMatch(t, []string{"Conflicted copy of local", "remote"}, titles)
+		}
+
+		assert.NoError(t, db.Close())
+		removeDB(tempDBPath)
+	}
+}
+
+func TestClientWinsIsPushed(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	local, remote := setupConflict(t, db, session)
+
+	// the server refuses items pushed with an updated_at other than that of its copy
+	server := map[string]gosn.EncryptedItem{remote.UUID: remote}
+	retrieved := false
+
+	syncer := SyncerFunc(func(input gosn.SyncInput) (output gosn.SyncOutput, err error) {
+		for _, i := range input.Items {
+			if s, ok := server[i.UUID]; ok && s.UpdatedAt != i.UpdatedAt {
+				output.Unsaved = append(output.Unsaved, i)
+				continue
+			}
+
+			i.UpdatedAt = "2020-05-21T10:00:00.000Z"
+			server[i.UUID] = i
+			output.SavedItems = append(output.SavedItems, i)
+		}
+
+		if !retrieved {
+			output.Items = gosn.EncryptedItems{remote}
+			retrieved = true
+		}
+
+		output.SyncToken = "token"
+
+		return
+	})
+
+	si := SyncInput{DB: db, Session: session, ConflictPolicy: ClientWins, Syncer: syncer}
+
+	so, err := Sync(si)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, so.Conflicts)
+
+	so, err = Sync(si)
+	assert.NoError(t, err)
+	assert.Empty(t, so.Conflicts)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", local.UUID, &stored))
+	assert.False(t, stored.Dirty)
+	assert.Equal(t, local.Content, stored.Content)
+	assert.Equal(t, local.Content, server[local.UUID].Content)
+}
+
+func TestNewestWinsComparesLocalEdit(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	// the local change was made after the retrieved copy was saved, though its updated_at is older
+	local, remote := setupConflict(t, db, session)
+	local.DirtiedDate = time.Now()
+	assert.NoError(t, db.Save(&local))
+
+	si := SyncInput{DB: db, Session: session}
+
+	conflicts, _, err := persistSyncOutput(context.Background(), &StormStore{db: db}, si, nil, gosn.SyncOutput{Items: gosn.EncryptedItems{remote}, SyncToken: "after"})
+	assert.NoError(t, err)
+	assert.Len(t, conflicts, 1)
+	assert.Equal(t, KeptLocal, conflicts[0].Resolution)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", local.UUID, &stored))
+	assert.Equal(t, local.Content, stored.Content)
+	assert.Equal(t, remote.UpdatedAt, stored.UpdatedAt)
+	assert.True(t, stored.Dirty)
+}
+
+// setupConflict004 saves an items key and a dirty 004 note with the local content, last synced with the base
+// content if not empty, and returns it along with a retrieved copy of the note with the remote content
+func setupConflict004(t *testing.T, db *storm.DB, session gosn.Session, base, local, remote string) (Item, gosn.EncryptedItem) {
+	itemsKey := randomKey(t)
+	key := encrypt004(t, "items-key", itemsKeyContentType, `{"itemsKey":"`+itemsKey+`","version":"004"}`, session.Mk)
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{key}))
+
+	l := ConvertItemsToPersistItems(gosn.EncryptedItems{encrypt004(t, "note", "Note", local, itemsKey)})[0]
+	l.Dirty = true
+	l.DirtiedDate = time.Date(2020, 5, 19, 10, 0, 0, 0, time.UTC)
+
+	if base != "" {
+		b := encrypt004(t, "note", "Note", base, itemsKey)
+		l.BaseContent, l.BaseEncItemKey = b.Content, b.EncItemKey
+	}
+
+	assert.NoError(t, db.Save(&l))
+
+	r := encrypt004(t, "note", "Note", remote, itemsKey)
+	r.UpdatedAt = "2020-05-20T10:00:00.000Z"
+
+	return l, r
+}
+
+func TestConflictCopy004(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	_, remote := setupConflict004(t, db, session, "", `{"title":"local","text":"","references":[]}`, `{"title":"remote","text":"","references":[]}`)
+
+	store := &StormStore{db: db}
+	si := SyncInput{DB: db, Session: session, ConflictPolicy: ConflictCopy, itemsKeys: &itemsKeyCache{store: store}}
+
+	var itemErrors []ItemError
+	_, itemErrors, err = persistSyncOutput(context.Background(), store, si, nil, gosn.SyncOutput{Items: gosn.EncryptedItems{remote}, SyncToken: "after"})
+	assert.NoError(t, err)
+	assert.Empty(t, itemErrors)
+
+	var all, copies []Item
+	assert.NoError(t, db.All(&all))
+
+	for _, i := range all {
+		if i.ConflictOf == "note" {
+			copies = append(copies, i)
+		}
+	}
+
+	assert.Len(t, copies, 1)
+	assert.Equal(t, protocol004, ProtocolVersion(copies[0]))
+
+	var note gosn.Note
+	note, err = GetNote(db, session, copies[0].UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Conflicted copy of local", note.Content.Title)
+}
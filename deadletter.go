@@ -0,0 +1,99 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	"github.com/jonhadfield/gosn-v2"
+	"time"
+)
+
+// DeadLetter is a dirty item moved aside after SN repeatedly refused to save it
+type DeadLetter struct {
+	UUID  string `storm:"id"`
+	Item  Item   // the local copy that could not be pushed
+	Error string // the item's last error when it was moved
+	At    time.Time
+}
+
+// DeadLetters returns the items moved to the dead letters
+func DeadLetters(db *storm.DB) (letters []DeadLetter, err error) {
+	err = db.All(&letters)
+
+	return
+}
+
+// deadLetter moves the dirty items returned as unsaved at least the input's DeadLetterAfter times to the dead letters
+// each is replaced by its last synced copy, or removed if it has never been synced, so it is no longer pushed
+// and the indexes the input maintains are updated with the replacement
+func deadLetter(si SyncInput) (moved []Item, err error) {
+	var tx storm.Node
+
+	tx, err = si.DB.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var failing []Item
+
+	err = tx.Select(q.Eq("Dirty", true), q.Gte("UnsavedCount", si.DeadLetterAfter)).Find(&failing)
+	if err != nil {
+		if errors.Is(err, storm.ErrNotFound) {
+			err = tx.Rollback()
+		}
+
+		return
+	}
+
+	at := time.Now()
+
+	var reverted gosn.EncryptedItems
+
+	for _, f := range failing {
+		if err = tx.Save(&DeadLetter{UUID: f.UUID, Item: f, Error: f.LastError, At: at}); err != nil {
+			return
+		}
+
+		if err = revertItem(stormTx{node: tx}, f); err != nil {
+			return
+		}
+
+		// an item that has never been synced is removed
+		reverted = append(reverted, gosn.EncryptedItem{
+			UUID:        f.UUID,
+			ContentType: f.ContentType,
+			Content:     f.BaseContent,
+			EncItemKey:  f.BaseEncItemKey,
+			Deleted:     f.BaseContent == "",
+		})
+	}
+
+	if si.IndexTitles || si.IndexReferences || si.IndexSearch {
+		if err = updateIndexes(stormTx{node: tx}, si, reverted); err != nil {
+			return
+		}
+	}
+
+	return failing, tx.Commit()
+}
+
+// revertItem replaces a dirty item with its last synced copy, or removes it if it has never been synced
+func revertItem(tx StoreTx, item Item) error {
+	if item.BaseContent == "" {
+		return tx.DeleteItem(item.UUID)
+	}
+
+	item.Content, item.EncItemKey = item.BaseContent, item.BaseEncItemKey
+	item.Deleted = false
+	item.UnsavedCount = 0
+	item.LastError = ""
+	item.clean()
+
+	return tx.SaveItem(item)
+}
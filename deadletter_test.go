@@ -0,0 +1,68 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncDeadLetter(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token-1"}))
+
+	// a synced item edited locally and an item that has never been synced
+	assert.NoError(t, db.Save(&Item{UUID: "synced", ContentType: "Note", Content: "base"}))
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{
+		{UUID: "synced", ContentType: "Note", Content: "edited"},
+		{UUID: "new", ContentType: "Note", Content: "new"},
+	}))
+
+	unsaved := gosn.SyncOutput{
+		Unsaved:   gosn.EncryptedItems{{UUID: "synced", ContentType: "Note"}, {UUID: "new", ContentType: "Note"}},
+		SyncToken: "token-1",
+	}
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{unsaved, unsaved, {SyncToken: "token-1"}}}
+
+	si := SyncInput{Session: offlineSession(), DB: db, Syncer: fs, DeadLetterAfter: 2}
+
+	var so SyncOutput
+	so, err = Sync(si)
+	assert.NoError(t, err)
+	assert.Empty(t, so.DeadLettered)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "synced", &stored))
+	assert.Equal(t, 1, stored.UnsavedCount)
+	assert.Equal(t, ErrItemUnsaved.Error(), stored.LastError)
+
+	so, err = Sync(si)
+	assert.NoError(t, err)
+	assert.Len(t, so.DeadLettered, 2)
+
+	var letters []DeadLetter
+	letters, err = DeadLetters(db)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 2)
+
+	for _, l := range letters {
+		assert.Equal(t, ErrItemUnsaved.Error(), l.Error)
+		assert.True(t, l.Item.Dirty)
+	}
+
+	// the synced item reverts to its last synced copy and the other is removed
+	assert.NoError(t, db.One("UUID", "synced", &stored))
+	assert.Equal(t, "base", stored.Content)
+	assert.False(t, stored.Dirty)
+	assert.Zero(t, stored.UnsavedCount)
+	assert.Error(t, db.One("UUID", "new", &stored))
+
+	// neither is pushed again
+	_, err = Sync(si)
+	assert.NoError(t, err)
+	assert.Len(t, fs.inputs, 3)
+	assert.Empty(t, fs.inputs[2].Items)
+}
@@ -0,0 +1,91 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidSession is returned when the session provided is missing its token, keys or server
+	ErrInvalidSession = errors.New("invalid session")
+	// ErrNoDB is returned when neither a DB pointer nor a DB path is provided
+	ErrNoDB = errors.New("DB pointer or DB path are required")
+	// ErrConflictingDBArgs is returned when both a DB pointer and a DB path are provided
+	ErrConflictingDBArgs = errors.New("passing a DB pointer and DB path does not make sense")
+	// ErrNoConflictFunc is returned when the conflict policy is Callback but no ConflictFunc is provided
+	ErrNoConflictFunc = errors.New("conflict policy is Callback but no ConflictFunc was provided")
+	// ErrSyncTokenCorrupt is returned when the stored sync token cannot be read
+	ErrSyncTokenCorrupt = errors.New("stored sync token is corrupt")
+	// ErrSchemaTooNew is returned when the DB was written by a newer version of this package
+	ErrSchemaTooNew = errors.New("DB schema version is newer than the supported version")
+	// ErrCodecMismatch is returned when a DB is opened with a different codec to the one it was created with
+	ErrCodecMismatch = errors.New("DB codec mismatch")
+	// ErrDBNotEmpty is returned when importing into a DB that already contains items without overwrite
+	ErrDBNotEmpty = errors.New("DB is not empty")
+	// ErrNoAuthParams is returned when exporting a backup from a DB without auth params or key params
+	ErrNoAuthParams = errors.New("no auth params or key params stored")
+	// ErrBackupIncompatible is returned when a backup belongs to a different account or keys
+	ErrBackupIncompatible = errors.New("backup is not compatible")
+	// ErrItemNotFound is returned when an item does not exist in the DB
+	ErrItemNotFound = errors.New("item not found")
+	// ErrItemDeleted is returned when an item exists in the DB but is flagged as deleted
+	ErrItemDeleted = errors.New("item is deleted")
+	// ErrRateLimited is returned when SN has rate limited syncs and the time it allows the next has not been reached
+	ErrRateLimited = errors.New("rate limited by SN")
+	// ErrItemUnsaved is recorded as the last error of an item SN returned as unsaved
+	ErrItemUnsaved = errors.New("item was not saved by SN")
+	// ErrSyncInProgress is returned when another sync of the same DB is in progress and SyncInput.FailIfSyncing is set
+	ErrSyncInProgress = errors.New("sync already in progress")
+	// ErrClosed is returned when using a Client after it has been closed
+	ErrClosed = errors.New("client is closed")
+	// ErrDBLocked is matched by the DBLockedError returned when a DB is in use by another process
+	ErrDBLocked = errors.New("DB is locked by another process")
+	// ErrAccountMismatch is returned when syncing a DB with a session for a different account to the one it was created for
+	ErrAccountMismatch = errors.New("DB belongs to a different account")
+	// ErrSessionNotFound is returned when loading a session that has not been saved
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrInvalidPassphrase is returned when a saved session cannot be decrypted with the passphrase provided
+	ErrInvalidPassphrase = errors.New("invalid passphrase")
+	// ErrKeyMismatch is returned when a session's keys differ from those recorded with the DB's key params
+	ErrKeyMismatch = errors.New("keys do not match those the DB's items are encrypted with")
+	// ErrKeyChanged is recorded as the error of a dirty item moved aside as it is encrypted with keys from before a password change
+	ErrKeyChanged = errors.New("item is encrypted with keys from before a password change")
+)
+
+// wrappedError matches a sentinel error with errors.Is whilst unwrapping to its underlying cause
+type wrappedError struct {
+	sentinel error
+	cause    error
+}
+
+func (e wrappedError) Error() string {
+	return e.sentinel.Error() + ": " + e.cause.Error()
+}
+
+func (e wrappedError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e wrappedError) Unwrap() error {
+	return e.cause
+}
+
+// wrapError returns an error that is sentinel to errors.Is and cause to errors.As
+func wrapError(sentinel, cause error) error {
+	return wrappedError{sentinel: sentinel, cause: cause}
+}
+
+// ItemError records an item retrieved from SN that could not be persisted
+type ItemError struct {
+	UUID        string
+	ContentType string
+	Err         error
+}
+
+func (e ItemError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.ContentType, e.UUID, e.Err)
+}
+
+func (e ItemError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,44 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncSentinelErrors(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	_, err = Sync(SyncInput{DB: db})
+	assert.True(t, errors.Is(err, ErrInvalidSession))
+
+	_, err = Sync(SyncInput{Session: offlineSession()})
+	assert.True(t, errors.Is(err, ErrNoDB))
+
+	_, err = Sync(SyncInput{Session: offlineSession(), DB: db, DBPath: tempDBPath})
+	assert.True(t, errors.Is(err, ErrConflictingDBArgs))
+
+	_, err = Sync(SyncInput{Session: offlineSession(), DB: db, ConflictPolicy: Callback})
+	assert.True(t, errors.Is(err, ErrNoConflictFunc))
+}
+
+func TestSyncTokenCorrupt(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	// a value that cannot be decoded as a SyncToken
+	assert.NoError(t, db.Set("SyncToken", "corrupt", []byte("corrupt")))
+
+	_, err = getSyncToken(db)
+	assert.True(t, errors.Is(err, ErrSyncTokenCorrupt))
+
+	var typeErr *json.UnmarshalTypeError
+	assert.True(t, errors.As(err, &typeErr))
+}
@@ -0,0 +1,104 @@
+package snpersist
+
+import (
+	"sync"
+)
+
+// EventType identifies what an Event describes
+type EventType int
+
+const (
+	// ItemAdded is published when an item retrieved from SN did not previously exist in the DB
+	ItemAdded EventType = iota
+	// ItemUpdated is published when an item retrieved from SN replaced an existing copy
+	ItemUpdated
+	// ItemDeleted is published when an item deleted elsewhere was removed from the DB
+	ItemDeleted
+	// SyncCompleted is published when a sync finishes successfully
+	SyncCompleted
+	// SyncFailed is published when a sync returns an error
+	SyncFailed
+	// ItemQuarantined is published when an item retrieved from SN was quarantined as it failed validation
+	ItemQuarantined
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ItemAdded:
+		return "ItemAdded"
+	case ItemUpdated:
+		return "ItemUpdated"
+	case ItemDeleted:
+		return "ItemDeleted"
+	case SyncCompleted:
+		return "SyncCompleted"
+	case SyncFailed:
+		return "SyncFailed"
+	case ItemQuarantined:
+		return "ItemQuarantined"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event describes a change applied by a sync, or the outcome of the sync itself
+type Event struct {
+	Type        EventType
+	UUID        string    // item events only
+	ContentType string    // item events only
+	Stats       SyncStats // SyncCompleted only
+	Err         error     // SyncFailed and ItemQuarantined only
+}
+
+// Events fans out the events published by syncs to any number of subscribers
+// item events are only published once the changes they describe have been committed
+type Events struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewEvents returns an Events with no subscribers
+func NewEvents() *Events {
+	return &Events{subs: map[chan Event]struct{}{}}
+}
+
+// Subscribe returns a channel receiving subsequent events and a function that cancels the subscription
+// events are dropped, rather than delaying the sync, if the channel's buffer is full
+func (e *Events) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	e.mu.Lock()
+	e.subs[ch] = struct{}{}
+	e.mu.Unlock()
+
+	var once sync.Once
+
+	return ch, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			delete(e.subs, ch)
+			e.mu.Unlock()
+
+			close(ch)
+		})
+	}
+}
+
+// publish sends events to every subscriber, it is safe to call on a nil Events
+func (e *Events) publish(events ...Event) {
+	if e == nil || len(events) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for ch := range e.subs {
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
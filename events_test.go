@@ -0,0 +1,57 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncEvents(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		if err := tx.SaveItem(Item{UUID: "updated", ContentType: "Note"}); err != nil {
+			return err
+		}
+
+		return tx.SaveItem(Item{UUID: "deleted", ContentType: "Tag"})
+	}))
+
+	events := NewEvents()
+	ch, unsubscribe := events.Subscribe(10)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{
+		Items: gosn.EncryptedItems{
+			{UUID: "added", ContentType: "Note"},
+			{UUID: "updated", ContentType: "Note"},
+			{UUID: "deleted", ContentType: "Tag", Deleted: true},
+			{UUID: "unknown", ContentType: "Tag", Deleted: true},
+		},
+		SyncToken: "token",
+	}}}
+
+	_, err := Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs, Events: events})
+	assert.NoError(t, err)
+
+	assert.Equal(t, Event{Type: ItemAdded, UUID: "added", ContentType: "Note"}, <-ch)
+	assert.Equal(t, Event{Type: ItemUpdated, UUID: "updated", ContentType: "Note"}, <-ch)
+	assert.Equal(t, Event{Type: ItemDeleted, UUID: "deleted", ContentType: "Tag"}, <-ch)
+
+	completed := <-ch
+	assert.Equal(t, SyncCompleted, completed.Type)
+	assert.Equal(t, 4, completed.Stats.Pulled)
+
+	failure := errors.New("session is invalid")
+	fs = &fakeSyncer{errs: []error{failure}}
+
+	_, err = Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs, Events: events})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, Event{Type: SyncFailed, Err: failure}, <-ch)
+
+	unsubscribe()
+	unsubscribe()
+
+	_, open := <-ch
+	assert.False(t, open)
+	assert.Equal(t, "SyncFailed", SyncFailed.String())
+}
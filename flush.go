@@ -0,0 +1,79 @@
+package snpersist
+
+import (
+	"context"
+	"time"
+)
+
+// Flush syncs repeatedly until no dirty items remain, returning the number that could not be pushed
+// syncing stops early once the timeout, if not zero, expires or a sync fails to reduce the dirty items
+// e.g. if SN refuses to save them, a DB created from a DBPath is closed on return
+func Flush(si SyncInput, timeout time.Duration) (remaining int, err error) {
+	ctx := context.Background()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return FlushWithContext(ctx, si)
+}
+
+// FlushWithContext is Flush with syncing stopped when ctx is cancelled
+func FlushWithContext(ctx context.Context, si SyncInput) (remaining int, err error) {
+	// every sync must reach SN
+	si.MinInterval = 0
+	si.Offline = false
+
+	// dirty items remaining after the previous sync, or -1 before the first
+	last := -1
+
+	for {
+		var so SyncOutput
+
+		so, err = SyncWithContext(ctx, si)
+
+		// a refreshed session is kept for the following syncs so they do not refresh it again
+		if so.Session.Valid() {
+			si.Session = so.Session
+		}
+
+		if so.DB != nil && si.DB == nil && si.Store == nil {
+			defer so.DB.Close()
+
+			si.DB, si.DBPath = so.DB, ""
+		}
+
+		if so.Store != nil {
+			var cErr error
+
+			if remaining, cErr = countDirty(so.Store); err == nil {
+				err = cErr
+			}
+		}
+
+		if err != nil {
+			return
+		}
+
+		// nothing left, or nothing more that can be pushed
+		if remaining == 0 || (last >= 0 && remaining >= last) {
+			if remaining > 0 {
+				si.warnf("snpersist | Flush | %d dirty items could not be pushed", remaining)
+			}
+
+			return
+		}
+
+		last = remaining
+	}
+}
+
+// countDirty returns the number of dirty items in the store
+func countDirty(store Store) (int, error) {
+	dirty, err := store.DirtyItems()
+
+	return len(dirty), err
+}
@@ -0,0 +1,79 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFlush(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveItem(Item{UUID: "a", ContentType: "Note", Content: "abc", Dirty: true})
+	}))
+
+	unsaved := gosn.SyncOutput{Unsaved: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token"}
+	saved := gosn.SyncOutput{SavedItems: gosn.EncryptedItems{{UUID: "a", ContentType: "Note", Content: "abc"}}, SyncToken: "token"}
+
+	// syncs are repeated until the item is saved
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{unsaved, saved}}
+
+	remaining, err := Flush(SyncInput{Session: offlineSession(), Store: store, Syncer: fs, MinInterval: time.Hour}, time.Minute)
+	assert.NoError(t, err)
+	assert.Zero(t, remaining)
+	assert.Len(t, fs.inputs, 2)
+
+	// and stop once they no longer reduce the dirty items
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveItem(Item{UUID: "a", ContentType: "Note", Content: "def", Dirty: true})
+	}))
+
+	fs = &fakeSyncer{outputs: []gosn.SyncOutput{unsaved, unsaved, unsaved}}
+
+	remaining, err = Flush(SyncInput{Session: offlineSession(), Store: store, Syncer: fs}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, remaining)
+	assert.Len(t, fs.inputs, 2)
+}
+
+func TestFlushKeepsRefreshedSession(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveItem(Item{UUID: "a", ContentType: "Note", Content: "abc", Dirty: true})
+	}))
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Unsaved: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token"},
+		{SavedItems: gosn.EncryptedItems{{UUID: "a", ContentType: "Note", Content: "abc"}}, SyncToken: "token"},
+	}}
+
+	var refreshes int
+
+	si := SyncInput{
+		Session: offlineSession(),
+		Store:   store,
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			if input.Session.Token != "refreshed" {
+				return gosn.SyncOutput{}, &HTTPError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+			}
+
+			return fs.Sync(input)
+		}),
+		RefreshSession: func(s gosn.Session) (gosn.Session, error) {
+			refreshes++
+			s.Token = "refreshed"
+
+			return s, nil
+		},
+	}
+
+	remaining, err := Flush(si, time.Minute)
+	assert.NoError(t, err)
+	assert.Zero(t, remaining)
+	assert.Len(t, fs.inputs, 2)
+
+	// the second sync uses the session refreshed by the first
+	assert.Equal(t, 1, refreshes)
+}
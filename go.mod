@@ -4,6 +4,12 @@ go 1.14
 
 require (
 	github.com/asdine/storm/v3 v3.2.0
+	github.com/dgraph-io/badger/v2 v2.2007.2
 	github.com/jonhadfield/gosn-v2 v0.0.0-20200517210619-52110795737e
+	github.com/mattn/go-sqlite3 v1.14.0
+	github.com/prometheus/client_golang v0.9.3
 	github.com/stretchr/testify v1.5.1
+	github.com/zalando/go-keyring v0.0.0-20200121091418-667557018717
+	go.etcd.io/bbolt v1.3.4
+	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 )
@@ -1,6 +1,7 @@
 package snpersist
 
 import (
+	"encoding/hex"
 	"fmt"
 	"github.com/jonhadfield/gosn-v2"
 	"log"
@@ -274,9 +275,28 @@ func randInt(min int, max int) int {
 const tempDBPath = "test.db"
 
 func removeDB(dbPath string) {
+	_ = os.Remove(dbPath + lockFileSuffix)
+
 	if err := os.Remove(dbPath); err != nil {
 		if ! strings.Contains(err.Error(), "no such file or directory") {
 			panic(err)
 		}
 	}
-}
\ No newline at end of file
+}
+// offlineSession returns a session with random keys that is valid for
+// encryption and decryption but cannot be used to contact a server
+func offlineSession() gosn.Session {
+	randHex := func() string {
+		b := make([]byte, 32)
+		rand.Read(b)
+
+		return hex.EncodeToString(b)
+	}
+
+	return gosn.Session{
+		Token:  "offline",
+		Mk:     randHex(),
+		Ak:     randHex(),
+		Server: "http://localhost",
+	}
+}
@@ -0,0 +1,64 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	"time"
+)
+
+// SyncHistory records the outcome of a sync run
+// entries are only kept when SyncInput.HistoryRetention is set
+type SyncHistory struct {
+	ID      int `storm:"id,increment"`
+	Started time.Time
+	Stats   SyncStats
+	Error   string // empty if the sync succeeded
+}
+
+// History returns up to n of the most recent sync runs recorded in the DB, newest first
+func History(db *storm.DB, n int) (history []SyncHistory, err error) {
+	err = db.All(&history, storm.Limit(n), storm.Reverse())
+
+	return
+}
+
+// recordHistory saves a sync run to the DB's history, removing the oldest entries beyond the retention limit
+func recordHistory(db *storm.DB, retention int, started time.Time, stats SyncStats, syncErr error) (err error) {
+	entry := SyncHistory{
+		Started: started,
+		Stats:   stats,
+	}
+
+	if syncErr != nil {
+		entry.Error = syncErr.Error()
+	}
+
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err = tx.Save(&entry); err != nil {
+		return
+	}
+
+	var count int
+
+	count, err = tx.Count(&SyncHistory{})
+	if err != nil {
+		return
+	}
+
+	if count > retention {
+		if err = tx.Select().OrderBy("ID").Limit(count - retention).Delete(&SyncHistory{}); err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,44 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncHistory(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	fs := &fakeSyncer{
+		errs: []error{nil, errors.New("session is invalid"), nil},
+		outputs: []gosn.SyncOutput{
+			{Items: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-1"},
+			{},
+			{SyncToken: "token-2"},
+		},
+	}
+
+	for range fs.outputs {
+		_, _ = Sync(SyncInput{Session: offlineSession(), DB: db, Syncer: fs, HistoryRetention: 2})
+	}
+
+	var history []SyncHistory
+	history, err = History(db, 10)
+	assert.NoError(t, err)
+
+	// the oldest run is removed once the retention limit is reached
+	assert.Len(t, history, 2)
+	assert.Empty(t, history[0].Error)
+	assert.Equal(t, "token-2", history[0].Stats.SyncTokenOut)
+	assert.Equal(t, "session is invalid", history[1].Error)
+	assert.True(t, history[0].Started.After(history[1].Started))
+
+	history, err = History(db, 1)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "token-2", history[0].Stats.SyncTokenOut)
+}
@@ -0,0 +1,158 @@
+package snpersist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jonhadfield/gosn-v2"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// path of the SN API's sync endpoint
+const syncPath = "/items/sync"
+
+// HTTPSyncer is a Syncer that calls the SN API with its own HTTP client, e.g. to use a proxy, custom CAs
+// or tuned timeouts, as gosn.Sync always uses the client built in to gosn
+// each call pushes the input's items and retrieves a single page
+type HTTPSyncer struct {
+	// client used for every request, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// HTTPError is returned by HTTPSyncer when SN responds with an unsuccessful status
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	// wait requested by a rate limited response's Retry-After header, zero if none was given
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("sync request failed: %s", e.Status)
+}
+
+// Is matches ErrRateLimited if SN rate limited the request
+func (e *HTTPError) Is(target error) bool {
+	return target == ErrRateLimited && e.StatusCode == http.StatusTooManyRequests
+}
+
+// parseRetryAfter returns the wait requested by a Retry-After header in either seconds or HTTP date form
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+
+	return 0
+}
+
+type syncRequest struct {
+	Items       gosn.EncryptedItems `json:"items"`
+	SyncToken   string              `json:"sync_token,omitempty"`
+	CursorToken string              `json:"cursor_token,omitempty"`
+	Limit       int                 `json:"limit"`
+}
+
+type syncResponse struct {
+	Items       gosn.EncryptedItems `json:"retrieved_items"`
+	SavedItems  gosn.EncryptedItems `json:"saved_items"`
+	Unsaved     gosn.EncryptedItems `json:"unsaved"`
+	SyncToken   string              `json:"sync_token"`
+	CursorToken string              `json:"cursor_token"`
+}
+
+func (s HTTPSyncer) Sync(input gosn.SyncInput) (output gosn.SyncOutput, err error) {
+	if !input.Session.Valid() {
+		err = errors.New("session is invalid")
+		return
+	}
+
+	req := syncRequest{
+		Items:       input.Items,
+		SyncToken:   strings.TrimSpace(input.SyncToken),
+		CursorToken: strings.TrimSpace(input.CursorToken),
+		Limit:       input.PageSize,
+	}
+
+	if req.Items == nil {
+		req.Items = gosn.EncryptedItems{}
+	}
+
+	if req.Limit <= 0 {
+		req.Limit = gosn.PageSize
+	}
+
+	var body []byte
+
+	body, err = json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	var request *http.Request
+
+	request, err = http.NewRequest(http.MethodPost, input.Session.Server+syncPath, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+input.Session.Token)
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var response *http.Response
+
+	response, err = client.Do(request)
+	if err != nil {
+		return
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err = &HTTPError{
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			RetryAfter: parseRetryAfter(response.Header.Get("Retry-After"), time.Now()),
+		}
+
+		return
+	}
+
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return
+	}
+
+	var resp syncResponse
+
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return
+	}
+
+	output = gosn.SyncOutput{
+		Items:      resp.Items,
+		SavedItems: resp.SavedItems,
+		Unsaved:    resp.Unsaved,
+		SyncToken:  resp.SyncToken,
+		Cursor:     resp.CursorToken,
+	}
+
+	output.Items.DeDupe()
+	output.SavedItems.DeDupe()
+	output.Unsaved.DeDupe()
+
+	return
+}
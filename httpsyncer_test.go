@@ -0,0 +1,69 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSyncer(t *testing.T) {
+	var requests []syncRequest
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, syncPath, r.URL.Path)
+		assert.Equal(t, "Bearer offline", r.Header.Get("Authorization"))
+
+		var req syncRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+
+		if len(requests) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(syncResponse{
+			Items:      gosn.EncryptedItems{{UUID: "b", ContentType: "Tag"}},
+			SavedItems: req.Items,
+			SyncToken:  "token-2",
+		})
+	}))
+	defer ts.Close()
+
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		if err := tx.SaveSyncToken(SyncToken{SyncToken: "token-1"}); err != nil {
+			return err
+		}
+
+		return tx.SaveItem(Item{UUID: "a", ContentType: "Note", Dirty: true})
+	}))
+
+	session := offlineSession()
+	session.Server = ts.URL
+
+	so, err := Sync(SyncInput{Session: session, Store: store, HTTPClient: ts.Client(), Retries: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, so.Stats.Saved)
+	assert.Equal(t, 1, so.Stats.Pulled)
+	assert.Equal(t, "token-2", so.Stats.SyncTokenOut)
+
+	// the unavailable response was retried
+	assert.Len(t, requests, 2)
+	assert.Equal(t, "token-1", requests[1].SyncToken)
+	assert.Equal(t, gosn.PageSize, requests[1].Limit)
+	assert.Len(t, requests[1].Items, 1)
+
+	var httpErr *HTTPError
+
+	_, err = HTTPSyncer{Client: ts.Client()}.Sync(gosn.SyncInput{Session: gosn.Session{}})
+	assert.False(t, errors.As(err, &httpErr))
+	assert.EqualError(t, err, "session is invalid")
+
+	assert.True(t, IsRetryable(&HTTPError{StatusCode: http.StatusBadGateway}))
+	assert.False(t, IsRetryable(&HTTPError{StatusCode: http.StatusUnauthorized}))
+}
@@ -0,0 +1,208 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"strings"
+)
+
+// TitleEntry maps an item to its decrypted title
+// titles are stored unencrypted so the index is only maintained when SyncInput.IndexTitles is set
+type TitleEntry struct {
+	UUID        string `storm:"id,unique"`
+	ContentType string `storm:"index"`
+	Title       string
+}
+
+// SearchTitles returns the index entries with titles containing term (case insensitive)
+func SearchTitles(db *storm.DB, term string) (entries []TitleEntry, err error) {
+	var all []TitleEntry
+
+	err = db.All(&all)
+	if err != nil {
+		return
+	}
+
+	term = strings.ToLower(term)
+
+	for _, e := range all {
+		if strings.Contains(strings.ToLower(e.Title), term) {
+			entries = append(entries, e)
+		}
+	}
+
+	return
+}
+
+// removeIndexes removes an item's index entries, whether or not the input maintains the indexes,
+// as entries may remain from syncs made when it did
+func removeIndexes(tx StoreTx, uuid string) (err error) {
+	if err = tx.DeleteTitle(uuid); err != nil {
+		return
+	}
+
+	if err = tx.SetSearchTerms(uuid, nil); err != nil {
+		return
+	}
+
+	if err = tx.SetReferences(uuid, nil); err != nil {
+		return
+	}
+
+	return tx.DeleteReferencesTo(uuid)
+}
+
+// updateIndexes decrypts only the items changed by a sync and updates the index entries requested by the input
+// items that cannot be decrypted, e.g. as their items key is yet to be retrieved, are left out of the indexes
+// rather than failing the sync
+func updateIndexes(tx StoreTx, si SyncInput, changed gosn.EncryptedItems) (err error) {
+	var toDecrypt gosn.EncryptedItems
+
+	for _, c := range changed {
+		if c.Deleted || c.EncItemKey == "" {
+			if err = clearIndexes(tx, si, c.UUID); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		toDecrypt = append(toDecrypt, c)
+	}
+
+	if len(toDecrypt) == 0 {
+		return
+	}
+
+	var decrypted gosn.DecryptedItems
+
+	if decrypted, err = si.decrypt(toDecrypt); err != nil {
+		if decrypted, err = decryptIndexable(tx, si, toDecrypt); err != nil {
+			return
+		}
+	}
+
+	for _, d := range decrypted {
+		var content struct {
+			Title      string              `json:"title"`
+			Text       string              `json:"text"`
+			References gosn.ItemReferences `json:"references"`
+		}
+
+		// content without a title, e.g. components, is indexed with an empty title
+		_ = json.Unmarshal([]byte(d.Content), &content)
+
+		if si.IndexTitles {
+			err = tx.SaveTitle(TitleEntry{
+				UUID:        d.UUID,
+				ContentType: d.ContentType,
+				Title:       content.Title,
+			})
+			if err != nil {
+				return
+			}
+		}
+
+		if si.IndexReferences {
+			if err = tx.SetReferences(d.UUID, newReferences(d.UUID, content.References)); err != nil {
+				return
+			}
+		}
+
+		if si.IndexSearch {
+			var terms map[string]int
+
+			// only notes are searchable
+			if d.ContentType == "Note" {
+				terms = searchTerms(si.Session, si.EncryptSearchIndex, content.Title+" "+content.Text)
+			}
+
+			if err = tx.SetSearchTerms(d.UUID, terms); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// clearIndexes removes an item's entries from the indexes the input maintains
+func clearIndexes(tx StoreTx, si SyncInput, uuid string) (err error) {
+	if si.IndexTitles {
+		if err = tx.DeleteTitle(uuid); err != nil {
+			return
+		}
+	}
+
+	if si.IndexReferences {
+		if err = tx.SetReferences(uuid, nil); err != nil {
+			return
+		}
+	}
+
+	if si.IndexSearch {
+		err = tx.SetSearchTerms(uuid, nil)
+	}
+
+	return
+}
+
+// storedIndexes returns an input maintaining the opt-in indexes the DB already holds entries for, so items
+// saved outside of a sync keep them up to date, with keys being the items keys available to decrypt them
+func storedIndexes(db *storm.DB, session gosn.Session, keys []ItemsKey) (si SyncInput, err error) {
+	si = SyncInput{Session: session, itemsKeys: &itemsKeyCache{keys: keys, loaded: true}}
+
+	var titles, docs int
+
+	if titles, err = db.Count(&TitleEntry{}); err != nil {
+		return
+	}
+
+	if docs, err = db.Count(&searchDoc{}); err != nil {
+		return
+	}
+
+	si.IndexTitles = titles > 0
+	si.IndexSearch = docs > 0
+
+	if si.IndexSearch {
+		var postings []searchPosting
+
+		if err = db.All(&postings, storm.Limit(1)); err != nil {
+			return
+		}
+
+		// new terms are stored in the same form as those already indexed
+		si.EncryptSearchIndex = len(postings) > 0 && strings.HasPrefix(postings[0].Term, hashedTermPrefix)
+	}
+
+	return
+}
+
+// decryptIndexable decrypts the items one at a time, clearing the index entries of those that cannot be
+// decrypted so they no longer describe an earlier version of the item
+func decryptIndexable(tx StoreTx, si SyncInput, eItems gosn.EncryptedItems) (decrypted gosn.DecryptedItems, err error) {
+	var keys []ItemsKey
+
+	if keys, err = si.keys(); err != nil {
+		return
+	}
+
+	for _, e := range eItems {
+		d, dErr := decryptItems(gosn.EncryptedItems{e}, si.Session, keys)
+		if dErr != nil {
+			si.warnf("snpersist | updateIndexes | not indexing %s %s: %v", e.ContentType, e.UUID, dErr)
+
+			if err = clearIndexes(tx, si, e.UUID); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		decrypted = append(decrypted, d...)
+	}
+
+	return
+}
@@ -0,0 +1,195 @@
+package snpersist
+
+import (
+	"context"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUpdateTitleIndex(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	noteOne, _ := createNote("Shopping List", "")
+	noteTwo, _ := createNote("Meeting Notes", "")
+	dItems := gosn.Items{&noteOne, &noteTwo}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	assert.NoError(t, updateIndexes(stormTx{node: db}, SyncInput{Session: session, IndexTitles: true}, eItems))
+
+	var entries []TitleEntry
+	entries, err = SearchTitles(db, "shopping")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, noteOne.UUID, entries[0].UUID)
+	assert.Equal(t, "Note", entries[0].ContentType)
+
+	// a deleted item should be removed from the index
+	assert.NoError(t, updateIndexes(stormTx{node: db}, SyncInput{Session: session, IndexTitles: true}, gosn.EncryptedItems{{UUID: noteOne.UUID, Deleted: true}}))
+	entries, err = SearchTitles(db, "")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, noteTwo.UUID, entries[0].UUID)
+}
+
+func TestUpdateReferenceIndex(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	note, _ := createNote("note", "")
+	tag := createTag("tag", "")
+	tag.Content.UpsertReferences(gosn.ItemReferences{{UUID: note.UUID, ContentType: "Note"}})
+	dItems := gosn.Items{&note, tag}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{Session: session, IndexReferences: true}, nil,
+		gosn.SyncOutput{Items: eItems, SyncToken: "token"})
+	assert.NoError(t, err)
+
+	var refs []Reference
+	refs, err = ReferencesFrom(db, tag.UUID)
+	assert.NoError(t, err)
+	assert.Len(t, refs, 1)
+	assert.Equal(t, note.UUID, refs[0].Child)
+	assert.Equal(t, "Note", refs[0].ContentType)
+
+	refs, err = ReferencesTo(db, note.UUID)
+	assert.NoError(t, err)
+	assert.Len(t, refs, 1)
+	assert.Equal(t, tag.UUID, refs[0].Parent)
+
+	// titles are not indexed unless requested
+	var entries []TitleEntry
+	entries, err = SearchTitles(db, "")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// references held by a deleted item are removed
+	assert.NoError(t, updateIndexes(stormTx{node: db}, SyncInput{Session: session, IndexReferences: true}, gosn.EncryptedItems{{UUID: tag.UUID, Deleted: true}}))
+	refs, err = ReferencesTo(db, note.UUID)
+	assert.NoError(t, err)
+	assert.Empty(t, refs)
+}
+
+func TestConfirmedDeletionRemovesIndexEntries(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	note, _ := createNote("Shopping List", "milk")
+	tag := createTag("tag", "")
+	tag.Content.UpsertReferences(gosn.ItemReferences{{UUID: note.UUID, ContentType: "Note"}})
+	dItems := gosn.Items{&note, tag}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: eItems, SyncToken: "token-1"},
+		{SavedItems: gosn.EncryptedItems{{UUID: tag.UUID, ContentType: "Tag", Deleted: true}}, SyncToken: "token-2"},
+		{SavedItems: gosn.EncryptedItems{{UUID: note.UUID, ContentType: "Note", Deleted: true}}, SyncToken: "token-3"},
+	}}
+	si := SyncInput{Session: session, DB: db, Syncer: fs, IndexTitles: true, IndexSearch: true, IndexReferences: true}
+
+	_, err = Sync(si)
+	assert.NoError(t, err)
+
+	entries, err := SearchTitles(db, "shopping")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	results, err := Search(db, session, "milk")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	refs, err := ReferencesFrom(db, tag.UUID)
+	assert.NoError(t, err)
+	assert.Len(t, refs, 1)
+
+	// the tag's references are removed once its deletion is confirmed
+	assert.NoError(t, DeleteItem(db, tag.UUID))
+
+	_, err = Sync(si)
+	assert.NoError(t, err)
+
+	refs, err = ReferencesTo(db, note.UUID)
+	assert.NoError(t, err)
+	assert.Empty(t, refs)
+
+	// as are the references to the note once its deletion is confirmed
+	assert.NoError(t, db.Save(&Reference{ID: "other/" + note.UUID, Parent: "other", Child: note.UUID, ContentType: "Note"}))
+	assert.NoError(t, DeleteItem(db, note.UUID))
+
+	_, err = Sync(si)
+	assert.NoError(t, err)
+
+	entries, err = SearchTitles(db, "shopping")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	results, err = Search(db, session, "milk")
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	refs, err = ReferencesFrom(db, "other")
+	assert.NoError(t, err)
+	assert.Empty(t, refs)
+}
+
+func TestIndexSkipsUndecryptableItems(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	session := offlineSession()
+
+	note, _ := createNote("003 note", "")
+	dItems := gosn.Items{&note}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	// the 004 note's items key is retrieved with a later page
+	encrypted004 := items004(t, session)
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: append(eItems, encrypted004[1]), SyncToken: "token-1", Cursor: "cursor-1"},
+		{Items: encrypted004[:1], SyncToken: "token-2"},
+	}}
+
+	si := SyncInput{Session: session, DBPath: tempDBPath, Syncer: fs, IndexTitles: true, IndexReferences: true, IndexSearch: true}
+
+	so, err := Sync(si)
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	var all []Item
+	assert.NoError(t, so.DB.All(&all))
+	assert.Len(t, all, 3)
+
+	st, err := getSyncToken(so.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", st.SyncToken)
+
+	var entries []TitleEntry
+	entries, err = SearchTitles(so.DB, "note")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, note.UUID, entries[0].UUID)
+
+	var results []SearchResult
+	results, err = Search(so.DB, session, "note")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, note.UUID, results[0].UUID)
+}
@@ -0,0 +1,375 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	"github.com/jonhadfield/gosn-v2"
+	"time"
+)
+
+// SaveItems persists encrypted items in a single transaction, marking them dirty so the next sync pushes them
+// items identical to the stored copy, other than their timestamps, are skipped to avoid pushing them needlessly
+// without a session the items cannot be decrypted, so the title and search index entries of those saved are
+// removed rather than left describing their previous versions
+func SaveItems(db *storm.DB, items gosn.EncryptedItems) (err error) {
+	var si SyncInput
+
+	if si, err = storedIndexes(db, gosn.Session{}, nil); err != nil {
+		return
+	}
+
+	return saveDirty(db, items, func(tx StoreTx, saved gosn.EncryptedItems) (err error) {
+		for _, s := range saved {
+			if err = clearIndexes(tx, si, s.UUID); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+}
+
+// saveIndexed saves items as SaveItems does and updates the DB's title and search indexes with those saved,
+// decrypting them with the session's keys and the items keys
+func saveIndexed(db *storm.DB, session gosn.Session, keys []ItemsKey, items gosn.EncryptedItems) (err error) {
+	var si SyncInput
+
+	if si, err = storedIndexes(db, session, keys); err != nil {
+		return
+	}
+
+	return saveDirty(db, items, func(tx StoreTx, saved gosn.EncryptedItems) error {
+		return updateIndexes(tx, si, saved)
+	})
+}
+
+// saveDirty saves items marked dirty and then calls then, if provided, with those saved within the same transaction
+func saveDirty(db *storm.DB, items gosn.EncryptedItems, then func(tx StoreTx, saved gosn.EncryptedItems) error) (err error) {
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	dirtiedDate := time.Now()
+
+	var saved gosn.EncryptedItems
+
+	for x, i := range ConvertItemsToPersistItems(items) {
+		var existing Item
+
+		err = tx.One("UUID", i.UUID, &existing)
+
+		switch {
+		case err == nil:
+			if existing.contentHash() == i.ContentHash {
+				continue
+			}
+
+			i.setBase(existing)
+		case !errors.Is(err, storm.ErrNotFound):
+			return
+		}
+
+		i.Dirty = true
+		i.DirtiedDate = dirtiedDate
+
+		if err = (stormTx{node: tx}).SaveItem(i); err != nil {
+			return
+		}
+
+		saved = append(saved, items[x])
+	}
+
+	err = nil
+
+	if then != nil {
+		if err = then(stormTx{node: tx}, saved); err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SaveDecryptedItems encrypts items and then saves them as SaveItems does
+// items are encrypted as 004 items with the DB's items key if it has one, otherwise with the session's keys
+// the reference index is updated with the items' references, and the title and search indexes, if the DB has them,
+// with their content
+// items with the same content as the stored copy are skipped as encrypting them again would always change them
+func SaveDecryptedItems(db *storm.DB, session gosn.Session, items gosn.Items) (err error) {
+	items, err = changedItems(db, session, items)
+	if err != nil || len(items) == 0 {
+		return
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	var eItems gosn.EncryptedItems
+
+	eItems, err = encryptItems(items, session, keys)
+	if err != nil {
+		return
+	}
+
+	var si SyncInput
+
+	if si, err = storedIndexes(db, session, keys); err != nil {
+		return
+	}
+
+	return saveDirty(db, eItems, func(tx StoreTx, saved gosn.EncryptedItems) (err error) {
+		if err = updateIndexes(tx, si, saved); err != nil {
+			return
+		}
+
+		for _, i := range items {
+			if err = tx.SetReferences(i.GetUUID(), itemReferences(i)); err != nil {
+				return
+			}
+
+			if i.IsDeleted() || i.GetContent() == nil {
+				if err = removeIndexes(tx, i.GetUUID()); err != nil {
+					return
+				}
+			}
+		}
+
+		return
+	})
+}
+
+// changedItems returns the items whose type, deleted flag or content differ from their stored copies
+func changedItems(db *storm.DB, session gosn.Session, items gosn.Items) (changed gosn.Items, err error) {
+	var stored gosn.EncryptedItems
+
+	for _, i := range items {
+		var existing Item
+
+		err = db.One("UUID", i.GetUUID(), &existing)
+
+		switch {
+		case err == nil:
+			if existing.EncItemKey != "" && !existing.Deleted {
+				stored = append(stored, gosn.EncryptedItem{
+					UUID:        existing.UUID,
+					Content:     existing.Content,
+					ContentType: existing.ContentType,
+					EncItemKey:  existing.EncItemKey,
+				})
+			}
+		case !errors.Is(err, storm.ErrNotFound):
+			return
+		}
+	}
+
+	err = nil
+
+	storedContent := make(map[string]gosn.DecryptedItem, len(stored))
+
+	if len(stored) > 0 {
+		var decrypted gosn.DecryptedItems
+
+		// stored copies that cannot be decrypted are treated as changed
+		keys, _ := ItemsKeys(db, session)
+		decrypted, _ = decryptItems(stored, session, keys)
+
+		for _, d := range decrypted {
+			storedContent[d.UUID] = d
+		}
+	}
+
+	for _, i := range items {
+		if s, ok := storedContent[i.GetUUID()]; ok && !i.IsDeleted() && s.ContentType == i.GetContentType() {
+			content, mErr := json.Marshal(i.GetContent())
+			if mErr == nil && string(content) == s.Content {
+				continue
+			}
+		}
+
+		changed = append(changed, i)
+	}
+
+	return
+}
+
+// DeleteItem flags the item with the provided UUID as deleted and dirty so the next sync pushes the deletion
+// the item is removed from the DB once SN confirms it has been saved
+func DeleteItem(db *storm.DB, uuid string) (err error) {
+	var item Item
+
+	err = db.One("UUID", uuid, &item)
+	if err != nil {
+		if errors.Is(err, storm.ErrNotFound) {
+			err = ErrItemNotFound
+		}
+
+		return
+	}
+
+	item.setBase(item)
+	item.Deleted = true
+	item.Dirty = true
+	item.DirtiedDate = time.Now()
+	// the deletion is pushed after any other changes
+	item.DirtySeq = 0
+
+	return stormTx{node: db}.SaveItem(item)
+}
+
+// ListDirty returns the items waiting to be pushed by the next sync, in the order they are pushed
+func ListDirty(db *storm.DB) (dirty []Item, err error) {
+	err = db.Find("Dirty", true, &dirty)
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	sortDirty(dirty)
+
+	return
+}
+
+// CountDirty returns the number of items waiting to be pushed by the next sync
+func CountDirty(db *storm.DB) (int, error) {
+	return db.Select(q.Eq("Dirty", true)).Count(&Item{})
+}
+
+// MarkDirty flags the items with the provided UUIDs as dirty so the next sync pushes them
+func MarkDirty(db *storm.DB, uuids []string) (err error) {
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	dirtiedDate := time.Now()
+
+	for _, uuid := range uuids {
+		var item Item
+
+		err = tx.One("UUID", uuid, &item)
+		if err != nil {
+			if errors.Is(err, storm.ErrNotFound) {
+				err = fmt.Errorf("%w: %s", ErrItemNotFound, uuid)
+			}
+
+			return
+		}
+
+		// keep the original date of items that are already dirty
+		if item.Dirty {
+			continue
+		}
+
+		item.setBase(item)
+		item.Dirty = true
+		item.DirtiedDate = dirtiedDate
+
+		if err = (stormTx{node: tx}).SaveItem(item); err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CleanAll removes the dirty flag from every item, discarding any changes that have not been pushed
+func CleanAll(db *storm.DB) (err error) {
+	var dirty []Item
+
+	dirty, err = ListDirty(db)
+	if err != nil {
+		return
+	}
+
+	uuids := make([]string, len(dirty))
+	for x := range dirty {
+		uuids[x] = dirty[x].UUID
+	}
+
+	return ClearDirty(db, uuids)
+}
+
+// PruneDirty returns the dirty items that were dirtied more than olderThan ago
+// such items may have been abandoned by an interrupted sync and can be reset with ClearDirty
+func PruneDirty(db *storm.DB, olderThan time.Duration) (abandoned []Item, err error) {
+	var dirty []Item
+
+	dirty, err = ListDirty(db)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+
+	for _, d := range dirty {
+		if d.DirtiedDate.Before(cutoff) {
+			abandoned = append(abandoned, d)
+		}
+	}
+
+	return
+}
+
+// ClearDirty removes the dirty flag from the items with the provided UUIDs so they will not be pushed
+// the items are updated in a single transaction
+func ClearDirty(db *storm.DB, uuids []string) (err error) {
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, uuid := range uuids {
+		var item Item
+
+		err = tx.One("UUID", uuid, &item)
+		if err != nil {
+			if errors.Is(err, storm.ErrNotFound) {
+				err = fmt.Errorf("%w: %s", ErrItemNotFound, uuid)
+			}
+
+			return
+		}
+
+		if !item.Dirty {
+			continue
+		}
+
+		item.clean()
+
+		if err = (stormTx{node: tx}).SaveItem(item); err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
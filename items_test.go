@@ -0,0 +1,227 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSaveDecryptedItems(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	note, text := createNote("test", "")
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&note}))
+
+	var dirty []Item
+	assert.NoError(t, db.Find("Dirty", true, &dirty))
+	assert.Len(t, dirty, 1)
+	assert.Equal(t, note.UUID, dirty[0].UUID)
+	assert.NotZero(t, dirty[0].DirtiedDate)
+
+	var items gosn.Items
+	items, err = Items(dirty).ToItems(session)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, text, items.Notes()[0].Content.Text)
+
+	// an existing title index is kept up to date
+	assert.NoError(t, db.Save(&TitleEntry{UUID: note.UUID, ContentType: "Note", Title: "test"}))
+
+	note.Content.Title = "renamed"
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&note}))
+
+	entries, err := SearchTitles(db, "renamed")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	note.Deleted = true
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&note}))
+
+	entries, err = SearchTitles(db, "")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPruneDirty(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, db.Save(&Item{UUID: "old", ContentType: "Note", Dirty: true, DirtiedDate: time.Now().Add(-72 * time.Hour)}))
+	assert.NoError(t, db.Save(&Item{UUID: "recent", ContentType: "Note", Dirty: true, DirtiedDate: time.Now()}))
+
+	var abandoned []Item
+	abandoned, err = PruneDirty(db, 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, abandoned, 1)
+	assert.Equal(t, "old", abandoned[0].UUID)
+
+	assert.NoError(t, ClearDirty(db, []string{"old"}))
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "old", &stored))
+	assert.False(t, stored.Dirty)
+	assert.Zero(t, stored.DirtiedDate)
+
+	abandoned, err = PruneDirty(db, 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Empty(t, abandoned)
+}
+
+func TestDeleteItem(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note"}))
+	assert.NoError(t, DeleteItem(db, "a"))
+	assert.Equal(t, ErrItemNotFound, DeleteItem(db, "missing"))
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "a", &stored))
+	assert.True(t, stored.Deleted)
+	assert.True(t, stored.Dirty)
+	assert.NotZero(t, stored.DirtiedDate)
+
+	_, err = GetItem(db, offlineSession(), "a")
+	assert.Equal(t, ErrItemDeleted, err)
+}
+
+func TestDirtyManagement(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	dirtied := time.Now().Add(-time.Hour)
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", Dirty: true, DirtiedDate: dirtied}))
+	assert.NoError(t, db.Save(&Item{UUID: "b", ContentType: "Note"}))
+	assert.NoError(t, db.Save(&Item{UUID: "c", ContentType: "Tag"}))
+
+	var count int
+	count, err = CountDirty(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, MarkDirty(db, []string{"a", "b"}))
+	assert.True(t, errors.Is(MarkDirty(db, []string{"c", "missing"}), ErrItemNotFound))
+
+	var dirty []Item
+	dirty, err = ListDirty(db)
+	assert.NoError(t, err)
+	assert.Len(t, dirty, 2)
+
+	// an item that was already dirty keeps its original date
+	for _, d := range dirty {
+		if d.UUID == "a" {
+			assert.True(t, dirtied.Equal(d.DirtiedDate))
+		}
+	}
+
+	// a missing item leaves every item unchanged
+	assert.True(t, errors.Is(ClearDirty(db, []string{"a", "missing"}), ErrItemNotFound))
+
+	count, err = CountDirty(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.NoError(t, CleanAll(db))
+
+	count, err = CountDirty(db)
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	dirty, err = ListDirty(db)
+	assert.NoError(t, err)
+	assert.Empty(t, dirty)
+}
+
+func TestToItemsParallel(t *testing.T) {
+	session := offlineSession()
+
+	var notes gosn.Items
+	for x := 0; x < 10; x++ {
+		note, _ := createNote(fmt.Sprintf("note %d", x), "")
+		notes = append(notes, &note)
+	}
+
+	eItems, err := notes.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	persisted := Items(ConvertItemsToPersistItems(eItems))
+
+	for _, workers := range []int{0, 1, 3, 10, 20} {
+		var items gosn.Items
+		items, err = persisted.ToItemsParallel(session, workers)
+		assert.NoError(t, err)
+		assert.Len(t, items, 10)
+
+		for x := range items {
+			assert.Equal(t, notes[x].GetUUID(), items[x].GetUUID())
+		}
+	}
+
+	// items that cannot be decrypted fail the whole set
+	_, err = persisted.ToItemsParallel(offlineSession(), 3)
+	assert.Error(t, err)
+}
+
+func TestSaveSkipsUnchangedItems(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	item := gosn.EncryptedItem{UUID: "a", ContentType: "Note", Content: "content", EncItemKey: "key", UpdatedAt: "2020-05-01T10:00:00.000Z"}
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{item}))
+	assert.NoError(t, ClearDirty(db, []string{"a"}))
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "a", &stored))
+	assert.NotEmpty(t, stored.ContentHash)
+
+	// only the timestamp has changed
+	item.UpdatedAt = "2020-05-02T10:00:00.000Z"
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{item}))
+
+	count, err := CountDirty(db)
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	item.Content = "changed"
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{item}))
+
+	count, err = CountDirty(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// decrypted items are compared with the decrypted stored copy
+	session := offlineSession()
+
+	note, _ := createNote("title", "text")
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&note}))
+	assert.NoError(t, ClearDirty(db, []string{note.UUID}))
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&note}))
+
+	count, err = CountDirty(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	note.Content.Text = "changed"
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&note}))
+
+	count, err = CountDirty(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
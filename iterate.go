@@ -0,0 +1,158 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/codec"
+	"github.com/asdine/storm/v3/q"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrStopIteration can be returned by the function passed to ForEachItem to stop without an error
+var ErrStopIteration = errors.New("stop iteration")
+
+// name of the bucket storm stores items in
+const itemBucket = "Item"
+
+// ItemIterator reads the persisted items matching a filter one at a time, ordered by UUID
+// it holds a read transaction open until closed so must always be closed
+type ItemIterator struct {
+	tx      *bolt.Tx
+	cursor  *bolt.Cursor
+	codec   codec.MarshalUnmarshaler
+	matcher q.Matcher
+	filter  Filter
+
+	started bool
+	matched int
+	item    Item
+	err     error
+}
+
+// NewItemIterator returns an iterator over the items matching the filter
+func NewItemIterator(db *storm.DB, filter Filter) (it *ItemIterator, err error) {
+	it = &ItemIterator{
+		codec:  db.Codec(),
+		filter: filter,
+	}
+
+	matchers := filter.matchers()
+	if filter.ContentType != "" {
+		matchers = append(matchers, q.Eq("ContentType", filter.ContentType))
+	}
+
+	it.matcher = q.And(matchers...)
+
+	it.tx, err = db.Bolt.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+
+	// a DB without items has no bucket
+	if bucket := it.tx.Bucket([]byte(itemBucket)); bucket != nil {
+		it.cursor = bucket.Cursor()
+	}
+
+	return
+}
+
+// Next advances to the next matching item, returning false when there are none left or an error occurred
+func (it *ItemIterator) Next() bool {
+	if it.cursor == nil || it.err != nil {
+		return false
+	}
+
+	for {
+		if it.filter.Limit > 0 && it.matched-it.filter.Offset >= it.filter.Limit {
+			return false
+		}
+
+		var k, v []byte
+
+		if it.started {
+			k, v = it.cursor.Next()
+		} else {
+			k, v = it.cursor.First()
+			it.started = true
+		}
+
+		if k == nil {
+			return false
+		}
+
+		// skip storm's index and metadata buckets
+		if v == nil {
+			continue
+		}
+
+		var item Item
+
+		if it.err = it.codec.Unmarshal(v, &item); it.err != nil {
+			return false
+		}
+
+		var ok bool
+
+		if ok, it.err = it.matcher.Match(&item); it.err != nil {
+			return false
+		}
+
+		if !ok {
+			continue
+		}
+
+		it.matched++
+
+		if it.matched <= it.filter.Offset {
+			continue
+		}
+
+		it.item = item
+
+		return true
+	}
+}
+
+// Item returns the item Next advanced to
+func (it *ItemIterator) Item() Item {
+	return it.item
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *ItemIterator) Err() error {
+	return it.err
+}
+
+// Close ends the iterator's read transaction
+func (it *ItemIterator) Close() error {
+	return it.tx.Rollback()
+}
+
+// ForEachItem calls fn with each persisted item matching the filter, ordered by UUID, without loading them all
+// iteration stops at the first error returned by fn, which is returned unless it is ErrStopIteration
+func ForEachItem(db *storm.DB, filter Filter, fn func(item Item) error) (err error) {
+	var it *ItemIterator
+
+	it, err = NewItemIterator(db, filter)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if cErr := it.Close(); err == nil {
+			err = cErr
+		}
+	}()
+
+	for it.Next() {
+		if err = fn(it.Item()); err != nil {
+			if errors.Is(err, ErrStopIteration) {
+				err = nil
+			}
+
+			return
+		}
+	}
+
+	return it.Err()
+}
@@ -0,0 +1,78 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestForEachItem(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	collect := func(filter Filter) (uuids []string) {
+		assert.NoError(t, ForEachItem(db, filter, func(item Item) error {
+			uuids = append(uuids, item.UUID)
+			return nil
+		}))
+
+		return
+	}
+
+	// nothing stored
+	assert.Empty(t, collect(Filter{}))
+
+	assert.NoError(t, db.Save(&Item{UUID: "d", ContentType: "Note", UpdatedAt: "2020-05-01T10:00:00.000Z"}))
+	assert.NoError(t, db.Save(&Item{UUID: "b", ContentType: "Note", UpdatedAt: "2020-05-03T10:00:00.000Z", Dirty: true}))
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", UpdatedAt: "2020-05-02T10:00:00.000Z", Deleted: true}))
+	assert.NoError(t, db.Save(&Item{UUID: "c", ContentType: "Tag", UpdatedAt: "2020-05-04T10:00:00.000Z"}))
+
+	yes, no := true, false
+	since, _ := time.Parse(time.RFC3339, "2020-05-02T10:00:00Z")
+
+	// results match GetItems
+	for _, filter := range []Filter{
+		{},
+		{ContentType: "Note"},
+		{ContentType: "Note", Deleted: &no},
+		{Dirty: &yes},
+		{UpdatedSince: since},
+		{ContentType: "Note", Limit: 1, Offset: 1},
+		{Deleted: &no, Limit: 2, Offset: 1},
+	} {
+		items, err := GetItems(db, filter)
+		assert.NoError(t, err)
+
+		var expected []string
+		for _, i := range items {
+			expected = append(expected, i.UUID)
+		}
+
+		assert.Equal(t, expected, collect(filter))
+	}
+
+	// iteration can be stopped early
+	var visited int
+	assert.NoError(t, ForEachItem(db, Filter{}, func(item Item) error {
+		visited++
+		return ErrStopIteration
+	}))
+	assert.Equal(t, 1, visited)
+
+	failure := errors.New("failed")
+	assert.Equal(t, failure, ForEachItem(db, Filter{}, func(item Item) error {
+		return failure
+	}))
+
+	it, err := NewItemIterator(db, Filter{ContentType: "Tag"})
+	assert.NoError(t, err)
+	assert.True(t, it.Next())
+	assert.Equal(t, "c", it.Item().UUID)
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+}
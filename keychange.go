@@ -0,0 +1,231 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	bolt "go.etcd.io/bbolt"
+	"strings"
+	"time"
+)
+
+// staleItems returns the stored items that cannot be decrypted with the session or the items keys it decrypts,
+// as happens to the items cached before the account's password was changed
+func staleItems(db *storm.DB, session gosn.Session) (stale Items, err error) {
+	var all Items
+
+	if err = db.All(&all); err != nil {
+		return
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	for _, i := range all {
+		if i.Deleted {
+			continue
+		}
+
+		if _, dErr := decryptStored(i, session, keys); dErr != nil {
+			stale = append(stale, i)
+		}
+	}
+
+	return
+}
+
+// DetectKeyChange returns the UUIDs of the stored items that cannot be decrypted with the session
+// any are a sign the account's password has changed since they were cached, see ReEncryptLocal
+func DetectKeyChange(db *storm.DB, session gosn.Session) (stale []string, err error) {
+	var items Items
+
+	if items, err = staleItems(db, session); err != nil {
+		return
+	}
+
+	for _, i := range items {
+		stale = append(stale, i.UUID)
+	}
+
+	return
+}
+
+// ReEncryptLocal brings the items cached before a password change into line with the session's keys
+// stale items are re-encrypted if they can be decrypted with the previous session's keys, otherwise clean items
+// are removed and downloaded again by the next sync and dirty items, whose edits cannot be pushed, are moved
+// to the dead letters
+// the stored auth and key params, which belong to the previous password, are removed and the search index is rebuilt
+func ReEncryptLocal(db *storm.DB, session gosn.Session, previous *gosn.Session) (reEncrypted, removed int, err error) {
+	if !session.Valid() {
+		return 0, 0, ErrInvalidSession
+	}
+
+	var stale Items
+
+	if stale, err = staleItems(db, session); err != nil || len(stale) == 0 {
+		return
+	}
+
+	// the items keys are unchanged by a password change, only the key they are encrypted with changes,
+	// so those decrypted with either session can be used
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	if previous != nil {
+		var previousKeys []ItemsKey
+
+		if previousKeys, err = ItemsKeys(db, *previous); err != nil {
+			return
+		}
+
+		keys = append(keys, previousKeys...)
+	}
+
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	st := stormTx{node: tx}
+	at := time.Now()
+
+	for _, i := range stale {
+		if previous != nil {
+			updated, rErr := reEncrypt(i, session, *previous, keys)
+			if rErr == nil {
+				if err = st.SaveItem(updated); err != nil {
+					return
+				}
+
+				reEncrypted++
+
+				continue
+			}
+		}
+
+		if i.Dirty {
+			if err = tx.Save(&DeadLetter{UUID: i.UUID, Item: i, Error: ErrKeyChanged.Error(), At: at}); err != nil {
+				return
+			}
+		}
+
+		if err = st.DeleteItem(i.UUID); err != nil {
+			return
+		}
+
+		removed++
+	}
+
+	// without a sync token the next sync downloads every item again, including those removed
+	if removed > 0 {
+		if err = tx.Drop(&SyncToken{}); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return
+		}
+	}
+
+	for _, params := range []interface{}{&AuthParams{ID: authParamsID}, &KeyParams{ID: keyParamsID}} {
+		if err = tx.DeleteStruct(params); err != nil && !errors.Is(err, storm.ErrNotFound) {
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	// a hashed index is keyed with the previous session's keys
+	var postings []searchPosting
+
+	err = db.All(&postings, storm.Limit(1))
+	if err != nil || len(postings) == 0 {
+		return
+	}
+
+	err = RebuildSearchIndex(db, session, strings.HasPrefix(postings[0].Term, hashedTermPrefix))
+
+	return
+}
+
+// reEncrypt returns the item, and its last synced copy, re-encrypted with the session's keys
+// 003 items of an account with items keys are encrypted as 004 items with the first of them
+func reEncrypt(item Item, session, previous gosn.Session, keys []ItemsKey) (updated Item, err error) {
+	updated = item
+
+	if updated.Content, updated.EncItemKey, err = reEncryptContent(item, item.Content, item.EncItemKey, session, previous, keys); err != nil {
+		return
+	}
+
+	if item.BaseContent != "" {
+		updated.BaseContent, updated.BaseEncItemKey, err = reEncryptContent(item, item.BaseContent, item.BaseEncItemKey, session, previous, keys)
+	}
+
+	return
+}
+
+// reEncryptContent decrypts an item's content and key with the previous session's keys and encrypts them with the session's,
+// or with the first of the items keys if there are any
+func reEncryptContent(item Item, content, encItemKey string, session, previous gosn.Session, keys []ItemsKey) (string, string, error) {
+	e := gosn.EncryptedItem{
+		UUID:        item.UUID,
+		Content:     content,
+		ContentType: item.ContentType,
+		EncItemKey:  encItemKey,
+		CreatedAt:   item.CreatedAt,
+		UpdatedAt:   item.UpdatedAt,
+	}
+
+	switch {
+	case item.ContentType == itemsKeyContentType:
+		// only the key is encrypted with the master key, the content is encrypted with the key itself
+		key, err := decryptString004(encItemKey, previous.Mk, item.UUID)
+		if err != nil {
+			return "", "", err
+		}
+
+		encItemKey, err = encryptString004(key, session.Mk, item.UUID)
+
+		return content, encItemKey, err
+	case strings.HasPrefix(content, protocol004+":"):
+		// the key is encrypted with an items key, which is re-encrypted in its place
+		_, err := decryptItem004(e, keys)
+
+		return content, encItemKey, err
+	}
+
+	d, err := gosn.EncryptedItems{e}.Decrypt(previous.Mk, previous.Ak, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(keys) > 0 {
+		e, err = encryptItem004(d[0], keys[0].Key)
+
+		return e.Content, e.EncItemKey, err
+	}
+
+	parsed, err := d.Parse()
+	if err != nil {
+		return "", "", err
+	}
+
+	eItems, err := parsed.Encrypt(session.Mk, session.Ak, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	return eItems[0].Content, eItems[0].EncItemKey, nil
+}
@@ -0,0 +1,111 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// saveKeyChangeItems stores 004 items, a clean 003 note and a dirty 003 note encrypted with the session's keys
+func saveKeyChangeItems(t *testing.T, session gosn.Session) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	clean, _ := createNote("clean", "")
+	dirty, _ := createNote("dirty", "")
+	dItems := gosn.Items{&clean, &dirty}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	for _, i := range ConvertItemsToPersistItems(append(items004(t, session), eItems[0])) {
+		assert.NoError(t, db.Save(&i))
+	}
+
+	assert.NoError(t, SaveItems(db, eItems[1:]))
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token-1"}))
+	assert.NoError(t, SaveAuthParams(db, AuthParams{Identifier: "user@example.com", Version: "003"}))
+}
+
+func TestReEncryptLocal(t *testing.T) {
+	previous := offlineSession()
+	session := offlineSession()
+
+	saveKeyChangeItems(t, previous)
+	defer removeDB(tempDBPath)
+
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	stale, err := DetectKeyChange(db, previous)
+	assert.NoError(t, err)
+	assert.Empty(t, stale)
+
+	stale, err = DetectKeyChange(db, session)
+	assert.NoError(t, err)
+	assert.Len(t, stale, 4)
+
+	reEncrypted, removed, err := ReEncryptLocal(db, session, &previous)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, reEncrypted)
+	assert.Zero(t, removed)
+
+	stale, err = DetectKeyChange(db, session)
+	assert.NoError(t, err)
+	assert.Empty(t, stale)
+
+	items, err := ReadItems(db, session, "Note")
+	assert.NoError(t, err)
+
+	var titles []string
+	for _, n := range items.Notes() {
+		titles = append(titles, n.Content.Title)
+	}
+
+	assert.ElementsMatch(t, []string{"004 note", "clean", "dirty"}, titles)
+
+	// the account has an items key so its 003 notes are not encrypted as 003 again
+	var all []Item
+	assert.NoError(t, db.All(&all))
+
+	for _, i := range all {
+		assert.Equal(t, protocol004, ProtocolVersion(i))
+	}
+
+	dirty, err := ListDirty(db)
+	assert.NoError(t, err)
+	assert.Len(t, dirty, 1)
+
+	ap, err := GetAuthParams(db)
+	assert.NoError(t, err)
+	assert.Nil(t, ap)
+}
+
+func TestReEncryptLocalWithoutPreviousKeys(t *testing.T) {
+	saveKeyChangeItems(t, offlineSession())
+	defer removeDB(tempDBPath)
+
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	reEncrypted, removed, err := ReEncryptLocal(db, offlineSession(), nil)
+	assert.NoError(t, err)
+	assert.Zero(t, reEncrypted)
+	assert.Equal(t, 4, removed)
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Empty(t, all)
+
+	// the dirty note's edits are kept and every item is downloaded again
+	letters, err := DeadLetters(db)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, ErrKeyChanged.Error(), letters[0].Error)
+
+	st, err := getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Empty(t, st.SyncToken)
+}
@@ -0,0 +1,98 @@
+package snpersist
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+)
+
+// KeyParams records the parameters of the keys the DB's items are encrypted with, so keys can be derived from
+// the account's password without asking SN for them and keys supplied later can be checked against them
+type KeyParams struct {
+	ID         int    `storm:"id"`
+	Identifier string // the account's email
+	Version    string // protocol version, e.g. "003" or "004"
+	Nonce      string // nonce the keys were derived with
+	KeyCheck   string // keyed hash identifying the keys without revealing them, set when saved
+
+	// number of key derivation iterations, used by 003 keys only
+	PasswordCost int64
+}
+
+// there is only ever one set of key params per DB
+const keyParamsID = 1
+
+// keyCheck returns a value identifying the session's keys, it cannot be used to recover them
+func keyCheck(session gosn.Session) string {
+	mac := hmac.New(sha256.New, []byte(session.Mk+session.Ak))
+	_, _ = mac.Write([]byte("sn-persist key check"))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SaveKeyParams stores the key params of the session's keys
+func SaveKeyParams(db *storm.DB, kp KeyParams, session gosn.Session) error {
+	kp.ID = keyParamsID
+	kp.KeyCheck = keyCheck(session)
+
+	return db.Save(&kp)
+}
+
+// GetKeyParams returns the stored key params or nil if none have been saved
+func GetKeyParams(db *storm.DB) (kp *KeyParams, err error) {
+	var stored KeyParams
+
+	err = db.One("ID", keyParamsID, &stored)
+	if err != nil {
+		if errors.Is(err, storm.ErrNotFound) {
+			err = nil
+		}
+
+		return
+	}
+
+	return &stored, err
+}
+
+// CheckKeys returns ErrKeyMismatch if the session's keys are not those recorded with the stored key params
+// nothing is checked if no key params have been saved
+func CheckKeys(db *storm.DB, session gosn.Session) (err error) {
+	var kp *KeyParams
+
+	if kp, err = GetKeyParams(db); err != nil || kp == nil {
+		return
+	}
+
+	if !hmac.Equal([]byte(kp.KeyCheck), []byte(keyCheck(session))) {
+		return fmt.Errorf("%w: keys differ from those for %s version %s", ErrKeyMismatch, kp.Identifier, kp.Version)
+	}
+
+	return nil
+}
+
+// checkKeyParams checks the input's session against the stored key params, saving the input's KeyParams
+// if none are stored or they have changed
+func (si SyncInput) checkKeyParams(db *storm.DB) (err error) {
+	if err = CheckKeys(db, si.Session); err != nil || si.KeyParams == nil {
+		return
+	}
+
+	var stored *KeyParams
+
+	if stored, err = GetKeyParams(db); err != nil {
+		return
+	}
+
+	kp := *si.KeyParams
+	kp.ID, kp.KeyCheck = keyParamsID, keyCheck(si.Session)
+
+	if stored != nil && *stored == kp {
+		return nil
+	}
+
+	return db.Save(&kp)
+}
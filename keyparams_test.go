@@ -0,0 +1,59 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestKeyParams(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	kp, err := GetKeyParams(db)
+	assert.NoError(t, err)
+	assert.Nil(t, kp)
+
+	// nothing to check against
+	assert.NoError(t, CheckKeys(db, session))
+
+	assert.NoError(t, SaveKeyParams(db, KeyParams{Identifier: "user@example.com", Version: "003", Nonce: "nonce"}, session))
+
+	kp, err = GetKeyParams(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@example.com", kp.Identifier)
+	assert.Equal(t, "nonce", kp.Nonce)
+	assert.NotEmpty(t, kp.KeyCheck)
+
+	assert.NoError(t, CheckKeys(db, session))
+	assert.True(t, errors.Is(CheckKeys(db, offlineSession()), ErrKeyMismatch))
+}
+
+func TestSyncKeyParams(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+	kp := &KeyParams{Identifier: "user@example.com", Version: "003", Nonce: "nonce"}
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token-1"}}}
+
+	_, err = Sync(SyncInput{Session: session, DB: db, Syncer: fs, KeyParams: kp})
+	assert.NoError(t, err)
+
+	stored, err := GetKeyParams(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "nonce", stored.Nonce)
+
+	// a session with other keys is refused before calling SN
+	_, err = Sync(SyncInput{Session: offlineSession(), DB: db, Syncer: fs})
+	assert.True(t, errors.Is(err, ErrKeyMismatch))
+	assert.Len(t, fs.inputs, 1)
+}
@@ -0,0 +1,92 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockFileSuffix is appended to a DB's path to name the file recording the process that last opened it
+const lockFileSuffix = ".lock"
+
+// openTimeout is how long to wait for another process to release a DB before returning ErrDBLocked
+// it can be changed by passing storm.BoltOptions when opening the DB
+const openTimeout = time.Second
+
+// boltTimeout returns the wait for a DB held by another process set by storm.BoltOptions amongst the options,
+// or openTimeout if they do not set one, so the files opened before storm opens the DB wait as long as storm does
+// storm keeps its options unexported so they are read with reflection
+func boltTimeout(options ...func(*storm.Options) error) time.Duration {
+	var o storm.Options
+
+	for _, option := range options {
+		if err := option(&o); err != nil {
+			return openTimeout
+		}
+	}
+
+	bo := reflect.ValueOf(o).FieldByName("boltOptions")
+	if !bo.IsValid() || bo.IsNil() {
+		return openTimeout
+	}
+
+	return time.Duration(bo.Elem().FieldByName("Timeout").Int())
+}
+
+// DBLockedError is returned when a DB cannot be opened as it is in use by another process
+// it matches ErrDBLocked with errors.Is
+type DBLockedError struct {
+	Path string
+	PID  int // process that last opened the DB, or zero if it is not known
+}
+
+func (e DBLockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s: %s", ErrDBLocked, e.Path)
+	}
+
+	return fmt.Sprintf("%s: %s is held by process %d", ErrDBLocked, e.Path, e.PID)
+}
+
+func (e DBLockedError) Is(target error) bool {
+	return target == ErrDBLocked
+}
+
+// writeLockFile records the current process as the holder of the DB at dbPath
+// the DB itself is locked by bolt, the file only identifies the holder so it is not removed on close
+// and the process it records is only reported while it is running
+func writeLockFile(dbPath string) error {
+	return ioutil.WriteFile(dbPath+lockFileSuffix, []byte(strconv.Itoa(os.Getpid())), 0600)
+}
+
+// lockHolder returns the process recorded as the holder of the DB at dbPath, or zero if it is not known
+// or has exited, as the file remains after the process that wrote it
+func lockHolder(dbPath string) int {
+	b, err := ioutil.ReadFile(dbPath + lockFileSuffix)
+	if err != nil {
+		return 0
+	}
+
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	if pid <= 0 || !processRunning(pid) {
+		return 0
+	}
+
+	return pid
+}
+
+// lockedError returns a DBLockedError in place of the timeout bolt returns when the DB is held by another process
+func lockedError(dbPath string, err error) error {
+	if !errors.Is(err, bolt.ErrTimeout) {
+		return err
+	}
+
+	return DBLockedError{Path: dbPath, PID: lockHolder(dbPath)}
+}
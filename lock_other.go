@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package snpersist
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processRunning reports whether the process with the given ID is running
+// a process owned by another user cannot be signalled but is still running
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = p.Signal(syscall.Signal(0))
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
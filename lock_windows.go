@@ -0,0 +1,32 @@
+package snpersist
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	// access right sufficient to read a process's exit code, granted for processes of other users
+	processQueryLimitedInformation = 0x1000
+	// exit code reported for a process that has not exited
+	stillActive = 259
+)
+
+// processRunning reports whether the process with the given ID is running
+// a process that cannot be opened as access is denied is still running
+func processRunning(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+	}
+
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+
+	if err = syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+
+	return code == stillActive
+}
@@ -0,0 +1,250 @@
+package snpersist
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store held entirely in memory, useful for tests and short-lived processes
+// nothing is persisted once the process exits
+type MemoryStore struct {
+	mu        sync.RWMutex
+	items     map[string]Item
+	titles    map[string]TitleEntry
+	refs      map[string][]Reference
+	search    map[string]map[string]int
+	syncToken SyncToken
+	dirtySeq  uint64
+
+	quarantined map[string]QuarantinedItem
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items:  map[string]Item{},
+		titles: map[string]TitleEntry{},
+		refs:   map[string][]Reference{},
+		search: map[string]map[string]int{},
+
+		quarantined: map[string]QuarantinedItem{},
+	}
+}
+
+func (s *MemoryStore) AllItems() (items []Item, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, i := range s.items {
+		items = append(items, i)
+	}
+
+	return
+}
+
+func (s *MemoryStore) DirtyItems() (items []Item, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, i := range s.items {
+		if i.Dirty {
+			items = append(items, i)
+		}
+	}
+
+	return
+}
+
+func (s *MemoryStore) SyncToken() (SyncToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.syncToken, nil
+}
+
+func (s *MemoryStore) Quarantined() (quarantined []QuarantinedItem, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, q := range s.quarantined {
+		quarantined = append(quarantined, q)
+	}
+
+	return
+}
+
+// Update applies fn to a copy of the store's contents which replaces the original only if fn succeeds
+func (s *MemoryStore) Update(fn func(tx StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{
+		items:     make(map[string]Item, len(s.items)),
+		titles:    make(map[string]TitleEntry, len(s.titles)),
+		refs:      make(map[string][]Reference, len(s.refs)),
+		search:    make(map[string]map[string]int, len(s.search)),
+		syncToken: s.syncToken,
+		dirtySeq:  s.dirtySeq,
+
+		quarantined: make(map[string]QuarantinedItem, len(s.quarantined)),
+	}
+
+	for k, v := range s.items {
+		tx.items[k] = v
+	}
+
+	for k, v := range s.titles {
+		tx.titles[k] = v
+	}
+
+	for k, v := range s.refs {
+		tx.refs[k] = v
+	}
+
+	for k, v := range s.search {
+		tx.search[k] = v
+	}
+
+	for k, v := range s.quarantined {
+		tx.quarantined[k] = v
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.items = tx.items
+	s.titles = tx.titles
+	s.refs = tx.refs
+	s.search = tx.search
+	s.syncToken = tx.syncToken
+	s.dirtySeq = tx.dirtySeq
+	s.quarantined = tx.quarantined
+
+	return nil
+}
+
+// Close is a no-op as there are no resources to release
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// memoryTx implements StoreTx for a copy of a MemoryStore's contents
+type memoryTx struct {
+	items     map[string]Item
+	titles    map[string]TitleEntry
+	refs      map[string][]Reference
+	search    map[string]map[string]int
+	syncToken SyncToken
+	dirtySeq  uint64
+
+	quarantined map[string]QuarantinedItem
+}
+
+func (t *memoryTx) Item(uuid string) (Item, error) {
+	item, ok := t.items[uuid]
+	if !ok {
+		return item, ErrItemNotFound
+	}
+
+	return item, nil
+}
+
+func (t *memoryTx) SaveItem(item Item) error {
+	item.derive()
+
+	_ = item.sequence(func() (uint64, error) {
+		t.dirtySeq++
+		return t.dirtySeq, nil
+	})
+
+	t.items[item.UUID] = item
+
+	return nil
+}
+
+func (t *memoryTx) DeleteItem(uuid string) error {
+	delete(t.items, uuid)
+
+	return nil
+}
+
+func (t *memoryTx) SaveSyncToken(st SyncToken) error {
+	st.SavedAt = time.Now()
+	t.syncToken = st
+
+	return nil
+}
+
+func (t *memoryTx) SaveTitle(entry TitleEntry) error {
+	t.titles[entry.UUID] = entry
+
+	return nil
+}
+
+func (t *memoryTx) DeleteTitle(uuid string) error {
+	delete(t.titles, uuid)
+
+	return nil
+}
+
+func (t *memoryTx) SetReferences(parent string, refs []Reference) error {
+	if len(refs) == 0 {
+		delete(t.refs, parent)
+		return nil
+	}
+
+	t.refs[parent] = append([]Reference(nil), refs...)
+
+	return nil
+}
+
+func (t *memoryTx) DeleteReferencesTo(child string) error {
+	for parent, refs := range t.refs {
+		// the slices are shared with the store so are replaced rather than modified
+		var kept []Reference
+
+		for _, r := range refs {
+			if r.Child != child {
+				kept = append(kept, r)
+			}
+		}
+
+		switch {
+		case len(kept) == 0:
+			delete(t.refs, parent)
+		case len(kept) < len(refs):
+			t.refs[parent] = kept
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTx) SetSearchTerms(uuid string, terms map[string]int) error {
+	if len(terms) == 0 {
+		delete(t.search, uuid)
+		return nil
+	}
+
+	copied := make(map[string]int, len(terms))
+	for k, v := range terms {
+		copied[k] = v
+	}
+
+	t.search[uuid] = copied
+
+	return nil
+}
+
+func (t *memoryTx) Quarantine(q QuarantinedItem) error {
+	t.quarantined[q.UUID] = q
+
+	return nil
+}
+
+func (t *memoryTx) Unquarantine(uuid string) error {
+	delete(t.quarantined, uuid)
+
+	return nil
+}
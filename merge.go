@@ -0,0 +1,323 @@
+package snpersist
+
+import (
+	"fmt"
+	"github.com/jonhadfield/gosn-v2"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hunk replaces the lines of a base text from start up to, but not including, end
+type hunk struct {
+	start, end int
+	lines      []string
+}
+
+// diffLines returns the hunks that turn a into b, found using the longest common subsequence of their lines
+func diffLines(a, b []string) (hunks []hunk) {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			i++
+			j++
+
+			continue
+		}
+
+		h := hunk{start: i}
+
+		for (i < len(a) || j < len(b)) && !(i < len(a) && j < len(b) && a[i] == b[j]) {
+			if j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]) {
+				h.lines = append(h.lines, b[j])
+				j++
+			} else {
+				i++
+			}
+		}
+
+		h.end = i
+		hunks = append(hunks, h)
+	}
+
+	return
+}
+
+// mergeLines performs a three-way merge of the lines of local and remote, both derived from base
+// ok is false if the changes made on each side overlap, or touch, and are not identical
+// unless concurrent is set, in which case both sides' versions of the overlapping lines are kept
+// in an order that does not depend on which side is local, so the result is the same whichever device merges
+func mergeLines(base, local, remote []string, concurrent bool) (merged []string, ok bool) {
+	lh, rh := diffLines(base, local), diffLines(base, remote)
+
+	pos := 0
+
+	apply := func(start, end int, lines []string) {
+		merged = append(merged, base[pos:start]...)
+		merged = append(merged, lines...)
+		pos = end
+	}
+
+	for len(lh) > 0 || len(rh) > 0 {
+		switch {
+		case len(rh) == 0 || (len(lh) > 0 && lh[0].end < rh[0].start):
+			apply(lh[0].start, lh[0].end, lh[0].lines)
+			lh = lh[1:]
+
+			continue
+		case len(lh) == 0 || rh[0].end < lh[0].start:
+			apply(rh[0].start, rh[0].end, rh[0].lines)
+			rh = rh[1:]
+
+			continue
+		}
+
+		// gather the hunks on each side that overlap the same region of base
+		start, end := minInt(lh[0].start, rh[0].start), maxInt(lh[0].end, rh[0].end)
+		lg, rg := []hunk{lh[0]}, []hunk{rh[0]}
+		lh, rh = lh[1:], rh[1:]
+
+		for grew := true; grew; {
+			grew = false
+
+			if len(lh) > 0 && lh[0].start <= end {
+				end = maxInt(end, lh[0].end)
+				lg = append(lg, lh[0])
+				lh = lh[1:]
+				grew = true
+			}
+
+			if len(rh) > 0 && rh[0].start <= end {
+				end = maxInt(end, rh[0].end)
+				rg = append(rg, rh[0])
+				rh = rh[1:]
+				grew = true
+			}
+		}
+
+		l, r := applyHunks(base, lg, start, end), applyHunks(base, rg, start, end)
+
+		switch {
+		case reflect.DeepEqual(l, r):
+			// the same change was made on both sides
+			apply(start, end, l)
+		case !concurrent:
+			return nil, false
+		case strings.Join(l, "\n") < strings.Join(r, "\n"):
+			apply(start, end, append(append([]string{}, l...), r...))
+		default:
+			apply(start, end, append(append([]string{}, r...), l...))
+		}
+	}
+
+	return append(merged, base[pos:]...), true
+}
+
+// applyHunks returns the lines of base from start to end with the hunks, which must lie within them, applied
+func applyHunks(base []string, hunks []hunk, start, end int) (lines []string) {
+	pos := start
+
+	for _, h := range hunks {
+		lines = append(lines, base[pos:h.start]...)
+		lines = append(lines, h.lines...)
+		pos = h.end
+	}
+
+	return append(lines, base[pos:end]...)
+}
+
+// minInt returns the smaller of a and b
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// maxInt returns the larger of a and b
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// mergeText performs a line-based three-way merge of local and remote text, both derived from base
+func mergeText(base, local, remote string, concurrent bool) (merged string, ok bool) {
+	lines, ok := mergeLines(strings.Split(base, "\n"), strings.Split(local, "\n"), strings.Split(remote, "\n"), concurrent)
+	if !ok {
+		return
+	}
+
+	return strings.Join(lines, "\n"), true
+}
+
+// mergeValue returns whichever of local and remote changed from base, ok is false if both changed differently
+func mergeValue(base, local, remote interface{}) (merged interface{}, ok bool) {
+	switch {
+	case reflect.DeepEqual(local, remote), reflect.DeepEqual(base, local):
+		return remote, true
+	case reflect.DeepEqual(base, remote):
+		return local, true
+	}
+
+	return nil, false
+}
+
+// separates the titles of a note changed differently on both sides when both are kept by mergeTitles
+const mergedTitleSeparator = " / "
+
+// mergeTitles returns the merged title of a note
+// if concurrent is set two different changes are both kept, in an order that does not depend on which side is local,
+// unless one of them cleared the title
+func mergeTitles(base, local, remote string, concurrent bool) (string, bool) {
+	merged, ok := mergeValue(base, local, remote)
+	switch {
+	case ok:
+		return merged.(string), true
+	case !concurrent:
+		return "", false
+	case local == "":
+		return remote, true
+	case remote == "":
+		return local, true
+	case local > remote:
+		local, remote = remote, local
+	}
+
+	return local + mergedTitleSeparator + remote, true
+}
+
+// mergeReferences returns the merged references of a note, keeping both sides' references if concurrent is set
+func mergeReferences(base, local, remote gosn.ItemReferences, concurrent bool) (gosn.ItemReferences, bool) {
+	merged, ok := mergeValue(base, local, remote)
+	switch {
+	case ok:
+		return merged.(gosn.ItemReferences), true
+	case !concurrent:
+		return nil, false
+	}
+
+	var refs gosn.ItemReferences
+
+	seen := make(map[string]bool)
+
+	for _, r := range append(append(gosn.ItemReferences{}, local...), remote...) {
+		if !seen[r.UUID] {
+			seen[r.UUID] = true
+			refs = append(refs, r)
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].UUID < refs[j].UUID
+	})
+
+	return refs, true
+}
+
+// mergeNote merges a dirty local note with the copy retrieved from SN, using the last synced copy as the base
+// the merged note is saved dirty, in place of both, so it is pushed with the next sync, encrypted as a 004 item
+// if the sync has an items key
+// merged is false, and nothing saved, if the item is not a note, has no base, or the changes overlap and concurrent is not set
+func mergeNote(tx StoreTx, si SyncInput, local Item, remote gosn.EncryptedItem, concurrent bool) (merged bool, err error) {
+	if local.ContentType != "Note" || remote.ContentType != "Note" || local.Deleted || remote.Deleted || local.BaseContent == "" {
+		return
+	}
+
+	base := local
+	base.Content = local.BaseContent
+	base.EncItemKey = local.BaseEncItemKey
+
+	var keys []ItemsKey
+
+	if keys, err = si.keys(); err != nil {
+		return
+	}
+
+	var items gosn.Items
+
+	items, err = Items{base, local, ConvertItemsToPersistItems(gosn.EncryptedItems{remote})[0]}.ToItems(si.Session, keys...)
+	if err != nil {
+		return
+	}
+
+	notes := items.Notes()
+	if len(notes) != 3 {
+		return false, fmt.Errorf("failed to decrypt note %s", local.UUID)
+	}
+
+	b, l, r := notes[0].Content, notes[1].Content, notes[2].Content
+
+	title, ok := mergeTitles(b.Title, l.Title, r.Title, concurrent)
+	if !ok {
+		return
+	}
+
+	refs, ok := mergeReferences(b.ItemReferences, l.ItemReferences, r.ItemReferences, concurrent)
+	if !ok {
+		return
+	}
+
+	text, ok := mergeText(b.Text, l.Text, r.Text, concurrent)
+	if !ok {
+		return
+	}
+
+	// the merged note replaces the retrieved copy so keeps its timestamps
+	note := notes[2]
+	note.Content.Title = title
+	note.Content.ItemReferences = refs
+	note.Content.Text = text
+
+	var eItems gosn.EncryptedItems
+
+	mItems := gosn.Items{&note}
+
+	eItems, err = encryptItems(mItems, si.Session, keys)
+	if err != nil {
+		return
+	}
+
+	item := ConvertItemsToPersistItems(eItems)[0]
+	item.Dirty = true
+	item.DirtiedDate = time.Now()
+
+	// the retrieved copy is now the last synced copy
+	item.BaseContent = remote.Content
+	item.BaseEncItemKey = remote.EncItemKey
+
+	if err = tx.SaveItem(item); err != nil {
+		return
+	}
+
+	if si.IndexTitles || si.IndexReferences || si.IndexSearch {
+		if err = updateIndexes(tx, si, eItems); err != nil {
+			return
+		}
+	}
+
+	return true, nil
+}
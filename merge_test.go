@@ -0,0 +1,227 @@
+package snpersist
+
+import (
+	"context"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMergeText(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive"
+
+	for _, tc := range []struct {
+		local, remote, merged string
+		ok                    bool
+	}{
+		// changes to separate lines
+		{"ONE\ntwo\nthree\nfour\nfive", "one\ntwo\nthree\nfour\nFIVE", "ONE\ntwo\nthree\nfour\nFIVE", true},
+		// insertion and deletion
+		{"zero\none\ntwo\nthree\nfour\nfive", "one\ntwo\nthree\nfive", "zero\none\ntwo\nthree\nfive", true},
+		// changes on one side only
+		{base, "one\nTWO\nthree\nfour\nfive", "one\nTWO\nthree\nfour\nfive", true},
+		// the same change on both sides
+		{"one\nTWO\nthree\nfour\nfive", "one\nTWO\nthree\nfour\nfive", "one\nTWO\nthree\nfour\nfive", true},
+		// different changes to the same line
+		{"one\nTWO\nthree\nfour\nfive", "one\n2\nthree\nfour\nfive", "", false},
+		// changes to adjacent lines
+		{"one\nTWO\nthree\nfour\nfive", "one\ntwo\nTHREE\nfour\nfive", "", false},
+		// insertions at the same point
+		{"one\na\ntwo\nthree\nfour\nfive", "one\nb\ntwo\nthree\nfour\nfive", "", false},
+	} {
+		merged, ok := mergeText(base, tc.local, tc.remote, false)
+		assert.Equal(t, tc.ok, ok, tc.local+" | "+tc.remote)
+		assert.Equal(t, tc.merged, merged)
+	}
+}
+
+func TestMergeTextConcurrent(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive"
+
+	for _, tc := range []struct {
+		local, remote, merged string
+	}{
+		// changes to separate lines merge as before
+		{"ONE\ntwo\nthree\nfour\nfive", "one\ntwo\nthree\nfour\nFIVE", "ONE\ntwo\nthree\nfour\nFIVE"},
+		// different changes to the same line are both kept
+		{"one\nTWO\nthree\nfour\nfive", "one\n2\nthree\nfour\nfive", "one\n2\nTWO\nthree\nfour\nfive"},
+		// overlapping changes spanning several lines
+		{"one\nTWO\nTHREE\nfour\nfive", "one\ntwo\n3\n4\nfive", "one\nTWO\nTHREE\nfour\ntwo\n3\n4\nfive"},
+		// insertions at the same point
+		{"one\na\ntwo\nthree\nfour\nfive", "one\nb\ntwo\nthree\nfour\nfive", "one\na\nb\ntwo\nthree\nfour\nfive"},
+	} {
+		// the result does not depend on which side is local
+		for _, sides := range [][2]string{{tc.local, tc.remote}, {tc.remote, tc.local}} {
+			merged, ok := mergeText(base, sides[0], sides[1], true)
+			assert.True(t, ok)
+			assert.Equal(t, tc.merged, merged)
+		}
+	}
+}
+
+func TestMergeTitles(t *testing.T) {
+	for _, tc := range []struct {
+		local, remote, merged string
+		ok                    bool
+	}{
+		// a change on one side
+		{"base", "remote", "remote", true},
+		// the same change on both sides
+		{"both", "both", "both", true},
+		// different changes on both sides are both kept
+		{"local", "remote", "local / remote", true},
+		// unless one side cleared the title
+		{"", "remote", "remote", true},
+	} {
+		// the result does not depend on which side is local
+		for _, sides := range [][2]string{{tc.local, tc.remote}, {tc.remote, tc.local}} {
+			merged, ok := mergeTitles("base", sides[0], sides[1], true)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.merged, merged)
+		}
+	}
+
+	_, ok := mergeTitles("base", "local", "remote", false)
+	assert.False(t, ok)
+}
+
+// setupMerge saves a synced note, edits it locally and returns a copy of the synced note edited remotely
+func setupMerge(t *testing.T, db *storm.DB, session gosn.Session, localText, remoteTitle, remoteText string) (uuid string, remote gosn.EncryptedItem) {
+	note, _ := createNote("title", "")
+	note.Content.Text = "one\ntwo\nthree"
+	note.UpdatedAt = "2020-05-19T10:00:00.000Z"
+	dItems := gosn.Items{&note}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	synced := ConvertItemsToPersistItems(eItems)[0]
+	assert.NoError(t, db.Save(&synced))
+
+	local := note.Copy()
+	local.Content.Text = localText
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&local}))
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", note.UUID, &stored))
+	assert.True(t, stored.Dirty)
+	assert.Equal(t, synced.Content, stored.BaseContent)
+
+	note.Content.Title = remoteTitle
+	note.Content.Text = remoteText
+	note.UpdatedAt = "2020-05-20T10:00:00.000Z"
+	eItems, err = dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	return note.UUID, eItems[0]
+}
+
+func TestMergePolicy(t *testing.T) {
+	session := offlineSession()
+
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	si := SyncInput{DB: db, Session: session, ConflictPolicy: Merge}
+
+	// changes that do not overlap are merged into a single dirty note
+	uuid, remote := setupMerge(t, db, session, "ONE\ntwo\nthree", "new title", "one\ntwo\nTHREE")
+
+	var conflicts []Conflict
+	conflicts, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, si, nil, gosn.SyncOutput{Items: gosn.EncryptedItems{remote}, SyncToken: "after"})
+	assert.NoError(t, err)
+	assert.Len(t, conflicts, 1)
+	assert.Equal(t, Merged, conflicts[0].Resolution)
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 1)
+	assert.True(t, all[0].Dirty)
+	assert.Equal(t, remote.UpdatedAt, all[0].UpdatedAt)
+	assert.Equal(t, remote.Content, all[0].BaseContent)
+
+	var note gosn.Note
+	note, err = GetNote(db, session, uuid)
+	assert.NoError(t, err)
+	assert.Equal(t, "new title", note.Content.Title)
+	assert.Equal(t, "ONE\ntwo\nTHREE", note.Content.Text)
+
+	// confirming the push clears the base
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, si, all, gosn.SyncOutput{SavedItems: gosn.EncryptedItems{remote}, SyncToken: "later"})
+	assert.NoError(t, err)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", uuid, &stored))
+	assert.False(t, stored.Dirty)
+	assert.Empty(t, stored.BaseContent)
+
+	assert.NoError(t, db.Drop(&Item{}))
+
+	// overlapping changes fall back to a conflicted copy
+	_, remote = setupMerge(t, db, session, "one\nTWO\nthree", "title", "one\n2\nthree")
+
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, si, nil, gosn.SyncOutput{Items: gosn.EncryptedItems{remote}, SyncToken: "after"})
+	assert.NoError(t, err)
+
+	var items gosn.Items
+	items, err = ReadItems(db, session, "Note")
+	assert.NoError(t, err)
+
+	var texts []string
+	for _, n := range items.Notes() {
+		texts = append(texts, n.Content.Title+": "+n.Content.Text)
+	}
+	assert.ElementsMatch(t, []string{"title: one\n2\nthree", "Conflicted copy of title: one\nTWO\nthree"}, texts)
+
+	assert.NoError(t, db.Drop(&Item{}))
+
+	// concurrent merging keeps both changes in a single note
+	si.ConflictPolicy = MergeConcurrent
+	uuid, remote = setupMerge(t, db, session, "one\nTWO\nthree", "remote title", "one\n2\nthree")
+
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, si, nil, gosn.SyncOutput{Items: gosn.EncryptedItems{remote}, SyncToken: "after"})
+	assert.NoError(t, err)
+
+	note, err = GetNote(db, session, uuid)
+	assert.NoError(t, err)
+	assert.Equal(t, "remote title", note.Content.Title)
+	assert.Equal(t, "one\n2\nTWO\nthree", note.Content.Text)
+
+	all = nil
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 1)
+}
+
+func TestMergePolicy004(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	_, remote := setupConflict004(t, db, session,
+		`{"title":"title","text":"one\ntwo\nthree","references":[]}`,
+		`{"title":"title","text":"ONE\ntwo\nthree","references":[]}`,
+		`{"title":"title","text":"one\ntwo\nTHREE","references":[]}`)
+
+	store := &StormStore{db: db}
+	si := SyncInput{DB: db, Session: session, ConflictPolicy: Merge, itemsKeys: &itemsKeyCache{store: store}}
+
+	var conflicts []Conflict
+	conflicts, _, err = persistSyncOutput(context.Background(), store, si, nil, gosn.SyncOutput{Items: gosn.EncryptedItems{remote}, SyncToken: "after"})
+	assert.NoError(t, err)
+	assert.Len(t, conflicts, 1)
+	assert.Equal(t, Merged, conflicts[0].Resolution)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "note", &stored))
+	assert.Equal(t, protocol004, ProtocolVersion(stored))
+
+	var note gosn.Note
+	note, err = GetNote(db, session, "note")
+	assert.NoError(t, err)
+	assert.Equal(t, "ONE\ntwo\nTHREE", note.Content.Text)
+}
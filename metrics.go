@@ -0,0 +1,123 @@
+package snpersist
+
+import (
+	"context"
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Metrics records the health of syncs as Prometheus metrics
+// provide one with SyncInput.Metrics, the same Metrics can be shared by many syncs
+type Metrics struct {
+	duration prometheus.Histogram
+	pushed   prometheus.Counter
+	pulled   prometheus.Counter
+	errors   *prometheus.CounterVec
+	dirty    prometheus.Gauge
+	dbSize   prometheus.Gauge
+}
+
+// NewMetrics creates the sync metrics and registers them with reg, e.g. prometheus.DefaultRegisterer
+func NewMetrics(reg prometheus.Registerer) (m *Metrics, err error) {
+	m = &Metrics{
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "snpersist",
+			Name:      "sync_duration_seconds",
+			Help:      "Time taken by each sync.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		pushed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "snpersist",
+			Name:      "items_pushed_total",
+			Help:      "Dirty items pushed to SN.",
+		}),
+		pulled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "snpersist",
+			Name:      "items_pulled_total",
+			Help:      "Items retrieved from SN.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snpersist",
+			Name:      "sync_errors_total",
+			Help:      "Failed syncs by type of error.",
+		}, []string{"type"}),
+		dirty: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "snpersist",
+			Name:      "dirty_items",
+			Help:      "Items waiting to be pushed to SN following the last sync.",
+		}),
+		dbSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "snpersist",
+			Name:      "db_size_bytes",
+			Help:      "Size of the storm DB following the last sync.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{m.duration, m.pushed, m.pulled, m.errors, m.dirty, m.dbSize} {
+		if err = reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// observe records the outcome of a sync
+func (m *Metrics) observe(so SyncOutput, err error) {
+	if m == nil || so.Skipped {
+		return
+	}
+
+	m.duration.Observe(so.Stats.Duration.Seconds())
+
+	if err != nil {
+		m.errors.WithLabelValues(errorType(err)).Inc()
+		return
+	}
+
+	m.pushed.Add(float64(so.Stats.Pushed))
+	m.pulled.Add(float64(so.Stats.Pulled))
+
+	if so.Store != nil {
+		if dirty, dErr := so.Store.DirtyItems(); dErr == nil {
+			m.dirty.Set(float64(len(dirty)))
+		}
+	}
+
+	if so.DB != nil {
+		if size, sErr := dbSize(so.DB); sErr == nil {
+			m.dbSize.Set(float64(size))
+		}
+	}
+}
+
+// errorType returns the label used to count a sync error
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	case errors.Is(err, ErrInvalidSession):
+		return "invalid_session"
+	case errors.Is(err, ErrNoDB), errors.Is(err, ErrConflictingDBArgs), errors.Is(err, ErrNoConflictFunc):
+		return "invalid_input"
+	case errors.Is(err, ErrSyncTokenCorrupt), errors.Is(err, ErrSchemaTooNew), errors.Is(err, ErrCodecMismatch):
+		return "db"
+	case IsRetryable(err):
+		return "transient"
+	default:
+		return "other"
+	}
+}
+
+// dbSize returns the size of the DB's data in bytes
+func dbSize(db *storm.DB) (size int64, err error) {
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+
+		return nil
+	})
+
+	return
+}
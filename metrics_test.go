@@ -0,0 +1,51 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSyncMetrics(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}, {UUID: "b", ContentType: "Note"}}))
+
+	reg := prometheus.NewRegistry()
+
+	var m *Metrics
+	m, err = NewMetrics(reg)
+	assert.NoError(t, err)
+
+	// metrics can only be registered once
+	_, err = NewMetrics(reg)
+	assert.Error(t, err)
+
+	fs := &fakeSyncer{
+		errs: []error{nil, errors.New("session is invalid")},
+		outputs: []gosn.SyncOutput{{
+			Items:      gosn.EncryptedItems{{UUID: "c", ContentType: "Tag"}},
+			SavedItems: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}},
+			Unsaved:    gosn.EncryptedItems{{UUID: "b", ContentType: "Note"}},
+			SyncToken:  "token",
+		}},
+	}
+
+	_, err = Sync(SyncInput{Session: offlineSession(), DB: db, Syncer: fs, Metrics: m})
+	assert.NoError(t, err)
+
+	_, err = Sync(SyncInput{Session: offlineSession(), DB: db, Syncer: fs, Metrics: m})
+	assert.Error(t, err)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.pushed))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.pulled))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.dirty))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.errors.WithLabelValues("other")))
+	assert.NotZero(t, testutil.ToFloat64(m.dbSize))
+}
@@ -0,0 +1,164 @@
+package snpersist
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+)
+
+// newKey returns a random hex encoded 256 bit key
+func newKey() (key string, err error) {
+	b := make([]byte, 32)
+
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// encryptItem004 encrypts an item's content with a new item key, itself encrypted with key
+func encryptItem004(item gosn.DecryptedItem, key string) (e gosn.EncryptedItem, err error) {
+	var itemKey string
+
+	if itemKey, err = newKey(); err != nil {
+		return
+	}
+
+	e = gosn.EncryptedItem{
+		UUID:        item.UUID,
+		ContentType: item.ContentType,
+		Deleted:     item.Deleted,
+		CreatedAt:   item.CreatedAt,
+		UpdatedAt:   item.UpdatedAt,
+	}
+
+	if e.EncItemKey, err = encryptString004(itemKey, key, item.UUID); err != nil {
+		return
+	}
+
+	e.Content, err = encryptString004(item.Content, itemKey, item.UUID)
+
+	return
+}
+
+// newItemsKey returns a new items key and the SN|ItemsKey item holding it, encrypted with the root key
+func newItemsKey(rootKey string) (key ItemsKey, item gosn.EncryptedItem, err error) {
+	key = ItemsKey{UUID: gosn.GenUUID(), Version: protocol004}
+
+	if key.Key, err = newKey(); err != nil {
+		return
+	}
+
+	var content []byte
+
+	if content, err = json.Marshal(map[string]string{"itemsKey": key.Key, "version": protocol004}); err != nil {
+		return
+	}
+
+	item, err = encryptItem004(gosn.DecryptedItem{UUID: key.UUID, ContentType: itemsKeyContentType, Content: string(content)}, rootKey)
+
+	return
+}
+
+// MigrateItemsTo004 re-encrypts the stored 003 items, decrypted with the legacy session's keys, as 004 items
+// and marks them dirty so the next sync pushes them
+// session is that of the upgraded account, whose master key is the 004 root key, and an items key encrypted with
+// it is created if the DB does not already hold one
+func MigrateItemsTo004(db *storm.DB, legacy, session gosn.Session) (migrated int, err error) {
+	var all Items
+
+	if err = db.All(&all); err != nil {
+		return
+	}
+
+	var old Items
+
+	for _, i := range all {
+		if !i.Deleted && i.ContentType != itemsKeyContentType && ProtocolVersion(i) == protocol003 {
+			old = append(old, i)
+		}
+	}
+
+	if len(old) == 0 {
+		return
+	}
+
+	var decrypted gosn.DecryptedItems
+
+	if decrypted, err = old.encrypted().Decrypt(legacy.Mk, legacy.Ak, false); err != nil {
+		return
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	var migrating gosn.EncryptedItems
+
+	if len(keys) == 0 {
+		var key ItemsKey
+
+		var item gosn.EncryptedItem
+
+		if key, item, err = newItemsKey(session.Mk); err != nil {
+			return
+		}
+
+		keys = append(keys, key)
+		migrating = append(migrating, item)
+	}
+
+	for _, d := range decrypted {
+		var e gosn.EncryptedItem
+
+		if e, err = encryptItem004(d, keys[0].Key); err != nil {
+			return
+		}
+
+		migrating = append(migrating, e)
+	}
+
+	if err = saveIndexed(db, session, keys, migrating); err != nil {
+		return
+	}
+
+	return len(decrypted), nil
+}
+
+// MigrateTo004 migrates the input's DB as MigrateItemsTo004 does, with si.Session being the upgraded session,
+// and then flushes the migrated items to SN, returning the number that could not be pushed
+// it requires a DB or DBPath, a DB opened from DBPath is closed on return
+func MigrateTo004(si SyncInput, legacy gosn.Session) (migrated, remaining int, err error) {
+	if !si.Session.Valid() {
+		return 0, 0, ErrInvalidSession
+	}
+
+	if si.DB == nil {
+		if si.DBPath == "" || si.Store != nil {
+			return 0, 0, ErrNoDB
+		}
+
+		var db *storm.DB
+
+		if db, err = si.openDB(); err != nil {
+			return
+		}
+
+		defer db.Close()
+
+		si.DB, si.DBPath = db, ""
+	}
+
+	if migrated, err = MigrateItemsTo004(si.DB, legacy, si.Session); err != nil {
+		return
+	}
+
+	remaining, err = Flush(si, 0)
+
+	return
+}
@@ -0,0 +1,91 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// save003Notes stores clean notes encrypted with the legacy session's keys
+func save003Notes(t *testing.T, legacy gosn.Session, titles ...string) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var dItems gosn.Items
+
+	for _, title := range titles {
+		note, _ := createNote(title, "")
+		dItems = append(dItems, &note)
+	}
+
+	eItems, err := dItems.Encrypt(legacy.Mk, legacy.Ak, false)
+	assert.NoError(t, err)
+
+	for _, i := range ConvertItemsToPersistItems(eItems) {
+		assert.NoError(t, db.Save(&i))
+	}
+}
+
+func TestMigrateItemsTo004(t *testing.T) {
+	legacy := offlineSession()
+	session := offlineSession()
+
+	save003Notes(t, legacy, "one", "two")
+	defer removeDB(tempDBPath)
+
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	migrated, err := MigrateItemsTo004(db, legacy, session)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+
+	// the notes and the new items key are pushed by the next sync
+	dirty, err := ListDirty(db)
+	assert.NoError(t, err)
+	assert.Len(t, dirty, 3)
+
+	for _, i := range dirty {
+		assert.Equal(t, protocol004, ProtocolVersion(i))
+	}
+
+	items, err := ReadItems(db, session, "Note")
+	assert.NoError(t, err)
+
+	var titles []string
+	for _, n := range items.Notes() {
+		titles = append(titles, n.Content.Title)
+	}
+
+	assert.ElementsMatch(t, []string{"one", "two"}, titles)
+
+	// nothing is left to migrate
+	migrated, err = MigrateItemsTo004(db, legacy, session)
+	assert.NoError(t, err)
+	assert.Zero(t, migrated)
+}
+
+func TestMigrateTo004(t *testing.T) {
+	legacy := offlineSession()
+
+	save003Notes(t, legacy, "one")
+	defer removeDB(tempDBPath)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token-1"}, {SyncToken: "token-2"}}}
+
+	migrated, remaining, err := MigrateTo004(SyncInput{Session: offlineSession(), DBPath: tempDBPath, Syncer: fs}, legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	// SN did not confirm saving them so they remain dirty
+	assert.Equal(t, 2, remaining)
+
+	assert.Len(t, fs.inputs[0].Items, 2)
+
+	for _, i := range fs.inputs[0].Items {
+		assert.True(t, strings.HasPrefix(i.Content, protocol004+":"))
+	}
+}
@@ -0,0 +1,62 @@
+package snpersist
+
+import (
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"time"
+)
+
+// timeLayout is the format SN uses for item timestamps
+const timeLayout = "2006-01-02T15:04:05.000Z"
+
+// CreateNote encrypts a new note with the session's keys and saves it, marked dirty so the next sync pushes it
+func CreateNote(db *storm.DB, session gosn.Session, title, text string) (note gosn.Note, err error) {
+	note = gosn.NewNote()
+
+	content := gosn.NewNoteContent()
+	content.Title = title
+	content.Text = text
+	note.Content = *content
+
+	err = SaveDecryptedItems(db, session, gosn.Items{&note})
+
+	return
+}
+
+// GetNote returns the decrypted note with the provided UUID
+func GetNote(db *storm.DB, session gosn.Session, uuid string) (note gosn.Note, err error) {
+	var item gosn.Item
+
+	item, err = GetItem(db, session, uuid)
+	if err != nil {
+		return
+	}
+
+	n, ok := item.(*gosn.Note)
+	if !ok {
+		err = fmt.Errorf("item %s is a %s not a Note", uuid, item.GetContentType())
+		return
+	}
+
+	return *n, nil
+}
+
+// UpdateNoteText replaces the text of a note and saves it, marked dirty so the next sync pushes it
+// the time of the edit is recorded in the content, updated_at is left as SN set it as SN refuses items pushed
+// with any other
+func UpdateNoteText(db *storm.DB, session gosn.Session, uuid, text string) (note gosn.Note, err error) {
+	note, err = GetNote(db, session, uuid)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	note.Content.Text = text
+	note.Content.SetUpdateTime(now)
+
+	err = SaveDecryptedItems(db, session, gosn.Items{&note})
+
+	return
+}
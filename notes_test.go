@@ -0,0 +1,86 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNoteLifecycle(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	created, err := CreateNote(db, session, "title", "text")
+	assert.NoError(t, err)
+
+	note, err := GetNote(db, session, created.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "title", note.Content.Title)
+	assert.Equal(t, "text", note.Content.Text)
+
+	assert.NoError(t, ClearDirty(db, []string{created.UUID}))
+
+	_, err = UpdateNoteText(db, session, created.UUID, "new text")
+	assert.NoError(t, err)
+
+	note, err = GetNote(db, session, created.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "title", note.Content.Title)
+	assert.Equal(t, "new text", note.Content.Text)
+	// SN refuses items pushed with an updated_at other than its own
+	assert.Equal(t, created.UpdatedAt, note.UpdatedAt)
+
+	var dirty []Item
+	dirty, err = ListDirty(db)
+	assert.NoError(t, err)
+	assert.Len(t, dirty, 1)
+
+	tag := createTag("tag", "")
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{tag}))
+	_, err = GetNote(db, session, tag.UUID)
+	assert.Error(t, err)
+
+	_, err = UpdateNoteText(db, session, "missing", "text")
+	assert.Equal(t, ErrItemNotFound, err)
+}
+
+func TestNotes004(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+	assert.NoError(t, SaveItems(db, items004(t, session)))
+
+	// items written back to an account with an items key stay 004
+	_, err = UpdateNoteText(db, session, "note", "new text")
+	assert.NoError(t, err)
+
+	created, err := CreateNote(db, session, "created", "text")
+	assert.NoError(t, err)
+
+	tag, err := CreateTag(db, session, "tag")
+	assert.NoError(t, err)
+	assert.NoError(t, TagNote(db, session, tag.UUID, "note"))
+
+	for _, uuid := range []string{"note", created.UUID, tag.UUID} {
+		var stored Item
+		assert.NoError(t, db.One("UUID", uuid, &stored))
+		assert.Equal(t, protocol004, ProtocolVersion(stored))
+	}
+
+	note, err := GetNote(db, session, "note")
+	assert.NoError(t, err)
+	assert.Equal(t, "004 note", note.Content.Title)
+	assert.Equal(t, "new text", note.Content.Text)
+
+	tag, err = GetTag(db, session, tag.UUID)
+	assert.NoError(t, err)
+	assert.Len(t, tag.Content.References(), 1)
+}
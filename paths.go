@@ -0,0 +1,63 @@
+package snpersist
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	// directory created for the DB within the user's data directory
+	defaultDBDir = "sn-persist"
+	// name of the DB file within defaultDBDir
+	defaultDBName = "sn.db"
+)
+
+// DefaultDBPath returns a per-user path for the DB, creating its directory if required
+// the directory is within $XDG_DATA_HOME, or ~/.local/share, on Linux and other Unix systems,
+// ~/Library/Application Support on macOS and %APPDATA% on Windows
+func DefaultDBPath() (path string, err error) {
+	var dir string
+
+	if dir, err = userDataDir(); err != nil {
+		return
+	}
+
+	dir = filepath.Join(dir, defaultDBDir)
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	return filepath.Join(dir, defaultDBName), nil
+}
+
+// userDataDir returns the platform's directory for per-user application data
+func userDataDir() (dir string, err error) {
+	switch runtime.GOOS {
+	case "windows":
+		if dir = os.Getenv("APPDATA"); dir == "" {
+			err = errors.New("%APPDATA% is not defined")
+		}
+
+		return
+	case "darwin":
+		if dir, err = os.UserHomeDir(); err != nil {
+			return
+		}
+
+		return filepath.Join(dir, "Library", "Application Support"), nil
+	}
+
+	// XDG requires the path to be absolute, otherwise it is ignored
+	if dir = os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return
+	}
+
+	if dir, err = os.UserHomeDir(); err != nil {
+		return
+	}
+
+	return filepath.Join(dir, ".local", "share"), nil
+}
@@ -0,0 +1,32 @@
+package snpersist
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDefaultDBPath(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("XDG_DATA_HOME is only used on Linux and other Unix systems")
+	}
+
+	dir, err := ioutil.TempDir("", "snpersist-data")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("XDG_DATA_HOME", os.Getenv("XDG_DATA_HOME"))
+	assert.NoError(t, os.Setenv("XDG_DATA_HOME", dir))
+
+	path, err := DefaultDBPath()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "sn-persist", "sn.db"), path)
+
+	// the directory is created so the DB can be opened
+	db, err := Open(path)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+}
@@ -0,0 +1,366 @@
+package snpersist
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"strings"
+)
+
+const (
+	// content type of the items holding the keys that 004 items are encrypted with
+	itemsKeyContentType = "SN|ItemsKey"
+	// protocol versions, the prefix of each encrypted string
+	protocol003 = "003"
+	protocol004 = "004"
+)
+
+// ItemsKey is a decrypted SN|ItemsKey, used to decrypt the keys of 004 items
+// gosn only handles 003 items, encrypted with the session's keys, so 004 items are decrypted here
+type ItemsKey struct {
+	UUID    string
+	Key     string // hex encoded 256 bit key
+	Version string
+}
+
+// ProtocolVersion returns the protocol version an item's content was encrypted with, e.g. "003" or "004"
+func ProtocolVersion(item Item) string {
+	if i := strings.Index(item.Content, ":"); i > 0 {
+		return item.Content[:i]
+	}
+
+	return ""
+}
+
+// authenticatedData is bound to the content of a 004 item so it cannot be moved to another item
+type authenticatedData struct {
+	UUID    string `json:"u"`
+	Version string `json:"v"`
+}
+
+// decryptString004 decrypts a 004 string, "004:nonce:ciphertext:authenticated data", encrypted with the
+// hex encoded key for the item with the given UUID
+func decryptString004(s, key, uuid string) (plaintext string, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 || parts[0] != protocol004 {
+		return "", fmt.Errorf("item %s is not a valid 004 string", uuid)
+	}
+
+	var ad []byte
+
+	if ad, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+		return
+	}
+
+	var data authenticatedData
+
+	if err = json.Unmarshal(ad, &data); err != nil {
+		return
+	}
+
+	if data.UUID != uuid {
+		return "", fmt.Errorf("item %s is authenticated for item %s", uuid, data.UUID)
+	}
+
+	var k, nonce, ciphertext []byte
+
+	if k, err = hex.DecodeString(key); err != nil {
+		return
+	}
+
+	if nonce, err = hex.DecodeString(parts[1]); err != nil {
+		return
+	}
+
+	if ciphertext, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return
+	}
+
+	aead, err := chacha20poly1305.NewX(k)
+	if err != nil {
+		return
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return "", fmt.Errorf("item %s has an invalid nonce", uuid)
+	}
+
+	var b []byte
+
+	// the encoded authenticated data is authenticated, as it is by the official clients
+	if b, err = aead.Open(nil, nonce, ciphertext, []byte(parts[3])); err != nil {
+		return
+	}
+
+	return string(b), nil
+}
+
+// encryptString004 encrypts plaintext with the hex encoded key for the item with the given UUID as a 004 string
+func encryptString004(plaintext, key, uuid string) (s string, err error) {
+	var k []byte
+
+	if k, err = hex.DecodeString(key); err != nil {
+		return
+	}
+
+	aead, err := chacha20poly1305.NewX(k)
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	var ad []byte
+
+	if ad, err = json.Marshal(authenticatedData{UUID: uuid, Version: protocol004}); err != nil {
+		return
+	}
+
+	encodedAD := base64.StdEncoding.EncodeToString(ad)
+	ciphertext := aead.Seal(nil, nonce, []byte(plaintext), []byte(encodedAD))
+
+	return strings.Join([]string{protocol004, hex.EncodeToString(nonce), base64.StdEncoding.EncodeToString(ciphertext), encodedAD}, ":"), nil
+}
+
+// decryptItem004 decrypts a 004 item, whose key is encrypted with one of the items keys
+// the items key used is not recorded by gosn so each is tried in turn
+func decryptItem004(item gosn.EncryptedItem, keys []ItemsKey) (content string, err error) {
+	err = fmt.Errorf("no items key decrypts item %s", item.UUID)
+
+	for _, k := range keys {
+		var itemKey string
+
+		if itemKey, err = decryptString004(item.EncItemKey, k.Key, item.UUID); err != nil {
+			continue
+		}
+
+		return decryptString004(item.Content, itemKey, item.UUID)
+	}
+
+	return
+}
+
+// decryptItemsKeys decrypts the SN|ItemsKey items, which are encrypted with the session's master key
+// items keys that are deleted, or cannot be decrypted, are skipped
+func decryptItemsKeys(items gosn.EncryptedItems, session gosn.Session) (keys []ItemsKey) {
+	root := []ItemsKey{{Key: session.Mk, Version: protocol004}}
+
+	for _, i := range items {
+		if i.ContentType != itemsKeyContentType || i.Deleted {
+			continue
+		}
+
+		content, err := decryptItem004(i, root)
+		if err != nil {
+			continue
+		}
+
+		var c struct {
+			ItemsKey string `json:"itemsKey"`
+			Version  string `json:"version"`
+		}
+
+		if json.Unmarshal([]byte(content), &c) != nil || c.ItemsKey == "" {
+			continue
+		}
+
+		keys = append(keys, ItemsKey{UUID: i.UUID, Key: c.ItemsKey, Version: c.Version})
+	}
+
+	return
+}
+
+// ItemsKeys returns the decrypted items keys stored in the DB
+func ItemsKeys(db *storm.DB, session gosn.Session) (keys []ItemsKey, err error) {
+	var stored Items
+
+	err = db.Find("ContentType", itemsKeyContentType, &stored)
+	if errors.Is(err, storm.ErrNotFound) {
+		return nil, nil
+	}
+
+	return decryptItemsKeys(stored.encrypted(), session), err
+}
+
+// storedItemsKeys returns the decrypted items keys held by the store
+func storedItemsKeys(store Store, session gosn.Session) (keys []ItemsKey, err error) {
+	if ss, ok := store.(*StormStore); ok {
+		return ItemsKeys(ss.db, session)
+	}
+
+	var all Items
+
+	if all, err = store.AllItems(); err != nil {
+		return
+	}
+
+	return decryptItemsKeys(all.encrypted(), session), nil
+}
+
+// decryptItems decrypts 003 items with the session's keys, and 004 items with the items keys, in order
+// items keys, which gosn cannot parse, are not returned but are used to decrypt the other items
+func decryptItems(eItems gosn.EncryptedItems, session gosn.Session, keys []ItemsKey) (decrypted gosn.DecryptedItems, err error) {
+	keys = append(decryptItemsKeys(eItems, session), keys...)
+
+	var legacy gosn.EncryptedItems
+
+	// gosn decrypts a run of 003 items in one call
+	flush := func() error {
+		if len(legacy) == 0 {
+			return nil
+		}
+
+		d, dErr := legacy.Decrypt(session.Mk, session.Ak, false)
+		if dErr != nil {
+			return dErr
+		}
+
+		decrypted = append(decrypted, d...)
+		legacy = nil
+
+		return nil
+	}
+
+	for _, i := range eItems {
+		if i.ContentType == itemsKeyContentType {
+			continue
+		}
+
+		if i.EncItemKey == "" || !strings.HasPrefix(i.Content, protocol004+":") {
+			legacy = append(legacy, i)
+			continue
+		}
+
+		if err = flush(); err != nil {
+			return
+		}
+
+		var content string
+
+		if content, err = decryptItem004(i, keys); err != nil {
+			return
+		}
+
+		decrypted = append(decrypted, gosn.DecryptedItem{
+			UUID:        i.UUID,
+			Content:     content,
+			ContentType: i.ContentType,
+			Deleted:     i.Deleted,
+			CreatedAt:   i.CreatedAt,
+			UpdatedAt:   i.UpdatedAt,
+		})
+	}
+
+	err = flush()
+
+	return
+}
+
+// encryptItems encrypts items as 004 items with the first of the items keys or, for an account that has none,
+// as 003 items with the session's keys, so items written back to an upgraded account are not downgraded to 003
+func encryptItems(items gosn.Items, session gosn.Session, keys []ItemsKey) (eItems gosn.EncryptedItems, err error) {
+	if len(keys) == 0 {
+		return items.Encrypt(session.Mk, session.Ak, false)
+	}
+
+	for _, i := range items {
+		// content is serialised as gosn serialises it for a 003 item
+		content, _ := json.Marshal(i.GetContent())
+
+		var e gosn.EncryptedItem
+
+		e, err = encryptItem004(gosn.DecryptedItem{
+			UUID:        i.GetUUID(),
+			Content:     string(content),
+			ContentType: i.GetContentType(),
+			Deleted:     i.IsDeleted(),
+			CreatedAt:   i.GetCreatedAt(),
+			UpdatedAt:   i.GetUpdatedAt(),
+		}, keys[0].Key)
+		if err != nil {
+			return
+		}
+
+		eItems = append(eItems, e)
+	}
+
+	return
+}
+
+// decryptStored returns the decrypted content of a stored item, an items key is decrypted with the session's
+// master key and other items with the session's keys or the items keys
+func decryptStored(item Item, session gosn.Session, keys []ItemsKey) (content string, err error) {
+	e := Items{item}.encrypted()
+
+	if item.ContentType == itemsKeyContentType {
+		return decryptItem004(e[0], []ItemsKey{{Key: session.Mk, Version: protocol004}})
+	}
+
+	var decrypted gosn.DecryptedItems
+
+	if decrypted, err = decryptItems(e, session, keys); err != nil {
+		return
+	}
+
+	if len(decrypted) != 1 {
+		return "", fmt.Errorf("failed to decrypt item %s", item.UUID)
+	}
+
+	return decrypted[0].Content, nil
+}
+
+// itemsKeyCache loads the items keys held by a sync's store when they are first needed
+// and collects those retrieved by the sync
+type itemsKeyCache struct {
+	store  Store
+	loaded bool
+	keys   []ItemsKey
+}
+
+// keys returns the items keys available to the sync
+func (si SyncInput) keys() (keys []ItemsKey, err error) {
+	c := si.itemsKeys
+	if c == nil {
+		return
+	}
+
+	if !c.loaded {
+		var stored []ItemsKey
+
+		if stored, err = storedItemsKeys(c.store, si.Session); err != nil {
+			return
+		}
+
+		c.keys = append(stored, c.keys...)
+		c.loaded = true
+	}
+
+	return c.keys, nil
+}
+
+// addKeys makes the items keys amongst items retrieved by the sync available to the rest of it
+func (si SyncInput) addKeys(items gosn.EncryptedItems) {
+	if si.itemsKeys != nil {
+		si.itemsKeys.keys = append(si.itemsKeys.keys, decryptItemsKeys(items, si.Session)...)
+	}
+}
+
+// decrypt decrypts items with the session's keys and the items keys available to the sync
+func (si SyncInput) decrypt(eItems gosn.EncryptedItems) (gosn.DecryptedItems, error) {
+	keys, err := si.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptItems(eItems, si.Session, keys)
+}
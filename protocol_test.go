@@ -0,0 +1,127 @@
+package snpersist
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// randomKey returns a hex encoded 256 bit key
+func randomKey(t *testing.T) string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	assert.NoError(t, err)
+
+	return hex.EncodeToString(b)
+}
+
+// encrypt004 returns a 004 item with the content, its item key encrypted with key
+func encrypt004(t *testing.T, uuid, contentType, content, key string) gosn.EncryptedItem {
+	itemKey := randomKey(t)
+
+	encItemKey, err := encryptString004(itemKey, key, uuid)
+	assert.NoError(t, err)
+
+	encContent, err := encryptString004(content, itemKey, uuid)
+	assert.NoError(t, err)
+
+	return gosn.EncryptedItem{
+		UUID:        uuid,
+		Content:     encContent,
+		ContentType: contentType,
+		EncItemKey:  encItemKey,
+		CreatedAt:   "2020-05-19T10:00:00.000Z",
+		UpdatedAt:   "2020-05-19T10:00:00.000Z",
+	}
+}
+
+// items004 returns an items key, encrypted with the session's master key, and a note encrypted with it
+func items004(t *testing.T, session gosn.Session) gosn.EncryptedItems {
+	itemsKey := randomKey(t)
+
+	return gosn.EncryptedItems{
+		encrypt004(t, "items-key", itemsKeyContentType, `{"itemsKey":"`+itemsKey+`","version":"004"}`, session.Mk),
+		encrypt004(t, "note", "Note", `{"title":"004 note","text":"text","references":[]}`, itemsKey),
+	}
+}
+
+func TestDecryptString004(t *testing.T) {
+	key := randomKey(t)
+
+	s, err := encryptString004("plaintext", key, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "004", ProtocolVersion(Item{Content: s}))
+
+	plaintext, err := decryptString004(s, key, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "plaintext", plaintext)
+
+	// the content is bound to its item and key
+	_, err = decryptString004(s, key, "b")
+	assert.Error(t, err)
+
+	_, err = decryptString004(s, randomKey(t), "a")
+	assert.Error(t, err)
+}
+
+func TestReadItems004(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	// a 003 note alongside the 004 items
+	note, _ := createNote("003 note", "")
+	dItems := gosn.Items{&note}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	for _, i := range ConvertItemsToPersistItems(append(items004(t, session), eItems...)) {
+		assert.NoError(t, db.Save(&i))
+	}
+
+	keys, err := ItemsKeys(db, session)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	for _, contentType := range []string{"Note", ""} {
+		items, err := ReadItems(db, session, contentType)
+		assert.NoError(t, err)
+
+		var titles []string
+		for _, n := range items.Notes() {
+			titles = append(titles, n.Content.Title)
+		}
+
+		assert.ElementsMatch(t, []string{"004 note", "003 note"}, titles)
+	}
+
+	item, err := GetItem(db, session, "note")
+	assert.NoError(t, err)
+	assert.Equal(t, "004 note", item.(*gosn.Note).Content.Title)
+}
+
+func TestSyncIndexes004(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token-1"}))
+
+	// the items key and the note it decrypts are retrieved together
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{Items: items004(t, session), SyncToken: "token-2"}}}
+
+	so, err := Sync(SyncInput{Session: session, DB: db, Syncer: fs, IndexTitles: true})
+	assert.NoError(t, err)
+	assert.Empty(t, so.ItemErrors)
+
+	entries, err := SearchTitles(db, "004")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,109 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jonhadfield/gosn-v2"
+	"time"
+)
+
+// QuarantinedItem is an item retrieved from SN that was set aside, rather than stored, as it failed validation
+type QuarantinedItem struct {
+	UUID   string `storm:"id"`
+	Item   gosn.EncryptedItem
+	Reason string
+	At     time.Time
+}
+
+// validateItem returns the reason an item retrieved from SN cannot be stored, or nil if it can
+// items without a UUID are not validated, they cannot be quarantined and are returned as item errors
+func validateItem(i gosn.EncryptedItem) error {
+	if i.UUID == "" {
+		return nil
+	}
+
+	if i.ContentType == "" {
+		return errors.New("missing content type")
+	}
+
+	for _, ts := range []string{i.CreatedAt, i.UpdatedAt} {
+		if ts == "" {
+			continue
+		}
+
+		if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+			return fmt.Errorf("invalid timestamp %q", ts)
+		}
+	}
+
+	// encrypted content must be in the format of a supported protocol
+	if !i.Deleted && i.EncItemKey != "" {
+		switch ProtocolVersion(Item{Content: i.Content}) {
+		case protocol003, protocol004:
+		default:
+			return errors.New("content is not encrypted with a supported protocol")
+		}
+	}
+
+	return nil
+}
+
+// quarantine sets aside an item that failed validation in place of storing it
+func quarantine(tx StoreTx, i gosn.EncryptedItem, reason error) error {
+	return tx.Quarantine(QuarantinedItem{UUID: i.UUID, Item: i, Reason: reason.Error(), At: time.Now()})
+}
+
+// RetryQuarantined validates the quarantined items again, e.g. after upgrading this package, storing those that
+// now pass unless a dirty local copy exists, and returns their UUIDs
+// items that still fail validation remain quarantined
+func RetryQuarantined(store Store) (restored []string, err error) {
+	var quarantined []QuarantinedItem
+
+	if quarantined, err = store.Quarantined(); err != nil {
+		return
+	}
+
+	err = store.Update(func(tx StoreTx) (err error) {
+		restored = nil
+
+		for _, q := range quarantined {
+			if validateItem(q.Item) != nil {
+				continue
+			}
+
+			var existing Item
+
+			existing, err = tx.Item(q.Item.UUID)
+
+			switch {
+			case err == nil && existing.Dirty:
+				// the local edits are pushed instead
+			case err == nil || errors.Is(err, ErrItemNotFound):
+				if q.Item.Deleted {
+					err = tx.DeleteItem(q.Item.UUID)
+				} else {
+					err = tx.SaveItem(ConvertItemsToPersistItems(gosn.EncryptedItems{q.Item})[0])
+				}
+
+				if err != nil {
+					return
+				}
+			default:
+				return
+			}
+
+			if err = tx.Unquarantine(q.UUID); err != nil {
+				return
+			}
+
+			restored = append(restored, q.Item.UUID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		restored = nil
+	}
+
+	return
+}
@@ -0,0 +1,73 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidateItem(t *testing.T) {
+	assert.NoError(t, validateItem(gosn.EncryptedItem{UUID: "a", ContentType: "Note", UpdatedAt: "2020-05-19T10:00:00.000Z"}))
+	assert.NoError(t, validateItem(gosn.EncryptedItem{UUID: "a", ContentType: "Note", EncItemKey: "key", Deleted: true}))
+
+	assert.Error(t, validateItem(gosn.EncryptedItem{UUID: "a"}))
+	assert.Error(t, validateItem(gosn.EncryptedItem{UUID: "a", ContentType: "Note", CreatedAt: "yesterday"}))
+	assert.Error(t, validateItem(gosn.EncryptedItem{UUID: "a", ContentType: "Note", EncItemKey: "key", Content: "plain"}))
+}
+
+func TestSyncQuarantine(t *testing.T) {
+	store := NewMemoryStore()
+	events := NewEvents()
+
+	sub, cancel := events.Subscribe(10)
+	defer cancel()
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{
+		Items:     gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}, {UUID: "b", ContentType: "Note", EncItemKey: "key", Content: "plain"}},
+		SyncToken: "token-1",
+	}}}
+
+	// the sync completes and its token is kept without the malformed item
+	_, err := Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs, Events: events})
+	assert.NoError(t, err)
+
+	st, err := store.SyncToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", st.SyncToken)
+
+	all, err := store.AllItems()
+	assert.NoError(t, err)
+	assert.Len(t, all, 1)
+
+	var quarantinedEvents []Event
+	for len(sub) > 0 {
+		if e := <-sub; e.Type == ItemQuarantined {
+			quarantinedEvents = append(quarantinedEvents, e)
+		}
+	}
+
+	assert.Len(t, quarantinedEvents, 1)
+	assert.Equal(t, "b", quarantinedEvents[0].UUID)
+	assert.Error(t, quarantinedEvents[0].Err)
+
+	// an item that still fails validation stays quarantined
+	restored, err := RetryQuarantined(store)
+	assert.NoError(t, err)
+	assert.Empty(t, restored)
+
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.Quarantine(QuarantinedItem{UUID: "c", Item: gosn.EncryptedItem{UUID: "c", ContentType: "Tag"}, Reason: "an older rule"})
+	}))
+
+	restored, err = RetryQuarantined(store)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, restored)
+
+	quarantined, err := store.Quarantined()
+	assert.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+
+	all, err = store.AllItems()
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+}
@@ -0,0 +1,226 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/index"
+	"github.com/asdine/storm/v3/q"
+	"github.com/jonhadfield/gosn-v2"
+	"sort"
+	"time"
+)
+
+// ReadItems returns the decrypted, non-deleted items of the given content type
+// if contentType is empty then items of all types are returned
+func ReadItems(db *storm.DB, session gosn.Session, contentType string) (items gosn.Items, err error) {
+	var persistItems Items
+
+	if contentType == "" {
+		err = db.All(&persistItems)
+	} else {
+		err = db.Find("ContentType", contentType, &persistItems)
+	}
+
+	if err != nil {
+		if !errors.Is(err, storm.ErrNotFound) {
+			return
+		}
+
+		err = nil
+	}
+
+	var live Items
+
+	for _, pi := range persistItems {
+		if pi.Deleted {
+			continue
+		}
+
+		live = append(live, pi)
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	items, err = live.ToItems(session, keys...)
+	if items == nil {
+		items = gosn.Items{}
+	}
+
+	return
+}
+
+// GetItem returns the decrypted item with the provided UUID
+func GetItem(db *storm.DB, session gosn.Session, uuid string) (item gosn.Item, err error) {
+	var pi Item
+
+	err = db.One("UUID", uuid, &pi)
+	if err != nil {
+		if errors.Is(err, storm.ErrNotFound) {
+			err = ErrItemNotFound
+		}
+
+		return
+	}
+
+	if pi.Deleted {
+		return nil, ErrItemDeleted
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	var items gosn.Items
+
+	items, err = Items{pi}.ToItems(session, keys...)
+	if err != nil {
+		return
+	}
+
+	if len(items) != 1 {
+		return nil, fmt.Errorf("failed to decrypt item %s", uuid)
+	}
+
+	return items[0], err
+}
+
+// Filter restricts the items returned by GetItems, ForEachItem and ItemIterator
+// zero values are not used to filter, so Deleted and Dirty are pointers to allow both states to be selected
+type Filter struct {
+	ContentType  string
+	Deleted      *bool
+	Dirty        *bool
+	UpdatedSince time.Time // only items updated after this time
+	// only items updated before, created after or created before these times, using the parsed timestamps
+	UpdatedBefore time.Time
+	CreatedSince  time.Time
+	CreatedBefore time.Time
+	Limit         int // maximum number of items to return, unlimited if zero
+	Offset        int // number of matching items to skip
+}
+
+// updatedSince matches items with an UpdatedAt timestamp after since
+type updatedSince time.Time
+
+func (u updatedSince) MatchField(v interface{}) (bool, error) {
+	updatedAt, ok := v.(string)
+	if !ok {
+		return false, fmt.Errorf("UpdatedAt is not a string")
+	}
+
+	return isNewer(updatedAt, time.Time(u).Format(time.RFC3339Nano)), nil
+}
+
+// matchers returns the matchers for the filter's conditions other than content type
+func (f Filter) matchers() (matchers []q.Matcher) {
+	if f.Deleted != nil {
+		matchers = append(matchers, q.Eq("Deleted", *f.Deleted))
+	}
+
+	if f.Dirty != nil {
+		matchers = append(matchers, q.Eq("Dirty", *f.Dirty))
+	}
+
+	if !f.UpdatedSince.IsZero() {
+		matchers = append(matchers, q.NewFieldMatcher("UpdatedAt", updatedSince(f.UpdatedSince)))
+	}
+
+	if !f.UpdatedBefore.IsZero() {
+		matchers = append(matchers, q.Lt("UpdatedAtTime", f.UpdatedBefore))
+	}
+
+	if !f.CreatedSince.IsZero() {
+		matchers = append(matchers, q.Gt("CreatedAtTime", f.CreatedSince))
+	}
+
+	if !f.CreatedBefore.IsZero() {
+		matchers = append(matchers, q.Lt("CreatedAtTime", f.CreatedBefore))
+	}
+
+	return
+}
+
+// GetItems returns the persisted, encrypted items matching the filter, ordered by UUID
+func GetItems(db *storm.DB, filter Filter) (items []Item, err error) {
+	matchers := filter.matchers()
+
+	var options []func(*index.Options)
+
+	if filter.Limit > 0 {
+		options = append(options, storm.Limit(filter.Limit))
+	}
+
+	if filter.Offset > 0 {
+		options = append(options, storm.Skip(filter.Offset))
+	}
+
+	switch {
+	// use the content type index where possible
+	case len(matchers) == 0 && filter.ContentType != "":
+		err = db.Find("ContentType", filter.ContentType, &items, options...)
+	case len(matchers) == 0:
+		err = db.All(&items, options...)
+	default:
+		if filter.ContentType != "" {
+			matchers = append(matchers, q.Eq("ContentType", filter.ContentType))
+		}
+
+		query := db.Select(matchers...).OrderBy("UUID")
+
+		if filter.Limit > 0 {
+			query = query.Limit(filter.Limit)
+		}
+
+		if filter.Offset > 0 {
+			query = query.Skip(filter.Offset)
+		}
+
+		err = query.Find(&items)
+	}
+
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+// latest time that can be stored in the UpdatedAtTime index
+var maxIndexedTime = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// ItemsModifiedSince returns the items, including those flagged as deleted, updated after since, oldest first
+// the UpdatedAtTime index is used so only the matching items are read
+func ItemsModifiedSince(db *storm.DB, since time.Time) (items []Item, err error) {
+	// index keys are encoded times that sort out of order within a second so start a second early and filter
+	from := since.UTC().Truncate(time.Second).Add(-time.Second)
+
+	var candidates []Item
+
+	err = db.Range("UpdatedAtTime", from, maxIndexedTime, &candidates)
+	if err != nil {
+		if errors.Is(err, storm.ErrNotFound) {
+			err = nil
+		}
+
+		return
+	}
+
+	for _, c := range candidates {
+		if c.UpdatedAtTime.After(since) {
+			items = append(items, c)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].UpdatedAtTime.Before(items[j].UpdatedAtTime)
+	})
+
+	return
+}
@@ -0,0 +1,204 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReadItems(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	// nothing stored
+	var items gosn.Items
+	items, err = ReadItems(db, session, "Note")
+	assert.NoError(t, err)
+	assert.NotNil(t, items)
+	assert.Empty(t, items)
+
+	note, _ := createNote("test", "")
+	tag := createTag("tag", "")
+	deletedNote, _ := createNote("deleted", "")
+	deletedNote.Deleted = true
+	dItems := gosn.Items{&note, tag, &deletedNote}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	for _, i := range ConvertItemsToPersistItems(eItems) {
+		i := i
+		assert.NoError(t, db.Save(&i))
+	}
+
+	items, err = ReadItems(db, session, "Note")
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, note.UUID, items[0].GetUUID())
+
+	items, err = ReadItems(db, session, "")
+	assert.NoError(t, err)
+	assert.Len(t, items, 2)
+}
+
+func TestGetItem(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	_, err = GetItem(db, session, "missing")
+	assert.Equal(t, ErrItemNotFound, err)
+
+	note, text := createNote("test", "")
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&note}))
+
+	var item gosn.Item
+	item, err = GetItem(db, session, note.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, text, item.(*gosn.Note).Content.Text)
+
+	assert.NoError(t, db.UpdateField(&Item{UUID: note.UUID}, "Deleted", true))
+	_, err = GetItem(db, session, note.UUID)
+	assert.Equal(t, ErrItemDeleted, err)
+}
+
+func TestGetItems(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	// nothing stored
+	var items []Item
+	items, err = GetItems(db, Filter{ContentType: "Note"})
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+
+	assert.NoError(t, db.Save(&Item{UUID: "d", ContentType: "Note", UpdatedAt: "2020-05-01T10:00:00.000Z"}))
+	assert.NoError(t, db.Save(&Item{UUID: "b", ContentType: "Note", UpdatedAt: "2020-05-03T10:00:00.000Z", Dirty: true}))
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", UpdatedAt: "2020-05-02T10:00:00.000Z", Deleted: true}))
+	assert.NoError(t, db.Save(&Item{UUID: "c", ContentType: "Tag", UpdatedAt: "2020-05-04T10:00:00.000Z"}))
+
+	uuids := func(items []Item) (u []string) {
+		for _, i := range items {
+			u = append(u, i.UUID)
+		}
+
+		return
+	}
+
+	yes, no := true, false
+
+	items, err = GetItems(db, Filter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, uuids(items))
+
+	items, err = GetItems(db, Filter{ContentType: "Note"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "d"}, uuids(items))
+
+	items, err = GetItems(db, Filter{ContentType: "Note", Deleted: &no})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "d"}, uuids(items))
+
+	items, err = GetItems(db, Filter{Dirty: &yes})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, uuids(items))
+
+	since, _ := time.Parse(time.RFC3339, "2020-05-02T10:00:00Z")
+	items, err = GetItems(db, Filter{UpdatedSince: since})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, uuids(items))
+
+	items, err = GetItems(db, Filter{ContentType: "Note", Limit: 1, Offset: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, uuids(items))
+
+	items, err = GetItems(db, Filter{Deleted: &no, Limit: 2, Offset: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c", "d"}, uuids(items))
+}
+
+func TestGetItemsTimeRange(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{
+		{UUID: "a", ContentType: "Note", CreatedAt: "2020-01-01T10:00:00.000Z", UpdatedAt: "2020-05-01T10:00:00.000Z"},
+		{UUID: "b", ContentType: "Note", CreatedAt: "2020-02-01T10:00:00.000Z", UpdatedAt: "2020-05-02T10:00:00.000Z"},
+		{UUID: "c", ContentType: "Note", CreatedAt: "2020-03-01T10:00:00.000Z", UpdatedAt: "2020-05-03T10:00:00.000Z"},
+		{UUID: "d", ContentType: "Note", CreatedAt: "invalid"},
+	}))
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "a", &stored))
+	assert.Equal(t, time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), stored.CreatedAtTime)
+	assert.Equal(t, time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC), stored.UpdatedAtTime)
+
+	uuids := func(filter Filter) (u []string) {
+		items, err := GetItems(db, filter)
+		assert.NoError(t, err)
+
+		for _, i := range items {
+			u = append(u, i.UUID)
+		}
+
+		return
+	}
+
+	feb := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, []string{"b", "c"}, uuids(Filter{CreatedSince: feb}))
+	assert.Equal(t, []string{"a", "b", "d"}, uuids(Filter{CreatedBefore: mar}))
+	assert.Equal(t, []string{"b"}, uuids(Filter{CreatedSince: feb, CreatedBefore: mar}))
+	assert.Equal(t, []string{"a", "d"}, uuids(Filter{UpdatedBefore: time.Date(2020, 5, 2, 0, 0, 0, 0, time.UTC)}))
+}
+
+func TestItemsModifiedSince(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	// nothing stored
+	var items []Item
+	items, err = ItemsModifiedSince(db, time.Time{})
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{
+		{UUID: "a", ContentType: "Note", UpdatedAt: "2020-05-03T10:00:00.000Z"},
+		{UUID: "b", ContentType: "Note", UpdatedAt: "2020-05-01T10:00:00.000Z"},
+		{UUID: "c", ContentType: "Tag", UpdatedAt: "2020-05-02T10:00:00.250Z", Deleted: true},
+		{UUID: "d", ContentType: "Note", UpdatedAt: "2020-05-02T10:00:00.500Z"},
+		{UUID: "e", ContentType: "Note", UpdatedAt: "2020-05-02T10:00:01.000Z"},
+	}))
+
+	uuids := func(items []Item) (u []string) {
+		for _, i := range items {
+			u = append(u, i.UUID)
+		}
+
+		return
+	}
+
+	// items within the same second as since are compared exactly
+	items, err = ItemsModifiedSince(db, time.Date(2020, 5, 2, 10, 0, 0, 300000000, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d", "e", "a"}, uuids(items))
+
+	items, err = ItemsModifiedSince(db, time.Date(2020, 5, 1, 0, 0, 0, 0, time.FixedZone("EST", -5*60*60)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d", "e", "a"}, uuids(items))
+}
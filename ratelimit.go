@@ -0,0 +1,54 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"time"
+)
+
+// RateLimit records when SN will next allow a sync after rate limiting the account
+// rate limits are only recognised by HTTPSyncer as gosn.Sync does not report the response status
+type RateLimit struct {
+	ID    int `storm:"id"`
+	Until time.Time
+}
+
+// there is only ever one rate limit per DB
+const rateLimitID = 1
+
+// NextSyncAllowed returns when SN will next allow a sync to the DB, or zero if it is not rate limited
+func NextSyncAllowed(db *storm.DB) (until time.Time, err error) {
+	var rl RateLimit
+
+	err = db.One("ID", rateLimitID, &rl)
+	if errors.Is(err, storm.ErrNotFound) {
+		return until, nil
+	}
+
+	return rl.Until, err
+}
+
+// checkRateLimit returns ErrRateLimited if the DB was rate limited by SN until a time that has not been reached
+func checkRateLimit(db *storm.DB) error {
+	until, err := NextSyncAllowed(db)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().Before(until) {
+		return fmt.Errorf("%w: next sync allowed at %s", ErrRateLimited, until.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// recordRateLimit saves the time a rate limited sync may be retried, if SN provided one
+func recordRateLimit(db *storm.DB, syncErr error) error {
+	wait := retryAfter(syncErr)
+	if !errors.Is(syncErr, ErrRateLimited) || wait <= 0 {
+		return nil
+	}
+
+	return db.Save(&RateLimit{ID: rateLimitID, Until: time.Now().Add(wait)})
+}
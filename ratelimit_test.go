@@ -0,0 +1,73 @@
+package snpersist
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSyncRateLimited(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	var requests int
+
+	retryAfter := "1"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		if requests == 2 {
+			_, _ = w.Write([]byte(`{"sync_token":"token-1"}`))
+			return
+		}
+
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	session := offlineSession()
+	session.Server = ts.URL
+
+	// the retry waits for the requested time
+	start := time.Now()
+	_, err = Sync(SyncInput{Session: session, DB: db, HTTPClient: ts.Client(), Retries: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+	assert.True(t, time.Since(start) >= time.Second)
+
+	// a rate limit that cannot be waited for before the context ends is recorded so later syncs do not call SN
+	retryAfter = "3600"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err = SyncWithContext(ctx, SyncInput{Session: session, DB: db, HTTPClient: ts.Client()})
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Equal(t, 3, requests)
+
+	var until time.Time
+	until, err = NextSyncAllowed(db)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), until, time.Minute)
+
+	_, err = Sync(SyncInput{Session: session, DB: db, HTTPClient: ts.Client()})
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Equal(t, 3, requests)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, time.Minute, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter("", now))
+}
@@ -0,0 +1,60 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+)
+
+// Reference records that one item, e.g. a tag, references another, e.g. a note
+// references are held outside of the encrypted content so relationships can be found without decrypting items
+// the index is maintained by SaveDecryptedItems and by syncs made with SyncInput.IndexReferences
+type Reference struct {
+	ID          string `storm:"id"` // parent and child UUIDs, so each relationship is only stored once
+	Parent      string `storm:"index"`
+	Child       string `storm:"index"`
+	ContentType string // content type of the child
+}
+
+// ReferencesFrom returns the references held by an item, e.g. the notes a tag has been applied to
+func ReferencesFrom(db *storm.DB, parent string) (refs []Reference, err error) {
+	err = db.Find("Parent", parent, &refs)
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+// ReferencesTo returns the references to an item, e.g. the tags applied to a note
+func ReferencesTo(db *storm.DB, child string) (refs []Reference, err error) {
+	err = db.Find("Child", child, &refs)
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+// newReferences converts an item's references to index entries
+func newReferences(parent string, itemRefs gosn.ItemReferences) (refs []Reference) {
+	for _, ir := range itemRefs {
+		refs = append(refs, Reference{
+			ID:          parent + "/" + ir.UUID,
+			Parent:      parent,
+			Child:       ir.UUID,
+			ContentType: ir.ContentType,
+		})
+	}
+
+	return
+}
+
+// itemReferences returns the references held by a decrypted item, or none if it is deleted
+func itemReferences(item gosn.Item) (refs []Reference) {
+	if item.IsDeleted() || item.GetContent() == nil {
+		return
+	}
+
+	return newReferences(item.GetUUID(), item.GetContent().References())
+}
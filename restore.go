@@ -0,0 +1,171 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"time"
+)
+
+// restoreSuffix is appended to a DB's path to name the file a backup is validated in before replacing it
+const restoreSuffix = ".restore"
+
+// restoreSample is the number of items in a backup decrypted to check it can be read with the session's keys
+const restoreSample = 20
+
+// Restore replaces the DB at dbPath with a backup taken by Backup, BackupFile or a BackupSchedule
+// the backup is copied and checked first, leaving the DB as it was if the backup: has a newer schema version,
+// belongs to a different account to the DB, has key params for other keys or has items the session cannot decrypt
+// the sync token is removed so the next sync retrieves every item, updating those that changed since the backup,
+// and items dirty in the backup are pushed again
+// the DB must not be open, ErrDBLocked is returned if another process holds it for longer than openTimeout,
+// or the timeout set by storm.BoltOptions amongst the options, which are used to open the DB and backup
+func Restore(backupPath, dbPath string, session gosn.Session, options ...func(*storm.Options) error) (err error) {
+	if !session.Valid() {
+		return ErrInvalidSession
+	}
+
+	tmpPath := dbPath + restoreSuffix
+
+	if err = copyBackup(backupPath, tmpPath, boltTimeout(options...)); err != nil {
+		return
+	}
+
+	defer func() {
+		_ = os.Remove(tmpPath + lockFileSuffix)
+
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	var fingerprint string
+
+	if fingerprint, err = liveAccount(dbPath, options...); err != nil {
+		return
+	}
+
+	var restored *storm.DB
+
+	if restored, err = openStored(tmpPath, options...); err != nil {
+		return
+	}
+
+	err = checkRestored(restored, fingerprint, session)
+	if err == nil {
+		if err = restored.Drop(&SyncToken{}); errors.Is(err, bolt.ErrBucketNotFound) {
+			err = nil
+		}
+	}
+
+	if cErr := restored.Close(); err == nil {
+		err = cErr
+	}
+
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, dbPath)
+}
+
+// copyBackup copies the bolt file at backupPath to path, failing if it is not a bolt file
+// another process holding the backup is waited for up to timeout
+func copyBackup(backupPath, path string, timeout time.Duration) (err error) {
+	var src *bolt.DB
+
+	if src, err = bolt.Open(backupPath, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout}); err != nil {
+		return lockedError(backupPath, err)
+	}
+
+	defer src.Close()
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	return src.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+}
+
+// openStored opens the DB at dbPath with the codec it was created with and the options
+func openStored(dbPath string, options ...func(*storm.Options) error) (db *storm.DB, err error) {
+	c, err := storedCodec(dbPath, boltTimeout(options...))
+	if err != nil {
+		return
+	}
+
+	return openWithCodec(dbPath, c, options...)
+}
+
+// liveAccount returns the account fingerprint recorded in the DB at dbPath, if it exists
+// a DB that cannot be opened, other than when held by another process, is being replaced so no account is returned
+func liveAccount(dbPath string, options ...func(*storm.Options) error) (fingerprint string, err error) {
+	if _, err = os.Stat(dbPath); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+
+		return
+	}
+
+	var db *storm.DB
+
+	if db, err = openStored(dbPath, options...); err != nil {
+		if errors.Is(err, ErrDBLocked) {
+			return
+		}
+
+		return "", nil
+	}
+
+	defer db.Close()
+
+	return GetAccount(db)
+}
+
+// checkRestored checks a copy of a backup belongs to the account fingerprint, if not empty, and a sample of its
+// items can be decrypted with the session's keys
+func checkRestored(db *storm.DB, fingerprint string, session gosn.Session) (err error) {
+	var account string
+
+	if account, err = GetAccount(db); err != nil {
+		return
+	}
+
+	if fingerprint != "" && account != "" && account != fingerprint {
+		return fmt.Errorf("%w: backup was created for another account or server", ErrAccountMismatch)
+	}
+
+	if err = CheckKeys(db, session); err != nil {
+		return
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	var sample Items
+
+	if err = db.Select().Limit(restoreSample).Find(&sample); err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	for _, i := range sample {
+		if i.Deleted {
+			continue
+		}
+
+		if _, dErr := decryptStored(i, session, keys); dErr != nil {
+			return wrapError(ErrBackupIncompatible, ItemError{UUID: i.UUID, ContentType: i.ContentType, Err: dErr})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	backupPath := tempDBPath + ".bak"
+	defer os.Remove(backupPath)
+
+	session := offlineSession()
+
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+
+	note, _ := createNote("backed up", "")
+	dItems := gosn.Items{&note}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+	assert.NoError(t, SaveItems(db, eItems))
+	assert.NoError(t, db.Save(&Account{ID: accountRecordID, Fingerprint: AccountFingerprint("me@example.com", session.Server)}))
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token-1"}))
+
+	_, err = BackupFile(db, backupPath)
+	assert.NoError(t, err)
+
+	later, _ := createNote("later", "")
+	dItems = gosn.Items{&later}
+	eItems, err = dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+	assert.NoError(t, SaveItems(db, eItems))
+	assert.NoError(t, db.Close())
+
+	// the DB cannot be replaced whilst it is held by another process, which is waited for as long as the options set
+	held, err := Open(tempDBPath)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	err = Restore(backupPath, tempDBPath, session, storm.BoltOptions(0600, &bolt.Options{Timeout: 10 * time.Millisecond}))
+	assert.True(t, errors.Is(err, ErrDBLocked))
+	assert.True(t, time.Since(start) < openTimeout/2)
+	assert.NoError(t, held.Close())
+
+	// a session that cannot decrypt the backup leaves the DB as it was
+	err = Restore(backupPath, tempDBPath, offlineSession())
+	assert.True(t, errors.Is(err, ErrBackupIncompatible))
+
+	_, err = os.Stat(tempDBPath + restoreSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, Restore(backupPath, tempDBPath, session))
+
+	db, err = Open(tempDBPath)
+	assert.NoError(t, err)
+
+	defer db.Close()
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 1)
+	assert.Equal(t, note.UUID, all[0].UUID)
+
+	// the next sync retrieves every item
+	st, err := getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Empty(t, st.SyncToken)
+}
+
+func TestRestoreRejectsBackup(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	backupPath := tempDBPath + ".bak"
+	defer os.Remove(backupPath)
+
+	session := offlineSession()
+
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Save(&Account{ID: accountRecordID, Fingerprint: AccountFingerprint("other@example.com", session.Server)}))
+
+	_, err = BackupFile(db, backupPath)
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Save(&Account{ID: accountRecordID, Fingerprint: AccountFingerprint("me@example.com", session.Server)}))
+	assert.NoError(t, db.Close())
+
+	err = Restore(backupPath, tempDBPath, session)
+	assert.True(t, errors.Is(err, ErrAccountMismatch))
+
+	// a backup written by a newer version of this package
+	db, err = Open(tempDBPath)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Save(&Meta{ID: metaID, SchemaVersion: SchemaVersion + 1}))
+
+	_, err = BackupFile(db, backupPath)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Save(&Meta{ID: metaID, SchemaVersion: SchemaVersion}))
+	assert.NoError(t, db.Close())
+
+	err = Restore(backupPath, tempDBPath, session)
+	assert.True(t, errors.Is(err, ErrSchemaTooNew))
+
+	db, err = Open(tempDBPath)
+	assert.NoError(t, err)
+
+	defer db.Close()
+
+	fingerprint, err := GetAccount(db)
+	assert.NoError(t, err)
+	assert.Equal(t, AccountFingerprint("me@example.com", session.Server), fingerprint)
+}
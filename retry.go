@@ -0,0 +1,143 @@
+package snpersist
+
+import (
+	"context"
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// messages of errors returned by gosn that are likely to succeed if retried
+// gosn returns an empty body for 5xx responses so these surface as JSON errors
+var retryableErrors = []string{
+	"timeout",
+	"connection reset",
+	"connection refused",
+	"failed to connect",
+	"unexpected eof",
+	"unexpected end of json input",
+}
+
+// IsRetryable reports whether an error returned by gosn.Sync is a transient network
+// or server failure, as opposed to an authentication or validation error
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, re := range retryableErrors {
+		if strings.Contains(msg, re) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryAfter returns the wait requested by SN with the error, if any
+func retryAfter(err error) time.Duration {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.RetryAfter
+	}
+
+	return 0
+}
+
+// retryDelay returns the wait before the retry following the given attempt
+func retryDelay(si SyncInput, attempt int) (delay time.Duration) {
+	delay = si.RetryBackoff << uint(attempt)
+
+	// guard against the shift overflowing as well as the configured limit
+	if si.RetryMaxBackoff > 0 && (delay > si.RetryMaxBackoff || delay < si.RetryBackoff) {
+		delay = si.RetryMaxBackoff
+	}
+
+	if si.RetryJitter > 0 && delay > 0 {
+		jitter := si.RetryJitter
+		if jitter > 1 {
+			jitter = 1
+		}
+
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+
+	return
+}
+
+// syncWithRetry calls the input's Syncer as callWithRetry, refreshing the input's session and calling again
+// once if SN rejects it, see SyncInput.RefreshSession
+func syncWithRetry(ctx context.Context, si *SyncInput, gSI gosn.SyncInput) (gSO gosn.SyncOutput, err error) {
+	gSO, err = callWithRetry(ctx, *si, gSI)
+	if !IsAuthError(err) {
+		return
+	}
+
+	if err = si.renewSession(err); err != nil {
+		return
+	}
+
+	gSI.Session = si.Session
+
+	return callWithRetry(ctx, *si, gSI)
+}
+
+// callWithRetry calls the input's Syncer, retrying transient failures up to si.Retries times
+// the wait between attempts starts at si.RetryBackoff and doubles with each retry, up to si.RetryMaxBackoff
+// a rate limited response is retried once after the wait SN requested even if si.Retries is 0, unless ctx
+// would end first, in which case the rate limit is returned so it can be recorded
+func callWithRetry(ctx context.Context, si SyncInput, gSI gosn.SyncInput) (gSO gosn.SyncOutput, err error) {
+	ctx, endSpan := si.startSpan(ctx, "remote-sync")
+	defer func() {
+		endSpan(err)
+	}()
+
+	for attempt := 0; ; attempt++ {
+		gSO, err = si.syncer().Sync(gSI)
+		if err == nil || !IsRetryable(err) {
+			return
+		}
+
+		wait := retryAfter(err)
+		rateLimited := errors.Is(err, ErrRateLimited) && wait > 0
+
+		if attempt >= si.Retries && !(rateLimited && attempt == 0) {
+			return
+		}
+
+		delay := retryDelay(si, attempt)
+
+		// honour the wait requested by a rate limited response
+		if wait > delay {
+			delay = wait
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && rateLimited && time.Now().Add(delay).After(deadline) {
+			return
+		}
+
+		si.warnf("snpersist | Sync | retrying in %s: %v", delay, err)
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(delay):
+		}
+	}
+}
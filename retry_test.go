@@ -0,0 +1,79 @@
+package snpersist
+
+import (
+	"context"
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	assert.False(t, IsRetryable(nil))
+	assert.False(t, IsRetryable(errors.New("session is invalid")))
+	assert.False(t, IsRetryable(errors.New("auth hash does not match. possible tampering or server issue")))
+	assert.True(t, IsRetryable(errors.New("failed to connect to https://sync.standardnotes.org/items/sync within 10 seconds")))
+	assert.True(t, IsRetryable(errors.New("unexpected end of JSON input")))
+	assert.True(t, IsRetryable(&net.OpError{Op: "dial", Err: errors.New("no route to host")}))
+}
+
+func TestRetryDelay(t *testing.T) {
+	si := SyncInput{RetryBackoff: time.Second}
+	assert.Equal(t, time.Second, retryDelay(si, 0))
+	assert.Equal(t, 4*time.Second, retryDelay(si, 2))
+
+	si.RetryMaxBackoff = 3 * time.Second
+	assert.Equal(t, 3*time.Second, retryDelay(si, 2))
+	assert.Equal(t, 3*time.Second, retryDelay(si, 100))
+
+	si.RetryJitter = 0.5
+	for x := 0; x < 10; x++ {
+		d := retryDelay(si, 2)
+		assert.True(t, d > 1500*time.Millisecond && d <= 3*time.Second)
+	}
+}
+
+func TestCallWithRetryRateLimited(t *testing.T) {
+	limited := &HTTPError{StatusCode: http.StatusTooManyRequests, RetryAfter: 50 * time.Millisecond}
+
+	// the requested wait is honoured even though retries are disabled
+	fs := &fakeSyncer{errs: []error{limited}, outputs: []gosn.SyncOutput{{}, {SyncToken: "token-1"}}}
+
+	start := time.Now()
+	gSO, err := callWithRetry(context.Background(), SyncInput{Syncer: fs}, gosn.SyncInput{})
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", gSO.SyncToken)
+	assert.Len(t, fs.inputs, 2)
+	assert.True(t, time.Since(start) >= limited.RetryAfter)
+
+	// but only once
+	fs = &fakeSyncer{errs: []error{limited, limited}}
+
+	_, err = callWithRetry(context.Background(), SyncInput{Syncer: fs}, gosn.SyncInput{})
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Len(t, fs.inputs, 2)
+
+	// a wait beyond the context's deadline is not started
+	fs = &fakeSyncer{errs: []error{&HTTPError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, err = callWithRetry(ctx, SyncInput{Syncer: fs, Retries: 3}, gosn.SyncInput{})
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Len(t, fs.inputs, 1)
+}
+
+func TestCallWithRetryCancelled(t *testing.T) {
+	fs := &fakeSyncer{errs: []error{errors.New("connection reset by peer")}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := callWithRetry(ctx, SyncInput{Syncer: fs, Retries: 1, RetryBackoff: time.Hour}, gosn.SyncInput{})
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, fs.inputs, 1)
+}
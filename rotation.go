@@ -0,0 +1,125 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupSchedule keeps rotating snapshots of a DB, taken with BackupFile, in a directory
+// a snapshot is taken for each hour and each day it is run in, and the oldest beyond those kept are removed
+type BackupSchedule struct {
+	Dir    string // created, with permissions 0700, if it does not exist
+	Hourly int    // hourly snapshots kept, none are taken if zero
+	Daily  int    // daily snapshots kept, none are taken if zero
+}
+
+// snapshot kinds, the prefix of their file names, and the layout of the time each covers
+var snapshotKinds = []struct {
+	prefix, layout string
+}{
+	{"hourly-", "20060102T15"},
+	{"daily-", "20060102"},
+}
+
+// snapshotSuffix is the extension of snapshot files
+const snapshotSuffix = ".db"
+
+// Run takes any snapshots not yet taken for the hour and day of now, in UTC, and prunes the oldest,
+// returning the paths of the snapshots taken
+func (s BackupSchedule) Run(db *storm.DB, now time.Time) (taken []string, err error) {
+	if err = os.MkdirAll(s.Dir, 0700); err != nil {
+		return
+	}
+
+	now = now.UTC()
+
+	for x, keep := range []int{s.Hourly, s.Daily} {
+		if keep <= 0 {
+			continue
+		}
+
+		kind := snapshotKinds[x]
+		path := filepath.Join(s.Dir, kind.prefix+now.Format(kind.layout)+snapshotSuffix)
+
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			if _, err = BackupFile(db, path); err != nil {
+				return
+			}
+
+			taken = append(taken, path)
+		} else if err != nil {
+			return
+		}
+
+		if err = s.prune(kind.prefix, keep); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Snapshots returns the paths of the snapshots in the directory, oldest first within each kind
+func (s BackupSchedule) Snapshots() (paths []string, err error) {
+	for _, kind := range snapshotKinds {
+		var names []string
+
+		if names, err = s.snapshots(kind.prefix); err != nil {
+			return
+		}
+
+		for _, n := range names {
+			paths = append(paths, filepath.Join(s.Dir, n))
+		}
+	}
+
+	return
+}
+
+// snapshots returns the names of the snapshots with the given prefix, oldest first
+func (s BackupSchedule) snapshots(prefix string) (names []string, err error) {
+	var files []os.FileInfo
+
+	if files, err = ioutil.ReadDir(s.Dir); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+
+		return
+	}
+
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), prefix) && strings.HasSuffix(f.Name(), snapshotSuffix) {
+			names = append(names, f.Name())
+		}
+	}
+
+	// the times in the names sort chronologically
+	sort.Strings(names)
+
+	return
+}
+
+// prune removes the oldest snapshots with the given prefix so no more than keep remain
+func (s BackupSchedule) prune(prefix string, keep int) (err error) {
+	var names []string
+
+	if names, err = s.snapshots(prefix); err != nil {
+		return
+	}
+
+	for len(names) > keep {
+		if err = os.Remove(filepath.Join(s.Dir, names[0])); err != nil {
+			return
+		}
+
+		names = names[1:]
+	}
+
+	return
+}
@@ -0,0 +1,87 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupScheduleRun(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	dir, err := ioutil.TempDir("", "snpersist-rotation")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+
+	defer db.Close()
+
+	s := BackupSchedule{Dir: filepath.Join(dir, "snapshots"), Hourly: 2, Daily: 1}
+	start := time.Date(2020, 1, 1, 22, 30, 0, 0, time.UTC)
+
+	taken, err := s.Run(db, start)
+	assert.NoError(t, err)
+	assert.Len(t, taken, 2)
+
+	// nothing is due within the same hour
+	taken, err = s.Run(db, start.Add(10*time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, taken)
+
+	taken, err = s.Run(db, start.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, taken, 1)
+
+	// the next day the oldest hourly and daily snapshots are pruned
+	taken, err = s.Run(db, start.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, taken, 2)
+
+	snapshots, err := s.Snapshots()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(s.Dir, "hourly-20200101T23.db"),
+		filepath.Join(s.Dir, "hourly-20200102T00.db"),
+		filepath.Join(s.Dir, "daily-20200102.db"),
+	}, snapshots)
+
+	// snapshots are usable DBs
+	snapshot, err := storm.Open(snapshots[0])
+	assert.NoError(t, err)
+	assert.NoError(t, snapshot.Close())
+}
+
+func TestSyncRunnerBackups(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	dir, err := ioutil.TempDir("", "snpersist-rotation")
+	assert.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token-1"}}}
+
+	r, err := NewSyncRunner(SyncInput{
+		Session: offlineSession(),
+		DBPath:  tempDBPath,
+		Syncer:  fs,
+		Backups: &BackupSchedule{Dir: dir, Daily: 1},
+	}, time.Hour)
+	assert.NoError(t, err)
+
+	_, err = r.Sync()
+	assert.NoError(t, err)
+	assert.NoError(t, r.Stop())
+
+	snapshots, err := (&BackupSchedule{Dir: dir}).Snapshots()
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+}
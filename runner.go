@@ -0,0 +1,257 @@
+package snpersist
+
+import (
+	"context"
+	"github.com/asdine/storm/v3"
+	"sync"
+	"time"
+)
+
+// number of events buffered for each subscriber to a SyncRunner
+const eventBuffer = 100
+
+// SyncRunner owns a DB and session and keeps them in sync with SN in the background
+// syncs run every interval and whenever Trigger is called, one at a time
+type SyncRunner struct {
+	input    SyncInput
+	interval time.Duration
+	ownsDB   bool
+
+	// the input the owned DB was opened with, used to reopen it after compaction
+	opened SyncInput
+
+	// held whilst a sync is in progress
+	syncMu sync.Mutex
+	// held whilst the owned DB is replaced, so DB can be called during a sync
+	dbMu sync.RWMutex
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	trigger chan struct{}
+	done    chan struct{}
+
+	startOnce, stopOnce sync.Once
+
+	lastMu     sync.Mutex
+	lastOutput SyncOutput
+	lastErr    error
+	lastTime   time.Time
+}
+
+// NewSyncRunner returns a runner that syncs the input every interval once started
+// if the input has a DBPath then the DB is opened now, owned by the runner and closed by Stop
+func NewSyncRunner(si SyncInput, interval time.Duration) (r *SyncRunner, err error) {
+	if !si.Session.Valid() {
+		return nil, ErrInvalidSession
+	}
+
+	if si.DB != nil && si.DBPath != "" || si.Store != nil && (si.DB != nil || si.DBPath != "") {
+		return nil, ErrConflictingDBArgs
+	}
+
+	if si.Store == nil && si.DB == nil && si.DBPath == "" {
+		return nil, ErrNoDB
+	}
+
+	r = &SyncRunner{
+		interval: interval,
+		trigger:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	if si.DBPath != "" {
+		var db *storm.DB
+
+		db, err = si.openDB()
+		if err != nil {
+			return nil, err
+		}
+
+		r.opened = si
+		si.DB = db
+		si.DBPath = ""
+		r.ownsDB = true
+	}
+
+	if si.Events == nil {
+		si.Events = NewEvents()
+	}
+
+	r.input = si
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	return r, nil
+}
+
+// DB returns the runner's DB, or nil if it was created with a Store or the runner's DB could not be reopened
+// a DB owned by the runner is closed and replaced when it is compacted so should not be retained
+func (r *SyncRunner) DB() *storm.DB {
+	r.dbMu.RLock()
+	defer r.dbMu.RUnlock()
+
+	return r.input.DB
+}
+
+// Start begins syncing in the background, starting with an immediate sync
+func (r *SyncRunner) Start() {
+	r.startOnce.Do(func() {
+		r.Trigger()
+
+		go r.run()
+	})
+}
+
+// run syncs on each tick of the interval and each trigger until the runner is stopped
+func (r *SyncRunner) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+
+		_, _ = r.Sync()
+	}
+}
+
+// Subscribe returns a channel receiving the events published by the runner's syncs
+// and a function that cancels the subscription
+func (r *SyncRunner) Subscribe() (<-chan Event, func()) {
+	return r.input.Events.Subscribe(eventBuffer)
+}
+
+// Trigger requests a sync as soon as possible without waiting for it to complete
+// requests made whilst a sync is pending are combined
+func (r *SyncRunner) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Sync runs a sync immediately, waiting for any sync already in progress to finish first
+func (r *SyncRunner) Sync() (so SyncOutput, err error) {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	// the owned DB is lost if it could not be reopened after compaction
+	if r.ownsDB && r.input.DB == nil {
+		return so, ErrClosed
+	}
+
+	so, err = SyncWithContext(r.ctx, r.input)
+
+	// a refreshed session is kept for later syncs so they do not refresh it again
+	if so.Session.Valid() {
+		r.input.Session = so.Session
+	}
+
+	if err != nil {
+		r.input.errorf("snpersist | SyncRunner | sync failed: %v", err)
+	} else {
+		if cErr := r.compact(); cErr != nil {
+			r.input.errorf("snpersist | SyncRunner | compaction failed: %v", cErr)
+		}
+
+		if bErr := r.backup(); bErr != nil {
+			r.input.errorf("snpersist | SyncRunner | backup failed: %v", bErr)
+		}
+	}
+
+	r.lastMu.Lock()
+	r.lastOutput, r.lastErr, r.lastTime = so, err, time.Now()
+	r.lastMu.Unlock()
+
+	return
+}
+
+// compact compacts the DB owned by the runner once the proportion of it that is free exceeds the input's
+// CompactThreshold, the DB is closed to be compacted and then reopened
+// if it cannot be reopened the runner is stopped as there is nothing left to sync
+// it must be called with syncMu held
+func (r *SyncRunner) compact() (err error) {
+	threshold := r.input.CompactThreshold
+	if !r.ownsDB || threshold <= 0 {
+		return
+	}
+
+	var ratio float64
+
+	if ratio, err = FreeRatio(r.input.DB); err != nil || ratio <= threshold {
+		return
+	}
+
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+
+	if err = r.input.DB.Close(); err != nil {
+		return
+	}
+
+	_, cErr := Compact(r.opened.dbPath(), r.opened.DBOptions...)
+
+	// the DB is reopened whether or not it was compacted
+	var db *storm.DB
+
+	if db, err = r.opened.openDB(); err != nil {
+		r.input.DB = nil
+		r.cancel()
+
+		return
+	}
+
+	r.input.DB = db
+
+	return cErr
+}
+
+// backup takes the snapshots of the input's Backups schedule that are due
+func (r *SyncRunner) backup() (err error) {
+	if r.input.Backups == nil || r.input.DB == nil {
+		return
+	}
+
+	_, err = r.input.Backups.Run(r.input.DB, time.Now())
+
+	return
+}
+
+// Last returns the output and error of the most recent sync and when it finished
+// the time is zero if there has not yet been a sync
+func (r *SyncRunner) Last() (so SyncOutput, finished time.Time, err error) {
+	r.lastMu.Lock()
+	defer r.lastMu.Unlock()
+
+	return r.lastOutput, r.lastTime, r.lastErr
+}
+
+// Stop cancels any sync in progress, waits for the background loop to exit and, if the runner opened it,
+// closes the DB
+func (r *SyncRunner) Stop() (err error) {
+	r.stopOnce.Do(func() {
+		r.cancel()
+
+		// prevent a later Start from launching the loop
+		r.startOnce.Do(func() {
+			close(r.done)
+		})
+
+		<-r.done
+
+		// wait for a sync started with Sync to return
+		r.syncMu.Lock()
+		defer r.syncMu.Unlock()
+
+		if r.ownsDB && r.input.DB != nil {
+			err = r.input.DB.Close()
+		}
+	})
+
+	return
+}
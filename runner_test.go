@@ -0,0 +1,112 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSyncRunner(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	calls := make(chan gosn.SyncInput, 10)
+
+	si := SyncInput{
+		Session: offlineSession(),
+		DBPath:  tempDBPath,
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			calls <- input
+			return gosn.SyncOutput{SyncToken: "token"}, nil
+		}),
+	}
+
+	r, err := NewSyncRunner(si, time.Hour)
+	assert.NoError(t, err)
+	assert.NotNil(t, r.DB())
+
+	_, finished, _ := r.Last()
+	assert.Zero(t, finished)
+
+	// starting syncs immediately
+	r.Start()
+	r.Start()
+
+	select {
+	case <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runner did not sync when started")
+	}
+
+	r.Trigger()
+
+	select {
+	case input := <-calls:
+		assert.Equal(t, "token", input.SyncToken)
+	case <-time.After(5 * time.Second):
+		t.Fatal("runner did not sync when triggered")
+	}
+
+	so, err := r.Sync()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", so.Stats.SyncTokenOut)
+
+	_, finished, err = r.Last()
+	assert.NoError(t, err)
+	assert.NotZero(t, finished)
+
+	assert.NoError(t, r.Stop())
+	assert.NoError(t, r.Stop())
+
+	// the runner closed the DB it opened
+	_, err = r.DB().Count(&Item{})
+	assert.Error(t, err)
+}
+
+func TestSyncRunnerStopBeforeStart(t *testing.T) {
+	r, err := NewSyncRunner(SyncInput{Session: offlineSession(), Store: NewMemoryStore()}, time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Stop())
+
+	// starting a stopped runner does nothing
+	r.Start()
+
+	_, err = NewSyncRunner(SyncInput{Session: offlineSession()}, time.Hour)
+	assert.Equal(t, ErrNoDB, err)
+}
+
+func TestSyncRunnerKeepsRefreshedSession(t *testing.T) {
+	var refreshes int
+
+	si := SyncInput{
+		Session: offlineSession(),
+		Store:   NewMemoryStore(),
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			if input.Session.Token != "refreshed" {
+				return gosn.SyncOutput{}, &HTTPError{StatusCode: http.StatusUnauthorized, Status: "401 Unauthorized"}
+			}
+
+			return gosn.SyncOutput{SyncToken: "token"}, nil
+		}),
+		RefreshSession: func(s gosn.Session) (gosn.Session, error) {
+			refreshes++
+			s.Token = "refreshed"
+
+			return s, nil
+		},
+	}
+
+	r, err := NewSyncRunner(si, time.Hour)
+	assert.NoError(t, err)
+	defer r.Stop()
+
+	for x := 0; x < 2; x++ {
+		so, err := r.Sync()
+		assert.NoError(t, err)
+		assert.Equal(t, "refreshed", so.Session.Token)
+	}
+
+	// the second sync uses the session refreshed by the first
+	assert.Equal(t, 1, refreshes)
+}
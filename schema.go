@@ -0,0 +1,106 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+)
+
+// Meta records information about the DB itself
+type Meta struct {
+	ID            int `storm:"id"`
+	SchemaVersion int
+}
+
+// there is only ever one meta record per DB
+const metaID = 1
+
+// migrations upgrade the DB layout, the function at index n upgrading a version n DB to version n+1
+var migrations = []func(db *storm.DB) error{
+	// version 0 DBs predate the meta record so re-save items to populate any new indexes
+	resaveItems,
+	// version 1 DBs lack the parsed and indexed timestamps
+	resaveItems,
+}
+
+// SchemaVersion is the version of the DB layout expected by this package
+// it must be incremented whenever a migration is added
+const SchemaVersion = 2
+
+// migrate brings the DB up to the current schema version
+// DBs without a meta record are new, if empty, or were created before versioning was introduced
+func migrate(db *storm.DB) (err error) {
+	var meta Meta
+
+	err = db.One("ID", metaID, &meta)
+
+	switch {
+	case errors.Is(err, storm.ErrNotFound):
+		var count int
+
+		count, err = db.Count(&Item{})
+		if err != nil {
+			return
+		}
+
+		if count == 0 {
+			return db.Save(&Meta{ID: metaID, SchemaVersion: SchemaVersion})
+		}
+
+		meta = Meta{ID: metaID}
+	case err != nil:
+		return
+	}
+
+	if meta.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("%w: DB is version %d but %d is supported", ErrSchemaTooNew, meta.SchemaVersion, SchemaVersion)
+	}
+
+	for v := meta.SchemaVersion; v < SchemaVersion; v++ {
+		if err = migrations[v](db); err != nil {
+			return fmt.Errorf("failed to migrate DB from schema version %d: %v", v, err)
+		}
+
+		meta.SchemaVersion = v + 1
+		if err = db.Save(&meta); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// resaveItems saves every item again, with its derived fields, so storm indexes any newly tagged fields
+func resaveItems(db *storm.DB) (err error) {
+	var all []Item
+
+	err = db.All(&all)
+	if err != nil {
+		return
+	}
+
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for x := range all {
+		all[x].derive()
+
+		if err = tx.Save(&all[x]); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+
+	return
+}
@@ -0,0 +1,42 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	assert.Len(t, migrations, SchemaVersion)
+
+	defer removeDB(tempDBPath)
+
+	// a DB with items but no meta record predates versioning
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", UpdatedAt: "2020-05-01T10:00:00.000Z"}))
+	assert.NoError(t, db.Close())
+
+	db, err = Open(tempDBPath)
+	assert.NoError(t, err)
+
+	var meta Meta
+	assert.NoError(t, db.One("ID", metaID, &meta))
+	assert.Equal(t, SchemaVersion, meta.SchemaVersion)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "a", &stored))
+	assert.Equal(t, 2020, stored.UpdatedAtTime.Year())
+
+	// the parsed timestamps are indexed
+	assert.NoError(t, db.One("UpdatedAtTime", stored.UpdatedAtTime, &stored))
+
+	// a DB from a newer version cannot be opened
+	meta.SchemaVersion = SchemaVersion + 1
+	assert.NoError(t, db.Save(&meta))
+	assert.NoError(t, db.Close())
+
+	_, err = Open(tempDBPath)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "newer than the supported version")
+}
@@ -0,0 +1,212 @@
+package snpersist
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	bolt "go.etcd.io/bbolt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// searchPosting records the number of times a term occurs in an item
+type searchPosting struct {
+	ID    string `storm:"id"` // term and UUID
+	Term  string `storm:"index"`
+	UUID  string `storm:"index"`
+	Count int
+}
+
+// searchDoc records the number of terms indexed for an item
+type searchDoc struct {
+	UUID   string `storm:"id"`
+	Length int
+}
+
+// SearchResult is a note matching a search, with higher scores being more relevant
+type SearchResult struct {
+	UUID  string
+	Score float64
+}
+
+// hashedTermPrefix marks terms stored as keyed hashes, it cannot occur in a plain term
+const hashedTermPrefix = "#"
+
+// tokenise splits text into lower case words
+func tokenise(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// hashTerm returns a term keyed with the session's authentication key so it cannot be read from the index
+func hashTerm(session gosn.Session, term string) string {
+	mac := hmac.New(sha256.New, []byte(session.Ak))
+	_, _ = mac.Write([]byte(term))
+
+	return hashedTermPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// searchTerms returns the frequency of each term in text, hashed if encrypt is set
+func searchTerms(session gosn.Session, encrypt bool, text string) map[string]int {
+	terms := map[string]int{}
+
+	for _, t := range tokenise(text) {
+		if encrypt {
+			t = hashTerm(session, t)
+		}
+
+		terms[t]++
+	}
+
+	return terms
+}
+
+// Search returns the notes containing every word of the query, most relevant first
+// the index is maintained by syncs made with SyncInput.IndexSearch or can be built with RebuildSearchIndex
+func Search(db *storm.DB, session gosn.Session, query string) (results []SearchResult, err error) {
+	words := uniqueStrings(tokenise(query))
+	if len(words) == 0 {
+		return
+	}
+
+	var docs int
+
+	docs, err = db.Count(&searchDoc{})
+	if err != nil {
+		return
+	}
+
+	scores := map[string]float64{}
+	matched := map[string]int{}
+
+	for x, w := range words {
+		var postings []searchPosting
+
+		// the index may hold plain or hashed terms depending on how it was built
+		for _, term := range []string{w, hashTerm(session, w)} {
+			var found []searchPosting
+
+			err = db.Find("Term", term, &found)
+			if err != nil && !errors.Is(err, storm.ErrNotFound) {
+				return
+			}
+
+			postings = append(postings, found...)
+		}
+
+		err = nil
+
+		idf := math.Log(1 + float64(docs)/float64(len(postings)+1))
+
+		for _, p := range postings {
+			// only notes matching every previous word can match the query
+			if matched[p.UUID] != x {
+				continue
+			}
+
+			var doc searchDoc
+			if err = db.One("UUID", p.UUID, &doc); err != nil {
+				return
+			}
+
+			matched[p.UUID]++
+			scores[p.UUID] += float64(p.Count) / float64(doc.Length) * idf
+		}
+	}
+
+	for uuid, score := range scores {
+		if matched[uuid] == len(words) {
+			results = append(results, SearchResult{UUID: uuid, Score: score})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].UUID < results[j].UUID
+		}
+
+		return results[i].Score > results[j].Score
+	})
+
+	return
+}
+
+// RebuildSearchIndex replaces the search index with one built from every note in the DB
+func RebuildSearchIndex(db *storm.DB, session gosn.Session, encrypt bool) (err error) {
+	var persisted Items
+
+	err = db.Find("ContentType", "Note", &persisted)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	var live Items
+
+	for _, p := range persisted {
+		if !p.Deleted {
+			live = append(live, p)
+		}
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	var items gosn.Items
+
+	items, err = live.ToItems(session, keys...)
+	if err != nil {
+		return
+	}
+
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, data := range []interface{}{&searchPosting{}, &searchDoc{}} {
+		if err = tx.Drop(data); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return
+		}
+	}
+
+	st := stormTx{node: tx}
+
+	for _, n := range items.Notes() {
+		if err = st.SetSearchTerms(n.UUID, searchTerms(session, encrypt, n.Content.Title+" "+n.Content.Text)); err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// uniqueStrings returns the distinct strings in the order they first appear
+func uniqueStrings(in []string) (out []string) {
+	seen := map[string]bool{}
+
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+
+	return
+}
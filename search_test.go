@@ -0,0 +1,170 @@
+package snpersist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	shopping, _ := createNote("Shopping", "apples, bread and more apples")
+	recipe, _ := createNote("Apple pie", "apples, flour, butter and a long list of other ingredients to bake")
+	meeting, _ := createNote("Meeting", "agenda for the week")
+	tag := createTag("apples", "")
+	dItems := gosn.Items{&shopping, &recipe, &meeting, tag}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	for _, encrypt := range []bool{false, true} {
+		si := SyncInput{Session: session, IndexSearch: true, EncryptSearchIndex: encrypt}
+		_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, si, nil, gosn.SyncOutput{Items: eItems, SyncToken: "token"})
+		assert.NoError(t, err)
+
+		var postings []searchPosting
+		assert.NoError(t, db.All(&postings))
+		assert.NotEmpty(t, postings)
+
+		for _, p := range postings {
+			assert.Equal(t, encrypt, strings.HasPrefix(p.Term, hashedTermPrefix))
+		}
+
+		// the note mentioning apples most often ranks first and tags are not indexed
+		var results []SearchResult
+		results, err = Search(db, session, "Apples")
+		assert.NoError(t, err)
+		assert.Len(t, results, 2)
+		assert.Equal(t, shopping.UUID, results[0].UUID)
+		assert.Equal(t, recipe.UUID, results[1].UUID)
+
+		// every word must match
+		results, err = Search(db, session, "apples flour")
+		assert.NoError(t, err)
+		assert.Len(t, results, 1)
+		assert.Equal(t, recipe.UUID, results[0].UUID)
+
+		results, err = Search(db, session, "missing")
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+	}
+
+	// a deleted note is removed from the index
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{Session: session, IndexSearch: true}, nil,
+		gosn.SyncOutput{Items: gosn.EncryptedItems{{UUID: shopping.UUID, ContentType: "Note", Deleted: true}}, SyncToken: "token"})
+	assert.NoError(t, err)
+
+	var results []SearchResult
+	results, err = Search(db, session, "apples")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, recipe.UUID, results[0].UUID)
+}
+
+func TestRebuildSearchIndex(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	note, err := CreateNote(db, session, "Holiday", "beach and sunshine")
+	assert.NoError(t, err)
+
+	var results []SearchResult
+	results, err = Search(db, session, "beach")
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	assert.NoError(t, RebuildSearchIndex(db, session, true))
+
+	results, err = Search(db, session, "BEACH")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, note.UUID, results[0].UUID)
+}
+
+func TestSavesUpdateIndexes(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	holiday, err := CreateNote(db, session, "Holiday", "beach and sunshine")
+	assert.NoError(t, err)
+	assert.NoError(t, RebuildSearchIndex(db, session, true))
+	assert.NoError(t, db.Save(&TitleEntry{UUID: holiday.UUID, ContentType: "Note", Title: "Holiday"}))
+
+	// imported items are added to the indexes the DB has, in the same form
+	trip, _ := createNote("Trip", "mountains and lakes")
+	dItems := gosn.Items{&trip}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, json.NewEncoder(&buf).Encode(snBackup{Items: eItems}))
+
+	_, err = ImportSNBackup(db, &buf, session)
+	assert.NoError(t, err)
+
+	results, err := Search(db, session, "mountains")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, trip.UUID, results[0].UUID)
+
+	var postings []searchPosting
+	assert.NoError(t, db.All(&postings))
+
+	for _, p := range postings {
+		assert.True(t, strings.HasPrefix(p.Term, hashedTermPrefix))
+	}
+
+	entries, err := SearchTitles(db, "trip")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// as are decrypted items saved directly
+	holiday.Content.Text = "beach and rain"
+	assert.NoError(t, SaveDecryptedItems(db, session, gosn.Items{&holiday}))
+
+	results, err = Search(db, session, "rain")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	results, err = Search(db, session, "sunshine")
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	// encrypted items saved directly cannot be decrypted so their entries are removed
+	holiday.Content.Text = "beach and snow"
+	dItems = gosn.Items{&holiday}
+	eItems, err = dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+	assert.NoError(t, SaveItems(db, eItems))
+
+	results, err = Search(db, session, "beach")
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	entries, err = SearchTitles(db, "holiday")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// the other items' entries are kept
+	entries, err = SearchTitles(db, "")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
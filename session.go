@@ -0,0 +1,251 @@
+package snpersist
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// StoredSession is a session saved in the DB, encrypted with a key derived from a passphrase
+type StoredSession struct {
+	ID         int `storm:"id"`
+	Salt       []byte
+	Iterations int
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// there is only ever one session per DB
+const sessionID = 1
+
+// number of PBKDF2 iterations used to derive the key protecting a saved session
+const sessionKeyIterations = 110000
+
+// sessionContent is the plaintext of a saved session
+type sessionContent struct {
+	Email   string       `json:"email"`
+	Session gosn.Session `json:"session"`
+}
+
+// sessionKey derives the AES-256 key protecting a saved session from its passphrase
+func sessionKey(passphrase string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha512.New)
+}
+
+// SaveSession stores the session, and the email of its account, in the DB encrypted with the passphrase
+// replacing any session already saved
+func SaveSession(db *storm.DB, email string, session gosn.Session, passphrase string) (err error) {
+	var plaintext []byte
+
+	if plaintext, err = json.Marshal(sessionContent{Email: email, Session: session}); err != nil {
+		return
+	}
+
+	stored := StoredSession{
+		ID:         sessionID,
+		Salt:       make([]byte, 16),
+		Iterations: sessionKeyIterations,
+	}
+
+	if _, err = rand.Read(stored.Salt); err != nil {
+		return
+	}
+
+	var gcm cipher.AEAD
+
+	if gcm, err = newSessionCipher(sessionKey(passphrase, stored.Salt, stored.Iterations)); err != nil {
+		return
+	}
+
+	stored.Nonce = make([]byte, gcm.NonceSize())
+
+	if _, err = rand.Read(stored.Nonce); err != nil {
+		return
+	}
+
+	stored.Ciphertext = gcm.Seal(nil, stored.Nonce, plaintext, nil)
+
+	return db.Save(&stored)
+}
+
+// LoadSession returns the session, and the email of its account, saved in the DB
+// ErrSessionNotFound is returned if none is saved and ErrInvalidPassphrase if the passphrase is not the one it was saved with
+func LoadSession(db *storm.DB, passphrase string) (email string, session gosn.Session, err error) {
+	var stored StoredSession
+
+	if err = db.One("ID", sessionID, &stored); err != nil {
+		if errors.Is(err, storm.ErrNotFound) {
+			err = ErrSessionNotFound
+		}
+
+		return
+	}
+
+	var gcm cipher.AEAD
+
+	if gcm, err = newSessionCipher(sessionKey(passphrase, stored.Salt, stored.Iterations)); err != nil {
+		return
+	}
+
+	var plaintext []byte
+
+	if plaintext, err = gcm.Open(nil, stored.Nonce, stored.Ciphertext, nil); err != nil {
+		err = ErrInvalidPassphrase
+		return
+	}
+
+	var content sessionContent
+
+	if err = json.Unmarshal(plaintext, &content); err != nil {
+		return
+	}
+
+	return content.Email, content.Session, nil
+}
+
+// RemoveSession deletes the session saved in the DB, if there is one
+func RemoveSession(db *storm.DB) (err error) {
+	err = db.DeleteStruct(&StoredSession{ID: sessionID})
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+// newSessionCipher returns the AES-GCM cipher protecting a saved session
+func newSessionCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// SessionStore saves and loads a session, and the email of its account, between runs of an application
+type SessionStore interface {
+	SaveSession(email string, session gosn.Session) error
+	// LoadSession returns ErrSessionNotFound if no session is saved
+	LoadSession() (email string, session gosn.Session, err error)
+	RemoveSession() error
+}
+
+// DBSessionStore saves the session in a DB, encrypted with a passphrase, see SaveSession
+type DBSessionStore struct {
+	DB         *storm.DB
+	Passphrase string
+}
+
+func (s DBSessionStore) SaveSession(email string, session gosn.Session) error {
+	return SaveSession(s.DB, email, session, s.Passphrase)
+}
+
+func (s DBSessionStore) LoadSession() (string, gosn.Session, error) {
+	return LoadSession(s.DB, s.Passphrase)
+}
+
+func (s DBSessionStore) RemoveSession() error {
+	return RemoveSession(s.DB)
+}
+
+// default keyring service name sessions are saved under
+const keyringService = "sn-persist"
+
+// KeyringSessionStore saves the session in the OS keyring, e.g. macOS Keychain, Windows Credential Manager
+// or the Secret Service on Linux, so the keys are never written to the DB
+type KeyringSessionStore struct {
+	// service and user the session is saved under, defaulting to "sn-persist" and "default"
+	// use a User per account to save several sessions
+	Service, User string
+	// keyring to use in place of the OS keyring if not nil, e.g. for testing
+	Keyring keyring.Keyring
+}
+
+func (s KeyringSessionStore) names() (service, user string) {
+	service, user = s.Service, s.User
+
+	if service == "" {
+		service = keyringService
+	}
+
+	if user == "" {
+		user = "default"
+	}
+
+	return
+}
+
+func (s KeyringSessionStore) keyring() keyring.Keyring {
+	if s.Keyring != nil {
+		return s.Keyring
+	}
+
+	return osKeyring{}
+}
+
+func (s KeyringSessionStore) SaveSession(email string, session gosn.Session) error {
+	content, err := json.Marshal(sessionContent{Email: email, Session: session})
+	if err != nil {
+		return err
+	}
+
+	service, user := s.names()
+
+	return s.keyring().Set(service, user, string(content))
+}
+
+func (s KeyringSessionStore) LoadSession() (email string, session gosn.Session, err error) {
+	service, user := s.names()
+
+	var raw string
+
+	if raw, err = s.keyring().Get(service, user); err != nil {
+		if errors.Is(err, keyring.ErrNotFound) {
+			err = ErrSessionNotFound
+		}
+
+		return
+	}
+
+	var content sessionContent
+
+	if err = json.Unmarshal([]byte(raw), &content); err != nil {
+		return
+	}
+
+	return content.Email, content.Session, nil
+}
+
+func (s KeyringSessionStore) RemoveSession() (err error) {
+	service, user := s.names()
+
+	err = s.keyring().Delete(service, user)
+	if errors.Is(err, keyring.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+// osKeyring is the OS keyring selected by the keyring package
+type osKeyring struct{}
+
+func (osKeyring) Set(service, user, password string) error {
+	return keyring.Set(service, user, password)
+}
+
+func (osKeyring) Get(service, user string) (string, error) {
+	return keyring.Get(service, user)
+}
+
+func (osKeyring) Delete(service, user string) error {
+	return keyring.Delete(service, user)
+}
@@ -0,0 +1,70 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zalando/go-keyring"
+	"testing"
+)
+
+func TestSaveSession(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	_, _, err = LoadSession(db, "secret")
+	assert.True(t, errors.Is(err, ErrSessionNotFound))
+
+	session := offlineSession()
+	assert.NoError(t, SaveSession(db, "a@example.com", session, "secret"))
+
+	email, loaded, err := LoadSession(db, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "a@example.com", email)
+	assert.Equal(t, session, loaded)
+
+	// the keys are not stored in plain text
+	var stored StoredSession
+	assert.NoError(t, db.One("ID", sessionID, &stored))
+	assert.NotContains(t, string(stored.Ciphertext), session.Mk)
+
+	_, _, err = LoadSession(db, "wrong")
+	assert.True(t, errors.Is(err, ErrInvalidPassphrase))
+
+	assert.NoError(t, RemoveSession(db))
+	assert.NoError(t, RemoveSession(db))
+
+	_, _, err = LoadSession(db, "secret")
+	assert.True(t, errors.Is(err, ErrSessionNotFound))
+}
+
+func TestSessionStores(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	keyring.MockInit()
+
+	session := offlineSession()
+
+	for _, store := range []SessionStore{
+		DBSessionStore{DB: db, Passphrase: "secret"},
+		KeyringSessionStore{},
+		KeyringSessionStore{User: "b@example.com"},
+	} {
+		_, _, err = store.LoadSession()
+		assert.True(t, errors.Is(err, ErrSessionNotFound))
+
+		assert.NoError(t, store.SaveSession("a@example.com", session))
+
+		email, loaded, err := store.LoadSession()
+		assert.NoError(t, err)
+		assert.Equal(t, "a@example.com", email)
+		assert.Equal(t, session, loaded)
+
+		assert.NoError(t, store.RemoveSession())
+		assert.NoError(t, store.RemoveSession())
+	}
+}
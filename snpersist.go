@@ -1,10 +1,22 @@
 package snpersist
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/codec"
 	"github.com/jonhadfield/gosn-v2"
-	"strings"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -18,10 +30,97 @@ type Item struct {
 	UpdatedAt   string
 	Dirty       bool
 	DirtiedDate time.Time
+	// order in which the item was last made dirty, assigned when it is saved, zero if it is not dirty
+	DirtySeq uint64
+	// number of consecutive syncs the server has returned the item as unsaved
+	UnsavedCount int
+	// reason the item last failed to push, cleared once SN saves it
+	LastError string
+	// CreatedAt and UpdatedAt parsed when the item is saved, zero if they are not valid timestamps
+	CreatedAtTime time.Time `storm:"index"`
+	UpdatedAtTime time.Time `storm:"index"`
+	// hash of the encrypted content, item key, content type and deleted flag, set when the item is saved
+	ContentHash string
+	// UUID of the item this is a conflicted copy of
+	// gosn's content types cannot carry conflict_of so the reference is only held locally
+	ConflictOf string
+	// encrypted content and item key of the last synced copy of a dirty item, used as the base when merging
+	BaseContent    string
+	BaseEncItemKey string
+}
+
+// setBase records the last synced copy of the stored item as the base of the item replacing it
+func (i *Item) setBase(stored Item) {
+	if stored.Dirty {
+		i.BaseContent, i.BaseEncItemKey = stored.BaseContent, stored.BaseEncItemKey
+		return
+	}
+
+	i.BaseContent, i.BaseEncItemKey = stored.Content, stored.EncItemKey
+}
+
+// clean removes the item's dirty flag and, as it is now considered synced, its base
+func (i *Item) clean() {
+	i.Dirty = false
+	i.DirtiedDate = time.Time{}
+	i.DirtySeq = 0
+	i.BaseContent = ""
+	i.BaseEncItemKey = ""
+}
+
+// sequence assigns a dirty item without a dirty sequence number the next one, obtained from next
+// the number is removed from items that are not dirty
+func (i *Item) sequence(next func() (uint64, error)) (err error) {
+	switch {
+	case !i.Dirty:
+		i.DirtySeq = 0
+	case i.DirtySeq == 0:
+		i.DirtySeq, err = next()
+	}
+
+	return
+}
+
+// sortDirty orders dirty items by the sequence in which they were made dirty
+// items dirtied before sequence numbers were assigned come first, in the order they were dirtied
+func sortDirty(items []Item) {
+	sort.SliceStable(items, func(x, y int) bool {
+		a, b := items[x], items[y]
+
+		switch {
+		case a.DirtySeq != b.DirtySeq:
+			return a.DirtySeq < b.DirtySeq
+		case !a.DirtiedDate.Equal(b.DirtiedDate):
+			return a.DirtiedDate.Before(b.DirtiedDate)
+		}
+
+		return a.UUID < b.UUID
+	})
+}
+
+// derive populates the item's parsed timestamps and content hash
+func (i *Item) derive() {
+	i.CreatedAtTime, _ = time.Parse(time.RFC3339Nano, i.CreatedAt)
+	i.UpdatedAtTime, _ = time.Parse(time.RFC3339Nano, i.UpdatedAt)
+	i.ContentHash = i.contentHash()
+}
+
+// contentHash returns the hash of the fields that are pushed to SN other than timestamps
+func (i Item) contentHash() string {
+	h := sha256.New()
+
+	for _, field := range []string{i.ContentType, i.Content, i.EncItemKey, strconv.FormatBool(i.Deleted)} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 type SyncToken struct {
-	SyncToken string `storm:"id,unique"`
+	SyncToken   string    `storm:"id,unique"`
+	CursorToken string    // set whilst a paginated sync is in progress
+	SavedAt     time.Time // used to find the latest token if more than one has been stored
 }
 
 // persist.sync is a wrapper around gosn.sync and local database updates
@@ -47,19 +146,282 @@ type SyncToken struct {
 type SyncInput struct {
 	Session gosn.Session
 	DB      *storm.DB // pointer to an existing DB
-	DBPath  string    // path to create new DB
+	DBPath  string    // path to create new DB, returned as SyncOutput.DB which the caller must close
+	// alternative storage to use in place of a storm DB, cannot be combined with DB or DBPath
+	Store Store
+	// email of the session's account, recorded in a storm DB by its first sync and compared by later syncs
+	// so a DB is not synced with another account's session, nothing is checked if empty
+	Email string
+	// parameters of the session's keys, saved in a storm DB so they are available offline, the keys of later
+	// syncs are checked against those saved, nothing is saved if nil
+	KeyParams *KeyParams
+	// called to refresh the session when SN rejects it, e.g. as its token has expired, the failed call is then
+	// repeated once with the refreshed session, which is returned as SyncOutput.Session
+	// gosn does not refresh sessions itself so this must be provided for sessions to be refreshed
+	RefreshSession func(session gosn.Session) (gosn.Session, error)
+	// called for a new session, e.g. by prompting the user to sign in again, when SN rejects the session and it
+	// cannot be refreshed, with the reason it was rejected or could not be refreshed
+	ReauthFunc func(reason error) (gosn.Session, error)
+	// where a refreshed session is saved, along with Email, nothing is saved if nil
+	SessionStore SessionStore
+	// account whose DB to use, if set then DBPath is a directory holding a DB for each account, created if required
+	// see ListAccounts and SetCurrentAccount for managing the accounts, ignored unless DBPath is set
+	AccountID string
+	// options used when opening the DB at DBPath, e.g. storm.BoltOptions to set a lock timeout or file mode
+	DBOptions []func(*storm.Options) error
+	// permissions of the DB file created at DBPath, defaults to 0600, ignored if DBOptions sets storm.BoltOptions
+	DBFileMode os.FileMode
+	// create the directories of DBPath that do not exist, with permissions 0700, rather than failing
+	CreateDBDir bool
+	// codec used to store values in the DB at DBPath, e.g. GzipCodec, defaults to JSON
+	// a DB must always be opened with the codec it was created with
+	Codec codec.MarshalUnmarshaler
+	// compact the DB at DBPath as it is opened, and after each sync of a SyncRunner that owns it, once the
+	// proportion of the file that is free, from 0 to 1, exceeds the threshold, never if zero, see Compact
+	CompactThreshold float64
+	// snapshots of the DB kept by a SyncRunner, taken after each successful sync, none if nil
+	Backups *BackupSchedule
+	// maintain an unencrypted index of item titles, updated with the items changed by each sync
+	IndexTitles bool
+	// maintain an index of the references between items, e.g. tags to notes, updated with the items changed by each sync
+	IndexReferences bool
+	// maintain a full-text search index of notes, updated with the items changed by each sync
+	IndexSearch bool
+	// store the search index's terms as keyed hashes rather than plain text
+	EncryptSearchIndex bool
+	// number of items requested with each page of a sync, defaults to the gosn page size
+	PageSize int
+	// number of times to retry transient SN failures and the initial wait between attempts, doubled each retry
+	// a rate limited sync is retried once after the wait SN requested even if Retries is 0
+	Retries      int
+	RetryBackoff time.Duration
+	// upper limit of the wait between attempts, unlimited if zero
+	RetryMaxBackoff time.Duration
+	// proportion, from 0 to 1, of each wait that is randomised to spread out retries from many clients
+	RetryJitter float64
+	// how to resolve retrieved items that collide with dirty local items, defaults to NewestWins
+	ConflictPolicy ConflictPolicy
+	// called to resolve collisions when ConflictPolicy is Callback
+	ConflictFunc ConflictFunc
+	// makes the calls to SN, defaults to DefaultSyncer
+	Syncer Syncer
+	// HTTP client used to call SN with an HTTPSyncer, ignored if Syncer is set
+	HTTPClient *http.Client
+	// receives events describing the changes applied by the sync, nothing is published if nil
+	Events *Events
+	// called with the dirty items before they are pushed to SN, returning an error aborts the sync
+	PreSyncHook func(dirty []Item) error
+	// called with the output of each successful sync
+	PostSyncHook func(so SyncOutput)
+	// called after each page is committed whilst populating a new DB with the running totals of items
+	// retrieved and saved, deleted items are retrieved but not saved, and the number of the page
+	Progress func(fetched, saved, page int)
+	// traces the phases of each sync, nothing is traced if nil
+	Tracer Tracer
+	// records the outcome of each sync as Prometheus metrics, nothing is recorded if nil
+	Metrics *Metrics
+	// number of sync runs recorded in the history of a storm DB, nothing is recorded if zero
+	HistoryRetention int
+	// optional logger for diagnosing sync behaviour, nothing is logged if nil
+	Logger Logger
+	// enable gosn's debug output and trace logging of each DB write, to Logger or the standard logger if nil
+	Debug bool
+	// skip the call to SN and return the existing persisted items, a valid session is not required
+	Offline bool
+	// skip the call to SN and return the existing persisted items if the previous sync completed within the interval
+	// dirty items are pushed by the next sync that is not skipped, ignored when populating a new DB from DBPath
+	MinInterval time.Duration
+	// number of consecutive syncs a dirty item can be returned as unsaved before it is moved to the dead letters
+	// so it is no longer pushed, never if zero, only applies to storm DBs
+	DeadLetterAfter int
+	// return ErrSyncInProgress rather than waiting if another sync of the same DB or store is in progress
+	// syncs are only serialised within the process
+	FailIfSyncing bool
+	// wait for, and return the output of, a sync of the same DB or store already in progress that also has Coalesce set
+	// rather than making another call to SN, items made dirty after that sync started are pushed by the next one
+	Coalesce bool
+
+	// items keys of the sync's store, used to decrypt 004 items
+	itemsKeys *itemsKeyCache
 }
 
 type SyncOutput struct {
 	Items, SavedItems, Unsaved gosn.EncryptedItems // only used for testing purposes!?
+	Conflicts                  []Conflict          // local dirty items the server refused to save or that collided with retrieved items
+	ItemErrors                 []ItemError         // retrieved items that could not be persisted, they are retrieved again by the next sync
 	//syncToken, cursorToken     string              // only used for testing purposes!?
-	DB *storm.DB // pointer to DB (same if passed in SyncInput, new if called without existing)
+	DB    *storm.DB // pointer to DB (same if passed in SyncInput, new, and owned by the caller, if called without existing)
+	Store Store     // the store the sync was applied to, wrapping DB unless SyncInput.Store was provided
+	Stats SyncStats
+	// set if the call to SN was skipped due to SyncInput.MinInterval
+	Skipped bool
+	// dirty items moved to the dead letters by this sync due to SyncInput.DeadLetterAfter
+	DeadLettered []Item
+	// the session used by the sync, which differs from SyncInput.Session if it was refreshed
+	Session gosn.Session
+}
+
+// SyncStats summarises the changes made by a sync
+type SyncStats struct {
+	Pushed       int    // dirty items sent to SN
+	Saved        int    // items SN confirmed as saved
+	Pulled       int    // items retrieved from SN
+	Conflicted   int    // dirty items SN refused to save
+	Deleted      int    // items removed from the DB following deletion
+	Unsaved      int    // items SN returned as unsaved
+	Failed       int    // items retrieved from SN that could not be persisted
+	Pages        int    // pages retrieved from SN
+	Bytes        int    // size of the encrypted content and keys pushed and pulled
+	SyncTokenIn  string // sync token the sync started from
+	SyncTokenOut string // sync token persisted for the next sync
+	// time taken by the sync
+	Duration time.Duration
+}
+
+// Logger is satisfied by the standard library's *log.Logger
+// loggers that also implement LevelLogger, e.g. logrus, receive each message at its level
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LevelLogger is implemented by structured loggers with levels, use Leveled to provide one lacking Printf
+type LevelLogger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// Leveled returns a Logger that passes each message to the LevelLogger at its level, e.g. for a zap SugaredLogger
+func Leveled(l LevelLogger) Logger {
+	return leveledLogger{l}
+}
+
+// leveledLogger adds Printf, logging at info level, to a LevelLogger
+type leveledLogger struct {
+	LevelLogger
+}
+
+func (l leveledLogger) Printf(format string, v ...interface{}) {
+	l.Infof(format, v...)
+}
+
+type logLevel int
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warnLevel
+	errorLevel
+)
+
+// log writes to the input's logger, if one has been provided, at the given level if it supports levels
+func (si SyncInput) log(level logLevel, format string, v ...interface{}) {
+	if si.Logger == nil {
+		return
+	}
+
+	ll, ok := si.Logger.(LevelLogger)
+	if !ok {
+		si.Logger.Printf(format, v...)
+		return
+	}
+
+	switch level {
+	case debugLevel:
+		ll.Debugf(format, v...)
+	case infoLevel:
+		ll.Infof(format, v...)
+	case warnLevel:
+		ll.Warnf(format, v...)
+	default:
+		ll.Errorf(format, v...)
+	}
+}
+
+func (si SyncInput) debugf(format string, v ...interface{}) {
+	si.log(debugLevel, format, v...)
+}
+
+func (si SyncInput) infof(format string, v ...interface{}) {
+	si.log(infoLevel, format, v...)
+}
+
+func (si SyncInput) warnf(format string, v ...interface{}) {
+	si.log(warnLevel, format, v...)
+}
+
+func (si SyncInput) errorf(format string, v ...interface{}) {
+	si.log(errorLevel, format, v...)
+}
+
+// tracef logs DB operations at debug level if the input has Debug set
+func (si SyncInput) tracef(format string, v ...interface{}) {
+	if !si.Debug {
+		return
+	}
+
+	if si.Logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+
+	si.debugf(format, v...)
+}
+
+// stormDB returns the storm DB the sync was applied to, or nil if there is not one
+func (si SyncInput) stormDB(so SyncOutput) *storm.DB {
+	if so.DB != nil {
+		return so.DB
+	}
+
+	return si.DB
+}
+
+// recordHistory adds the sync run to the history of the input's storm DB, if requested
+// failures are logged rather than failing the sync
+func (si SyncInput) recordHistory(so SyncOutput, started time.Time, syncErr error) {
+	db := si.stormDB(so)
+
+	if si.HistoryRetention <= 0 || db == nil || so.Skipped {
+		return
+	}
+
+	if err := recordHistory(db, si.HistoryRetention, started, so.Stats, syncErr); err != nil {
+		si.warnf("snpersist | Sync | failed to record history: %v", err)
+	}
+}
+
+// preSync calls the input's PreSyncHook, if one has been provided
+func (si SyncInput) preSync(dirty []Item) error {
+	if si.PreSyncHook == nil {
+		return nil
+	}
+
+	return si.PreSyncHook(dirty)
 }
 
 type Items []Item
 
-func (pi Items) ToItems(session gosn.Session) (items gosn.Items, err error) {
-	var eItems gosn.EncryptedItems
+// ToItems decrypts and parses the items, 004 items are decrypted with the items keys, which may also be
+// included amongst the items, items keys are not returned as gosn cannot represent them
+func (pi Items) ToItems(session gosn.Session, keys ...ItemsKey) (items gosn.Items, err error) {
+	eItems := pi.encrypted()
+	if eItems == nil {
+		return
+	}
+
+	var decrypted gosn.DecryptedItems
+
+	if decrypted, err = decryptItems(eItems, session, keys); err != nil || decrypted == nil {
+		return
+	}
+
+	return decrypted.Parse()
+}
+
+// encrypted returns the items as gosn encrypted items
+func (pi Items) encrypted() (eItems gosn.EncryptedItems) {
 	for _, ei := range pi {
 		eItems = append(eItems, gosn.EncryptedItem{
 			UUID:        ei.UUID,
@@ -71,8 +433,57 @@ func (pi Items) ToItems(session gosn.Session) (items gosn.Items, err error) {
 			UpdatedAt:   ei.UpdatedAt,
 		})
 	}
-	if eItems != nil {
-		items, err = eItems.DecryptAndParse(session.Mk, session.Ak, false)
+
+	return
+}
+
+// ToItemsParallel decrypts and parses the items as ToItems does, split between the given number of workers
+// the items are returned in their original order
+func (pi Items) ToItemsParallel(session gosn.Session, workers int, keys ...ItemsKey) (items gosn.Items, err error) {
+	if workers > len(pi) {
+		workers = len(pi)
+	}
+
+	if workers <= 1 {
+		return pi.ToItems(session, keys...)
+	}
+
+	// each worker decrypts a contiguous chunk so the results can be joined in order
+	size := (len(pi) + workers - 1) / workers
+
+	results := make([]gosn.Items, workers)
+	errs := make([]error, workers)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		start := w * size
+		if start >= len(pi) {
+			break
+		}
+
+		end := start + size
+		if end > len(pi) {
+			end = len(pi)
+		}
+
+		wg.Add(1)
+
+		go func(w int, chunk Items) {
+			defer wg.Done()
+
+			results[w], errs[w] = chunk.ToItems(session, keys...)
+		}(w, pi[start:end])
+	}
+
+	wg.Wait()
+
+	for w := range results {
+		if errs[w] != nil {
+			return nil, errs[w]
+		}
+
+		items = append(items, results[w]...)
 	}
 
 	return
@@ -80,7 +491,7 @@ func (pi Items) ToItems(session gosn.Session) (items gosn.Items, err error) {
 
 func ConvertItemsToPersistItems(items gosn.EncryptedItems) (pitems []Item) {
 	for _, i := range items {
-		pitems = append(pitems, Item{
+		pi := Item{
 			UUID:        i.UUID,
 			Content:     i.Content,
 			ContentType: i.ContentType,
@@ -88,109 +499,596 @@ func ConvertItemsToPersistItems(items gosn.EncryptedItems) (pitems []Item) {
 			Deleted:     i.Deleted,
 			CreatedAt:   i.CreatedAt,
 			UpdatedAt:   i.UpdatedAt,
-		})
+		}
+		pi.derive()
+
+		pitems = append(pitems, pi)
 	}
 
 	return
 }
 
-func initialiseDB(si SyncInput) (db *storm.DB, err error) {
+// initialiseDB populates the DB at DBPath, resuming from the last committed page if a previous attempt was interrupted
+func initialiseDB(ctx context.Context, si *SyncInput) (db *storm.DB, stats SyncStats, itemErrors []ItemError, err error) {
+	ctx, endSpan := si.startSpan(ctx, "initialise-db")
+	defer func() {
+		endSpan(err)
+	}()
+
 	// create new DB in provided path
-	db, err = storm.Open(si.DBPath)
+	db, err = si.openDB()
 	if err != nil {
 		return
 	}
 
-	// call gosn sync to get existing items
-	gSI := gosn.SyncInput{
-		Session: si.Session,
+	if err = si.checkAccount(db); err != nil {
+		return
 	}
 
-	var gSO gosn.SyncOutput
+	if err = si.checkKeyParams(db); err != nil {
+		return
+	}
+
+	// resume from the last committed page of a population that was interrupted
+	var stored SyncToken
 
-	gSO, err = gosn.Sync(gSI)
+	stored, err = getSyncToken(db)
 	if err != nil {
 		return
 	}
 
-	// put new Items in db
-	for _, i := range gSO.Items {
-		item := Item{
-			UUID:        i.UUID,
-			Content:     i.Content,
-			ContentType: i.ContentType,
-			EncItemKey:  i.EncItemKey,
-			Deleted:     i.Deleted,
-			CreatedAt:   i.CreatedAt,
-			UpdatedAt:   i.UpdatedAt,
+	// call gosn sync to get existing items, a page at a time
+	gSI := gosn.SyncInput{
+		Session:  si.Session,
+		PageSize: si.PageSize,
+		Debug:    si.Debug,
+	}
+
+	if stored.CursorToken != "" {
+		si.infof("snpersist | initialiseDB | resuming from cursor token: %q", stored.CursorToken)
+
+		gSI.SyncToken = stored.SyncToken
+		gSI.CursorToken = stored.CursorToken
+	}
+
+	var gSO gosn.SyncOutput
+
+	store := &StormStore{db: db}
+	si.itemsKeys = &itemsKeyCache{store: store}
+
+	for page := 1; ; page++ {
+		if err = ctx.Err(); err != nil {
+			return
 		}
-		err = db.Save(&item)
+
+		// the session may have been refreshed by the previous page
+		gSI.Session = si.Session
+
+		gSO, err = syncWithRetry(ctx, si, gSI)
 		if err != nil {
 			return
 		}
+
+		// pages already committed are kept if cancelled
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		si.debugf("snpersist | initialiseDB | pulled %d items | cursor token: %q", len(gSO.Items), gSO.Cursor)
+
+		// put new Items and sync values in db
+		var pageErrors []ItemError
+		si.addKeys(gSO.Items)
+
+		if _, pageErrors, err = persistSyncOutput(ctx, store, *si, nil, gSO); err != nil {
+			si.errorf("snpersist | initialiseDB | failed to persist sync output: %v", err)
+			return
+		}
+
+		itemErrors = append(itemErrors, pageErrors...)
+		stats.Failed += len(pageErrors)
+
+		stats.Pulled += len(gSO.Items)
+		stats.Deleted += countDeleted(gSO.Items)
+		stats.Pages = page
+		stats.Bytes += contentSize(gSO.Items)
+
+		if len(pageErrors) == 0 {
+			stats.SyncTokenOut = gSO.SyncToken
+		}
+
+		if si.Progress != nil {
+			si.Progress(stats.Pulled, stats.Pulled-stats.Deleted, page)
+		}
+
+		// the sync token was not updated so later pages are left for the next sync to retrieve
+		if gSO.Cursor == "" || len(pageErrors) > 0 {
+			break
+		}
+
+		gSI.SyncToken = gSO.SyncToken
+		gSI.CursorToken = gSO.Cursor
+	}
+
+	return
+}
+
+// openDB opens, or creates, the DB at the input's DBPath, or its account's within it, with the input's codec and options
+func (si SyncInput) openDB() (*storm.DB, error) {
+	path := si.dbPath()
+	dir := filepath.Dir(path)
+
+	if si.CompactThreshold > 0 {
+		if err := compactIfFree(path, si.CompactThreshold, si.DBOptions...); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if !si.CreateDBDir && si.AccountID == "" {
+			return nil, fmt.Errorf("DB directory %s does not exist: %w", dir, err)
+		}
+
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	options := si.DBOptions
+
+	if si.DBFileMode != 0 {
+		mode := storm.BoltOptions(si.DBFileMode, &bolt.Options{Timeout: boltTimeout(options...)})
+		options = append([]func(*storm.Options) error{mode}, options...)
 	}
 
-	// update sync values in db for next time
-	sv := SyncToken{
-		SyncToken: gSO.SyncToken,
+	return openWithCodec(path, si.Codec, options...)
+}
+
+// Open opens, or creates, the DB at the provided path without contacting SN
+// values are stored as JSON, use OpenCompressed for a compressed DB
+func Open(dbPath string, options ...func(*storm.Options) error) (*storm.DB, error) {
+	return openWithCodec(dbPath, nil, options...)
+}
+
+// syncOffline returns the store and its persisted items without contacting SN
+func syncOffline(si SyncInput) (so SyncOutput, err error) {
+	so.DB = si.DB
+	so.Store = si.Store
+
+	if so.Store == nil {
+		if so.DB == nil {
+			so.DB, err = si.openDB()
+			if err != nil {
+				return
+			}
+		}
+
+		so.Store = &StormStore{db: so.DB}
 	}
-	if err = db.Save(&sv); err != nil {
+
+	var persisted []Item
+
+	persisted, err = so.Store.AllItems()
+	if err != nil {
 		return
 	}
 
+	for _, p := range persisted {
+		so.Items = append(so.Items, gosn.EncryptedItem{
+			UUID:        p.UUID,
+			Content:     p.Content,
+			ContentType: p.ContentType,
+			EncItemKey:  p.EncItemKey,
+			Deleted:     p.Deleted,
+			CreatedAt:   p.CreatedAt,
+			UpdatedAt:   p.UpdatedAt,
+		})
+	}
+
 	return
 }
 
-func Sync(si SyncInput) (so SyncOutput, err error) {
-	if !si.Session.Valid() {
-		err = fmt.Errorf("invalid session")
+// saveItems persists a page of items retrieved from SN
+// retrieved items that collide with dirty local items are resolved using the input's conflict policy
+// and returned as conflicts, along with events describing the changes applied
+// items that cannot be persisted are returned as item errors rather than aborting the rest of the page
+func saveItems(tx StoreTx, si SyncInput, items gosn.EncryptedItems) (conflicts []Conflict, events []Event, itemErrors []ItemError, err error) {
+	var applied gosn.EncryptedItems
+
+	for _, i := range items {
+		conflict, event, apply, iErr := saveItem(tx, si, i)
+		if iErr != nil {
+			si.errorf("snpersist | saveItems | failed to persist %s %s: %v", i.ContentType, i.UUID, iErr)
+			itemErrors = append(itemErrors, ItemError{UUID: i.UUID, ContentType: i.ContentType, Err: iErr})
+
+			continue
+		}
+
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+
+		if event != nil {
+			events = append(events, *event)
+		}
+
+		if apply {
+			applied = append(applied, i)
+		}
+	}
+
+	if si.IndexTitles || si.IndexReferences || si.IndexSearch {
+		err = updateIndexes(tx, si, applied)
+	}
+
+	return
+}
+
+// saveItem persists an item retrieved from SN, returning any conflict with a dirty local item,
+// the event describing the change, if any, and whether the retrieved item was applied
+// items that fail validation are quarantined rather than stored
+func saveItem(tx StoreTx, si SyncInput, i gosn.EncryptedItem) (conflict *Conflict, event *Event, apply bool, err error) {
+	if vErr := validateItem(i); vErr != nil {
+		si.warnf("snpersist | saveItems | quarantined %s %s: %v", i.ContentType, i.UUID, vErr)
+
+		return nil, &Event{Type: ItemQuarantined, UUID: i.UUID, ContentType: i.ContentType, Err: vErr}, false, quarantine(tx, i, vErr)
+	}
+
+	var existing Item
+
+	existing, err = tx.Item(i.UUID)
+
+	switch {
+	case err == nil:
+		if existing.Dirty {
+			var resolution ConflictResolution
+			if resolution, err = resolveConflict(tx, si, existing, i); err != nil {
+				return
+			}
+
+			conflict = &Conflict{
+				Local:      existing,
+				Remote:     ConvertItemsToPersistItems(gosn.EncryptedItems{i})[0],
+				Resolution: resolution,
+			}
+
+			if !resolution.savesRemote() {
+				return
+			}
+		}
+	case !errors.Is(err, ErrItemNotFound):
 		return
 	}
 
-	if si.DB != nil && si.DBPath != "" {
-		err = fmt.Errorf("passing a DB pointer and DB path does not make sense")
+	exists := err == nil
+	err = nil
+
+	// a valid copy replaces any quarantined before
+	if err = tx.Unquarantine(i.UUID); err != nil {
 		return
 	}
 
-	if si.DB == nil {
-		if si.DBPath == "" {
-			err = fmt.Errorf("DB pointer or DB path are required")
+	// items deleted elsewhere are removed rather than saved
+	if i.Deleted {
+		if err = tx.DeleteItem(i.UUID); err != nil {
 			return
 		}
-		var db *storm.DB
-		db, err = initialiseDB(si)
-		return SyncOutput{
-			DB: db,
-		}, err
+
+		si.tracef("snpersist | saveItems | removed deleted %s %s", i.ContentType, i.UUID)
+
+		if exists {
+			event = &Event{Type: ItemDeleted, UUID: i.UUID, ContentType: i.ContentType}
+		}
+
+		return conflict, event, true, nil
 	}
 
-	// get dirty Items
-	var dirty []Item
-	err = si.DB.Find("Dirty", true, &dirty)
+	item := Item{
+		UUID:        i.UUID,
+		Content:     i.Content,
+		ContentType: i.ContentType,
+		EncItemKey:  i.EncItemKey,
+		Deleted:     i.Deleted,
+		CreatedAt:   i.CreatedAt,
+		UpdatedAt:   i.UpdatedAt,
+	}
+	if err = tx.SaveItem(item); err != nil {
+		return
+	}
+
+	si.tracef("snpersist | saveItems | saved %s %s", i.ContentType, i.UUID)
+
+	event = &Event{Type: ItemAdded, UUID: i.UUID, ContentType: i.ContentType}
+	if exists {
+		event.Type = ItemUpdated
+	}
+
+	return conflict, event, true, nil
+}
+
+// contentSize returns the size of the items' encrypted content and keys
+func contentSize(items gosn.EncryptedItems) (size int) {
+	for _, i := range items {
+		size += len(i.Content) + len(i.EncItemKey)
+	}
+
+	return
+}
+
+// countDeleted returns the number of items flagged as deleted
+func countDeleted(items gosn.EncryptedItems) (count int) {
+	for _, i := range items {
+		if i.Deleted {
+			count++
+		}
+	}
+
+	return
+}
+
+// saveSyncToken replaces any existing sync token with the one provided
+func saveSyncToken(db storm.Node, sv SyncToken) (err error) {
+	var existing []SyncToken
+
+	err = db.All(&existing)
 	if err != nil {
-		if !strings.Contains(err.Error(), "not found") {
+		return
+	}
+
+	for x := range existing {
+		if existing[x].SyncToken == sv.SyncToken {
+			continue
+		}
+
+		if err = db.DeleteStruct(&existing[x]); err != nil {
 			return
 		}
 	}
 
-	// get sync token from previous operation
+	sv.SavedAt = time.Now()
+
+	return db.Save(&sv)
+}
+
+// completedAt returns when the sync that saved the token completed, or zero if it is incomplete or there has not been one
+func (st SyncToken) completedAt() time.Time {
+	if st.CursorToken != "" {
+		return time.Time{}
+	}
+
+	return st.SavedAt
+}
+
+// LastSyncTime returns when the most recent sync to complete against the DB finished
+// the time is zero if there has not been one or a paginated sync has since been interrupted
+func LastSyncTime(db *storm.DB) (last time.Time, err error) {
+	var st SyncToken
+
+	st, err = getSyncToken(db)
+	if err != nil {
+		return
+	}
+
+	return st.completedAt(), nil
+}
+
+// SyncIfStale syncs only if the last sync completed more than maxAge ago, otherwise returning the persisted items
+// SyncOutput.Skipped is set if SN was not called
+func SyncIfStale(si SyncInput, maxAge time.Duration) (SyncOutput, error) {
+	si.MinInterval = maxAge
+
+	return Sync(si)
+}
+
+// getSyncToken returns the sync token from the previous sync, or an empty token if there has not been one
+// if more than one token has been stored then the most recently saved is kept and the rest removed
+func getSyncToken(db storm.Node) (latest SyncToken, err error) {
 	var syncTokens []SyncToken
-	err = si.DB.All(&syncTokens)
+
+	err = db.All(&syncTokens)
 	if err != nil {
-		if !strings.Contains(err.Error(), "not found") {
+		err = wrapError(ErrSyncTokenCorrupt, err)
+		return
+	}
+
+	if len(syncTokens) == 0 {
+		return
+	}
+
+	latest = syncTokens[0]
+	for _, st := range syncTokens[1:] {
+		if st.SavedAt.After(latest.SavedAt) {
+			latest = st
+		}
+	}
+
+	for x := range syncTokens {
+		if syncTokens[x].SyncToken == latest.SyncToken {
+			continue
+		}
+
+		if err = db.DeleteStruct(&syncTokens[x]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Sync pushes dirty items to SN and persists the items retrieved in return
+// each page of results, including the clearing of dirty flags and the new sync token, is applied to the DB
+// in a single transaction so a failure leaves the DB as it was after the last successfully applied page
+func Sync(si SyncInput) (so SyncOutput, err error) {
+	return SyncWithContext(context.Background(), si)
+}
+
+// SyncWithContext is Sync with cancellation checked before each call to SN and each DB update
+// pages of items already persisted are kept if the context is cancelled
+func SyncWithContext(ctx context.Context, si SyncInput) (so SyncOutput, err error) {
+	if si.Coalesce {
+		return si.coalesce(ctx, func() (SyncOutput, error) {
+			return syncWithContext(ctx, si)
+		})
+	}
+
+	return syncWithContext(ctx, si)
+}
+
+func syncWithContext(ctx context.Context, si SyncInput) (so SyncOutput, err error) {
+	start := time.Now()
+
+	ctx, endSpan := si.startSpan(ctx, "sync")
+	defer func() {
+		endSpan(err)
+	}()
+
+	defer func() {
+		so.Stats.Duration = time.Since(start)
+		so.Session = si.Session
+
+		si.recordHistory(so, start, err)
+
+		if db := si.stormDB(so); db != nil && err != nil {
+			if rErr := recordRateLimit(db, err); rErr != nil {
+				si.warnf("snpersist | Sync | failed to record rate limit: %v", rErr)
+			}
+		}
+		si.Metrics.observe(so, err)
+
+		if err != nil {
+			si.Events.publish(Event{Type: SyncFailed, Err: err})
 			return
 		}
 
+		si.Events.publish(Event{Type: SyncCompleted, Stats: so.Stats})
+
+		if si.PostSyncHook != nil {
+			si.PostSyncHook(so)
+		}
+	}()
+
+	if !si.Offline && !si.Session.Valid() {
+		err = ErrInvalidSession
+		return
+	}
+
+	if (si.DB != nil && si.DBPath != "") || (si.Store != nil && (si.DB != nil || si.DBPath != "")) {
+		err = ErrConflictingDBArgs
 		return
 	}
-	var syncToken string
-	if len(syncTokens) > 1 {
-		err = fmt.Errorf("expected maximum of one sync token but %d returned", len(syncTokens))
+
+	if si.Store == nil && si.DB == nil && si.DBPath == "" {
+		err = ErrNoDB
+		return
+	}
+
+	if si.ConflictPolicy == Callback && si.ConflictFunc == nil {
+		err = ErrNoConflictFunc
+		return
+	}
+
+	if si.Offline {
+		return syncOffline(si)
 	}
-	if len(syncTokens) == 1 {
-		syncToken = syncTokens[0].SyncToken
+
+	// interleaved syncs of the same DB would overwrite each other's sync tokens and dirty items
+	var unlock func()
+
+	if unlock, err = si.lockSync(ctx); err != nil {
+		return
+	}
+
+	defer unlock()
+
+	if si.Store == nil && si.DB == nil {
+		// a new DB has nothing to push
+		if err = si.preSync(nil); err != nil {
+			return
+		}
+
+		var db *storm.DB
+		var stats SyncStats
+		var itemErrors []ItemError
+		db, stats, itemErrors, err = initialiseDB(ctx, &si)
+		so = SyncOutput{
+			DB:         db,
+			Stats:      stats,
+			ItemErrors: itemErrors,
+		}
+		if db != nil {
+			so.Store = &StormStore{db: db}
+		}
+
+		return
+	}
+
+	store := si.Store
+	if store == nil {
+		// a DB opened by the caller may not have been migrated
+		if store, err = NewStormStore(si.DB); err != nil {
+			return
+		}
+	}
+
+	// avoid calling SN again before a rate limit expires
+	if si.DB != nil {
+		if err = si.checkAccount(si.DB); err != nil {
+			return
+		}
+
+		if err = si.checkKeyParams(si.DB); err != nil {
+			return
+		}
+
+		if err = checkRateLimit(si.DB); err != nil {
+			return
+		}
 	}
 
+	si.itemsKeys = &itemsKeyCache{store: store}
+
+	// get sync token from previous operation
+	_, endLoad := si.startSpan(ctx, "load-dirty")
+
+	var stored SyncToken
+	stored, err = store.SyncToken()
+	if err != nil {
+		endLoad(err)
+		return
+	}
+
+	// serve from the store if the previous sync completed recently enough
+	if last := stored.completedAt(); si.MinInterval > 0 && !last.IsZero() && time.Since(last) < si.MinInterval {
+		si.infof("snpersist | Sync | skipped, last sync completed at %s", last)
+
+		si.Store = store
+		so, err = syncOffline(si)
+		so.Skipped = true
+
+		return
+	}
+
+	// get dirty Items
+	var dirty []Item
+	dirty, err = store.DirtyItems()
+	endLoad(err)
+	if err != nil {
+		return
+	}
+
+	// push in the order the items were made dirty
+	sortDirty(dirty)
+
+	if err = si.preSync(dirty); err != nil {
+		return
+	}
+
+	syncToken := stored.SyncToken
+	// resume a paginated sync that was interrupted
+	cursorToken := stored.CursorToken
+
+	si.debugf("snpersist | Sync | %d dirty items | sync token: %q | cursor token: %q", len(dirty), syncToken, cursorToken)
+
 	// convert dirty to gosn.Items
 	var dirtyItemsToPush gosn.EncryptedItems
 	for _, d := range dirty {
@@ -207,59 +1105,243 @@ func Sync(si SyncInput) (so SyncOutput, err error) {
 
 	// call gosn sync with dirty items to push
 	gSI := gosn.SyncInput{
-		Session:   si.Session,
-		Items:     dirtyItemsToPush,
-		SyncToken: syncToken,
+		Session:     si.Session,
+		Items:       dirtyItemsToPush,
+		SyncToken:   syncToken,
+		CursorToken: cursorToken,
+		PageSize:    si.PageSize,
+		Debug:       si.Debug,
 	}
 
 	var gSO gosn.SyncOutput
 
-	gSO, err = gosn.Sync(gSI)
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	gSO, err = syncWithRetry(ctx, &si, gSI)
 	if err != nil {
 		return
 	}
 
-	// TODO: Remove dirty flag from DB after successful push
+	so.SavedItems = gSO.SavedItems
+	so.Unsaved = gSO.Unsaved
+	so.DB = si.DB
+	so.Store = store
+	so.Stats.Pushed = len(dirtyItemsToPush)
+	so.Stats.Saved = len(gSO.SavedItems)
+	so.Stats.Deleted = countDeleted(gSO.SavedItems)
+	so.Stats.Unsaved = len(gSO.Unsaved)
+	so.Stats.Bytes = contentSize(dirtyItemsToPush)
+	so.Stats.SyncTokenIn = syncToken
+	so.Stats.SyncTokenOut = syncToken
+
+	// dirty items returned as unsaved remain dirty and are reported as conflicts
+	unsaved := make(map[string]bool, len(gSO.Unsaved))
+	for _, u := range gSO.Unsaved {
+		unsaved[u.UUID] = true
+	}
 	for _, d := range dirty {
-		err = si.DB.UpdateField(&Item{UUID: d.UUID}, "Dirty", false)
-		if err != nil {
+		if unsaved[d.UUID] {
+			si.warnf("snpersist | Sync | conflict: %s %s was not saved by the server", d.ContentType, d.UUID)
+			so.Conflicts = append(so.Conflicts, Conflict{Local: d, Resolution: Unresolved})
+		}
+	}
+	so.Stats.Conflicted = len(so.Conflicts)
+
+	// apply results to the db, retrieving further pages whilst the server returns a cursor
+	for {
+		if err = ctx.Err(); err != nil {
 			return
 		}
-		err = si.DB.UpdateField(&Item{UUID: d.UUID}, "DirtiedDate", time.Time{})
-		if err != nil {
+
+		so.Items = append(so.Items, gSO.Items...)
+
+		si.debugf("snpersist | Sync | pulled %d items | saved %d | unsaved %d", len(gSO.Items), len(gSO.SavedItems), len(gSO.Unsaved))
+
+		var stale []Conflict
+		var pageErrors []ItemError
+		si.addKeys(gSO.Items)
+
+		if stale, pageErrors, err = persistSyncOutput(ctx, store, si, dirty, gSO); err != nil {
+			si.errorf("snpersist | Sync | failed to persist sync output: %v", err)
 			return
 		}
-	}
 
-	so.Items = gSO.Items
-	so.SavedItems = gSO.SavedItems
-	so.Unsaved = gSO.Unsaved
-	so.DB = si.DB
+		for _, c := range stale {
+			si.warnf("snpersist | Sync | conflict: dirty local copy of %s %s collided with the server's | %s", c.Local.ContentType, c.Local.UUID, c.Resolution)
+		}
 
-	// put new Items in db
-	for _, i := range gSO.Items {
-		item := Item{
-			UUID:        i.UUID,
-			Content:     i.Content,
-			ContentType: i.ContentType,
-			EncItemKey:  i.EncItemKey,
-			Deleted:     i.Deleted,
-			CreatedAt:   i.CreatedAt,
-			UpdatedAt:   i.UpdatedAt,
+		so.Conflicts = append(so.Conflicts, stale...)
+		so.Stats.Conflicted = len(so.Conflicts)
+
+		so.ItemErrors = append(so.ItemErrors, pageErrors...)
+		so.Stats.Failed = len(so.ItemErrors)
+
+		so.Stats.Pulled += len(gSO.Items)
+		so.Stats.Deleted += countDeleted(gSO.Items)
+		so.Stats.Pages++
+		so.Stats.Bytes += contentSize(gSO.Items)
+
+		// the sync token was not updated so later pages are left for the next sync to retrieve
+		if len(pageErrors) > 0 {
+			si.warnf("snpersist | Sync | stopped after %d items could not be persisted | sync token: %q", len(pageErrors), so.Stats.SyncTokenOut)
+			break
 		}
-		err = si.DB.Save(&item)
+
+		so.Stats.SyncTokenOut = gSO.SyncToken
+
+		if gSO.Cursor == "" {
+			si.infof("snpersist | Sync | complete | sync token: %q", gSO.SyncToken)
+			break
+		}
+
+		// dirty items are only pushed with the first page
+		dirty = nil
+
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		gSO, err = syncWithRetry(ctx, &si, gosn.SyncInput{
+			Session:     si.Session,
+			SyncToken:   gSO.SyncToken,
+			CursorToken: gSO.Cursor,
+			PageSize:    si.PageSize,
+			Debug:       si.Debug,
+		})
 		if err != nil {
 			return
 		}
 	}
 
-	// update sync values in db for next time
-	sv := SyncToken{
-		SyncToken: gSO.SyncToken,
+	// move items that repeatedly fail to push aside so they are not pushed with every sync
+	if si.DeadLetterAfter > 0 && si.DB != nil {
+		if so.DeadLettered, err = deadLetter(si); err != nil {
+			return
+		}
+
+		for _, d := range so.DeadLettered {
+			si.warnf("snpersist | Sync | moved %s %s to the dead letters: %s", d.ContentType, d.UUID, d.LastError)
+		}
 	}
-	if err = si.DB.Save(&sv); err != nil {
+
+	return
+}
+
+// persistSyncOutput applies the result of a gosn sync call to the store in a single transaction
+// so a failure part way through leaves the store exactly as it was before
+// conflicts between dirty local items and retrieved items are returned
+// retrieved items that cannot be persisted are returned as item errors, and the sync token is then left
+// unchanged so the next sync retrieves them again
+// the page is not committed if ctx is cancelled before the writes complete
+func persistSyncOutput(ctx context.Context, store Store, si SyncInput, dirty []Item, gSO gosn.SyncOutput) (conflicts []Conflict, itemErrors []ItemError, err error) {
+	var events []Event
+
+	err = store.Update(func(tx StoreTx) (err error) {
+		saved := make(map[string]bool, len(gSO.SavedItems))
+		for _, s := range gSO.SavedItems {
+			saved[s.UUID] = true
+		}
+
+		// remove dirty flag from pushed items the server confirmed as saved
+		// any others remain dirty so they are pushed again with the next sync
+		for _, d := range dirty {
+			if !saved[d.UUID] {
+				continue
+			}
+
+			var item Item
+
+			item, err = tx.Item(d.UUID)
+			if err != nil {
+				return
+			}
+
+			// an item changed locally since it was pushed must stay dirty so the change is pushed too
+			if item.contentHash() != d.contentHash() {
+				si.warnf("snpersist | persistSyncOutput | %s %s changed during the sync so remains dirty", item.ContentType, item.UUID)
+				continue
+			}
+
+			item.clean()
+
+			if err = tx.SaveItem(item); err != nil {
+				return
+			}
+
+			si.tracef("snpersist | persistSyncOutput | cleared dirty flag of %s %s", item.ContentType, item.UUID)
+		}
+
+		// track items the server refused to save so chronic failures can be surfaced
+		var unsavedUUIDs, savedUUIDs []string
+		for _, u := range gSO.Unsaved {
+			unsavedUUIDs = append(unsavedUUIDs, u.UUID)
+		}
+		for _, s := range gSO.SavedItems {
+			savedUUIDs = append(savedUUIDs, s.UUID)
+		}
+
+		if err = recordUnsaved(tx, unsavedUUIDs); err != nil {
+			return
+		}
+
+		if err = resetUnsaved(tx, savedUUIDs); err != nil {
+			return
+		}
+
+		// the server has confirmed these deletions so there is no need to keep them
+		for _, s := range gSO.SavedItems {
+			if !s.Deleted {
+				continue
+			}
+
+			if err = tx.DeleteItem(s.UUID); err != nil {
+				return
+			}
+
+			if err = removeIndexes(tx, s.UUID); err != nil {
+				return
+			}
+
+			si.tracef("snpersist | persistSyncOutput | removed %s %s following confirmed deletion", s.ContentType, s.UUID)
+		}
+
+		// put new Items in store
+		_, endPersist := si.startSpan(ctx, "persist-items")
+		conflicts, events, itemErrors, err = saveItems(tx, si, gSO.Items)
+		endPersist(err)
+		if err != nil {
+			return
+		}
+
+		if len(itemErrors) > 0 {
+			si.warnf("snpersist | persistSyncOutput | %d items not persisted so sync token not updated", len(itemErrors))
+
+			return ctx.Err()
+		}
+
+		// update sync values in store for next time
+		_, endToken := si.startSpan(ctx, "update-token")
+		err = tx.SaveSyncToken(SyncToken{SyncToken: gSO.SyncToken, CursorToken: gSO.Cursor})
+		endToken(err)
+		if err != nil {
+			return
+		}
+
+		si.tracef("snpersist | persistSyncOutput | saved sync token: %q | cursor token: %q", gSO.SyncToken, gSO.Cursor)
+
+		// a cancellation whilst the page was being written discards it
+		return ctx.Err()
+	})
+	if err != nil {
+		conflicts = nil
+		itemErrors = nil
+
 		return
 	}
 
+	si.Events.publish(events...)
+
 	return
 }
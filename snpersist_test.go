@@ -1,9 +1,20 @@
 package snpersist
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/asdine/storm/v3"
 	"github.com/jonhadfield/gosn-v2"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -111,6 +122,10 @@ func TestSyncWithNewNote(t *testing.T) {
 	assert.Len(t, so.SavedItems, 1)
 	assert.Equal(t, newNote.UUID, so.SavedItems[0].UUID)
 	assert.Equal(t, "Note", so.SavedItems[0].ContentType)
+	assert.Equal(t, 1, so.Stats.Pushed)
+	assert.Equal(t, 1, so.Stats.Saved)
+	assert.Zero(t, so.Stats.Conflicted)
+	assert.NotEmpty(t, so.Stats.SyncTokenOut)
 
 	assert.NoError(t, so.DB.All(&allPersistedItems))
 	var foundNonDirtyNote bool
@@ -203,3 +218,726 @@ func TestSyncOneExisting(t *testing.T) {
 	}
 	assert.Equal(t, 1, foundNotes)
 }
+
+// a failure saving one of the pulled items should not prevent the rest being saved, but should keep the sync token
+func TestPersistSyncOutputItemErrors(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	dirtyItem := Item{UUID: "dirty", ContentType: "Note", Dirty: true, DirtiedDate: time.Now()}
+	assert.NoError(t, db.Save(&dirtyItem))
+	assert.NoError(t, db.Save(&SyncToken{SyncToken: "before"}))
+
+	// the third pulled item has no UUID so cannot be saved
+	gSO := gosn.SyncOutput{
+		Items: gosn.EncryptedItems{
+			{UUID: "pulled-1", ContentType: "Note"},
+			{UUID: "pulled-2", ContentType: "Note"},
+			{UUID: "", ContentType: "Note"},
+		},
+		SavedItems: gosn.EncryptedItems{{UUID: "dirty", ContentType: "Note"}},
+		SyncToken:  "after",
+	}
+
+	var itemErrors []ItemError
+	_, itemErrors, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, []Item{dirtyItem}, gSO)
+	assert.NoError(t, err)
+	assert.Len(t, itemErrors, 1)
+	assert.Equal(t, "", itemErrors[0].UUID)
+	assert.Error(t, itemErrors[0].Err)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "dirty", &stored))
+	assert.False(t, stored.Dirty)
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 3)
+
+	var syncTokens []SyncToken
+	assert.NoError(t, db.All(&syncTokens))
+	assert.Len(t, syncTokens, 1)
+	assert.Equal(t, "before", syncTokens[0].SyncToken)
+
+	// without the bad item everything is applied
+	gSO.Items = gSO.Items[:2]
+	_, itemErrors, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, []Item{dirtyItem}, gSO)
+	assert.NoError(t, err)
+	assert.Empty(t, itemErrors)
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 3)
+	assert.NoError(t, db.All(&syncTokens))
+	assert.Len(t, syncTokens, 1)
+	assert.Equal(t, "after", syncTokens[0].SyncToken)
+}
+
+// create a note in SN, then mark it deleted and dirty in the DB
+// after a persist Sync the deletion should be pushed to SN and the note removed from the DB
+func TestSyncDeletedNote(t *testing.T) {
+	sOutput, err := gosn.SignIn(sInput)
+	assert.NoError(t, err, "sign-in failed", err)
+
+	defer cleanup(&sOutput.Session)
+
+	// create new note and push to SN
+	newNote, _ := createNote("test", "")
+	dItems := gosn.Items{&newNote}
+	var eItems gosn.EncryptedItems
+	eItems, err = dItems.Encrypt(sOutput.Session.Mk, sOutput.Session.Ak, true)
+	assert.NoError(t, err)
+
+	_, err = gosn.Sync(gosn.SyncInput{
+		Session: sOutput.Session,
+		Items:   eItems,
+	})
+	assert.NoError(t, err)
+
+	// populate DB
+	var so SyncOutput
+	so, err = Sync(SyncInput{
+		Session: sOutput.Session,
+		DBPath:  tempDBPath,
+	})
+	assert.NoError(t, err)
+
+	defer so.DB.Close()
+	defer removeDB(tempDBPath)
+
+	// delete the note locally
+	newNote.Deleted = true
+	newNote.Content = *gosn.NewNoteContent()
+	eItems, err = dItems.Encrypt(sOutput.Session.Mk, sOutput.Session.Ak, true)
+	assert.NoError(t, err)
+
+	for _, i := range ConvertItemsToPersistItems(eItems) {
+		i.Dirty = true
+		i.DirtiedDate = time.Now()
+		assert.NoError(t, so.DB.Save(&i))
+	}
+
+	so, err = Sync(SyncInput{
+		Session: sOutput.Session,
+		DB:      so.DB,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, so.SavedItems, 1)
+	assert.True(t, so.SavedItems[0].Deleted)
+	assert.Equal(t, 1, so.Stats.Deleted)
+
+	var persisted Item
+	err = so.DB.One("UUID", newNote.UUID, &persisted)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not found")
+}
+
+func TestPersistSyncOutputRemovesDeleted(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	dirtyItem := Item{UUID: "deleted-locally", ContentType: "Note", Deleted: true, Dirty: true, DirtiedDate: time.Now()}
+	assert.NoError(t, db.Save(&dirtyItem))
+	assert.NoError(t, db.Save(&Item{UUID: "deleted-remotely", ContentType: "Note"}))
+
+	gSO := gosn.SyncOutput{
+		Items:      gosn.EncryptedItems{{UUID: "deleted-remotely", ContentType: "Note", Deleted: true}},
+		SavedItems: gosn.EncryptedItems{{UUID: "deleted-locally", ContentType: "Note", Deleted: true}},
+		SyncToken:  "after",
+	}
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, []Item{dirtyItem}, gSO)
+	assert.NoError(t, err)
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Empty(t, all)
+}
+
+// push a note to SN, update it in SN, then push the stale version via persist Sync
+// the stale version should be reported as a conflict and remain dirty
+func TestSyncStaleNoteRemainsDirty(t *testing.T) {
+	sOutput, err := gosn.SignIn(sInput)
+	assert.NoError(t, err, "sign-in failed", err)
+
+	defer cleanup(&sOutput.Session)
+
+	newNote, _ := createNote("test", "")
+	dItems := gosn.Items{&newNote}
+	var staleItems gosn.EncryptedItems
+	staleItems, err = dItems.Encrypt(sOutput.Session.Mk, sOutput.Session.Ak, true)
+	assert.NoError(t, err)
+
+	var gSO gosn.SyncOutput
+	gSO, err = gosn.Sync(gosn.SyncInput{
+		Session: sOutput.Session,
+		Items:   staleItems,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, gSO.SavedItems, 1)
+
+	// update the note in SN so the local copy is stale
+	updated := gSO.SavedItems
+	_, err = gosn.Sync(gosn.SyncInput{
+		Session: sOutput.Session,
+		Items:   updated,
+	})
+	assert.NoError(t, err)
+
+	var so SyncOutput
+	so, err = Sync(SyncInput{
+		Session: sOutput.Session,
+		DBPath:  tempDBPath,
+	})
+	assert.NoError(t, err)
+
+	defer so.DB.Close()
+	defer removeDB(tempDBPath)
+
+	for _, i := range ConvertItemsToPersistItems(staleItems) {
+		i.Dirty = true
+		i.DirtiedDate = time.Now()
+		assert.NoError(t, so.DB.Save(&i))
+	}
+
+	so, err = Sync(SyncInput{
+		Session: sOutput.Session,
+		DB:      so.DB,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, so.Conflicts, 1)
+	assert.Equal(t, newNote.UUID, so.Conflicts[0].Local.UUID)
+	assert.Equal(t, Unresolved, so.Conflicts[0].Resolution)
+
+	var persisted Item
+	assert.NoError(t, so.DB.One("UUID", newNote.UUID, &persisted))
+	assert.True(t, persisted.Dirty)
+}
+
+func TestPersistSyncOutputKeepsUnsavedDirty(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	saved := Item{UUID: "saved", ContentType: "Note", Dirty: true, DirtiedDate: time.Now()}
+	conflicted := Item{UUID: "conflicted", ContentType: "Note", Dirty: true, DirtiedDate: time.Now()}
+	assert.NoError(t, db.Save(&saved))
+	assert.NoError(t, db.Save(&conflicted))
+
+	gSO := gosn.SyncOutput{
+		SavedItems: gosn.EncryptedItems{{UUID: "saved", ContentType: "Note"}},
+		Unsaved:    gosn.EncryptedItems{{UUID: "conflicted", ContentType: "Note"}},
+		SyncToken:  "after",
+	}
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, []Item{saved, conflicted}, gSO)
+	assert.NoError(t, err)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "saved", &stored))
+	assert.False(t, stored.Dirty)
+	assert.NoError(t, db.One("UUID", "conflicted", &stored))
+	assert.True(t, stored.Dirty)
+	assert.Equal(t, 1, stored.UnsavedCount)
+}
+
+func TestSyncOffline(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note"}))
+	assert.NoError(t, db.Save(&SyncToken{SyncToken: "token"}))
+	assert.NoError(t, db.Close())
+
+	// no session is required
+	var so SyncOutput
+	so, err = Sync(SyncInput{DBPath: tempDBPath, Offline: true})
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	assert.Len(t, so.Items, 1)
+	assert.Equal(t, "a", so.Items[0].UUID)
+
+	var syncTokens []SyncToken
+	assert.NoError(t, so.DB.All(&syncTokens))
+	assert.Len(t, syncTokens, 1)
+	assert.Equal(t, "token", syncTokens[0].SyncToken)
+}
+
+// a DB locked by another handle should fail to open within the timeout rather than block
+func TestSyncWithDBOptionsTimeout(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = Sync(SyncInput{
+		DBPath:    tempDBPath,
+		Offline:   true,
+		DBOptions: []func(*storm.Options) error{storm.BoltOptions(0600, &bolt.Options{Timeout: 100 * time.Millisecond})},
+	})
+	assert.Error(t, err)
+}
+
+func TestSyncWithCancelledContext(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = SyncWithContext(ctx, SyncInput{
+		Session: offlineSession(),
+		DB:      db,
+	})
+	assert.Equal(t, context.Canceled, err)
+}
+
+// a page whose context is cancelled before it is committed should leave the DB untouched
+func TestPersistSyncOutputCancelled(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err = persistSyncOutput(ctx, &StormStore{db: db}, SyncInput{DB: db}, nil, gosn.SyncOutput{
+		Items:     gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}},
+		SyncToken: "token",
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	var count int
+	count, err = db.Count(&Item{})
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	var st SyncToken
+	st, err = getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Empty(t, st.SyncToken)
+}
+
+func TestGetSyncTokenRecoversFromDuplicates(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	// no token stored
+	var st SyncToken
+	st, err = getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Empty(t, st.SyncToken)
+
+	assert.NoError(t, db.Save(&SyncToken{SyncToken: "older", SavedAt: time.Now().Add(-time.Hour)}))
+	assert.NoError(t, db.Save(&SyncToken{SyncToken: "newer", SavedAt: time.Now()}))
+
+	st, err = getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "newer", st.SyncToken)
+
+	var syncTokens []SyncToken
+	assert.NoError(t, db.All(&syncTokens))
+	assert.Len(t, syncTokens, 1)
+	assert.Equal(t, "newer", syncTokens[0].SyncToken)
+}
+
+// a locally dirty note that is newer than the retrieved copy should be preserved
+func TestPersistSyncOutputKeepsNewerDirty(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	local := Item{
+		UUID:        "note",
+		ContentType: "Note",
+		Content:     "local",
+		UpdatedAt:   "2020-05-20T10:00:00.000Z",
+		Dirty:       true,
+		DirtiedDate: time.Now(),
+	}
+	assert.NoError(t, db.Save(&local))
+
+	gSO := gosn.SyncOutput{
+		Items:     gosn.EncryptedItems{{UUID: "note", ContentType: "Note", Content: "remote", UpdatedAt: "2020-05-19T10:00:00.000Z"}},
+		SyncToken: "after",
+	}
+
+	var conflicts []Conflict
+	conflicts, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, nil, gSO)
+	assert.NoError(t, err)
+	assert.Len(t, conflicts, 1)
+	assert.Equal(t, "note", conflicts[0].Local.UUID)
+	assert.Equal(t, "local", conflicts[0].Local.Content)
+	assert.Equal(t, "remote", conflicts[0].Remote.Content)
+	assert.Equal(t, KeptLocal, conflicts[0].Resolution)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "note", &stored))
+	assert.Equal(t, "local", stored.Content)
+	assert.True(t, stored.Dirty)
+}
+
+func TestSyncLogger(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var buf bytes.Buffer
+	_, err = SyncWithContext(ctx, SyncInput{
+		Session: offlineSession(),
+		DB:      db,
+		Logger:  log.New(&buf, "", 0),
+	})
+	assert.Error(t, err)
+	assert.Contains(t, buf.String(), "1 dirty items")
+}
+
+// levelRecorder records the level of each message it receives
+type levelRecorder struct {
+	messages map[string][]string
+}
+
+func (l *levelRecorder) record(level, format string, v ...interface{}) {
+	if l.messages == nil {
+		l.messages = make(map[string][]string)
+	}
+
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, v...))
+}
+
+func (l *levelRecorder) Debugf(format string, v ...interface{}) { l.record("debug", format, v...) }
+func (l *levelRecorder) Infof(format string, v ...interface{})  { l.record("info", format, v...) }
+func (l *levelRecorder) Warnf(format string, v ...interface{})  { l.record("warn", format, v...) }
+func (l *levelRecorder) Errorf(format string, v ...interface{}) { l.record("error", format, v...) }
+
+func TestSyncLevelLogger(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveItem(Item{UUID: "a", ContentType: "Note", Dirty: true})
+	}))
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{
+		Unsaved:   gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}},
+		SyncToken: "token",
+	}}}
+
+	var rec levelRecorder
+
+	_, err := Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs, Logger: Leveled(&rec)})
+	assert.NoError(t, err)
+
+	assert.Contains(t, rec.messages["debug"][0], "1 dirty items")
+	assert.Contains(t, rec.messages["warn"][0], "was not saved by the server")
+	assert.Contains(t, rec.messages["info"][0], "complete")
+	assert.Empty(t, rec.messages["error"])
+}
+
+// a failure applying an item of a later page should keep the cursor of the pages already committed
+func TestPersistSyncOutputPagesAreIndependent(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	pageOne := gosn.SyncOutput{
+		Items:     gosn.EncryptedItems{{UUID: "page-1", ContentType: "Note"}},
+		SyncToken: "token-1",
+		Cursor:    "cursor-1",
+	}
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, nil, pageOne)
+	assert.NoError(t, err)
+
+	pageTwo := gosn.SyncOutput{
+		Items:     gosn.EncryptedItems{{UUID: "page-2", ContentType: "Note"}, {UUID: "", ContentType: "Note"}},
+		SyncToken: "token-2",
+	}
+	var itemErrors []ItemError
+	_, itemErrors, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, nil, pageTwo)
+	assert.NoError(t, err)
+	assert.Len(t, itemErrors, 1)
+
+	var all []Item
+	assert.NoError(t, db.All(&all))
+	assert.Len(t, all, 2)
+
+	var st SyncToken
+	st, err = getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", st.SyncToken)
+	assert.Equal(t, "cursor-1", st.CursorToken)
+}
+
+// dirty items missing from both SavedItems and Unsaved should remain dirty
+func TestPersistSyncOutputOnlyClearsSaved(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	saved := Item{UUID: "saved", ContentType: "Note", Dirty: true, DirtiedDate: time.Now()}
+	missing := Item{UUID: "missing", ContentType: "Note", Dirty: true, DirtiedDate: time.Now()}
+	assert.NoError(t, db.Save(&saved))
+	assert.NoError(t, db.Save(&missing))
+
+	gSO := gosn.SyncOutput{
+		SavedItems: gosn.EncryptedItems{{UUID: "saved", ContentType: "Note"}},
+		SyncToken:  "after",
+	}
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, []Item{saved, missing}, gSO)
+	assert.NoError(t, err)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "saved", &stored))
+	assert.False(t, stored.Dirty)
+	assert.NoError(t, db.One("UUID", "missing", &stored))
+	assert.True(t, stored.Dirty)
+}
+
+func TestPersistSyncOutputKeepsRedirtied(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	// the pushed copy was edited again before SN confirmed it
+	pushed := Item{UUID: "a", ContentType: "Note", Content: "first", Dirty: true, DirtiedDate: time.Now()}
+	edited := pushed
+	edited.Content = "second"
+	assert.NoError(t, db.Save(&edited))
+
+	gSO := gosn.SyncOutput{
+		SavedItems: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}},
+		SyncToken:  "after",
+	}
+	_, _, err = persistSyncOutput(context.Background(), &StormStore{db: db}, SyncInput{DB: db}, []Item{pushed}, gSO)
+	assert.NoError(t, err)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "a", &stored))
+	assert.True(t, stored.Dirty)
+	assert.Equal(t, "second", stored.Content)
+}
+
+func TestSyncHooks(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveItem(Item{UUID: "a", ContentType: "Note", Dirty: true})
+	}))
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{
+		SavedItems: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}},
+		SyncToken:  "token",
+	}}}
+
+	var preDirty []Item
+	var post SyncOutput
+
+	_, err := Sync(SyncInput{
+		Session: offlineSession(),
+		Store:   store,
+		Syncer:  fs,
+		PreSyncHook: func(dirty []Item) error {
+			preDirty = dirty
+			return nil
+		},
+		PostSyncHook: func(so SyncOutput) {
+			post = so
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, preDirty, 1)
+	assert.Equal(t, "a", preDirty[0].UUID)
+	assert.Equal(t, 1, post.Stats.Saved)
+	assert.Equal(t, "token", post.Stats.SyncTokenOut)
+
+	// an error from the pre-sync hook aborts the sync before SN is called
+	hookErr := errors.New("backup failed")
+	postCalled := false
+
+	_, err = Sync(SyncInput{
+		Session: offlineSession(),
+		Store:   store,
+		Syncer:  fs,
+		PreSyncHook: func(dirty []Item) error {
+			return hookErr
+		},
+		PostSyncHook: func(so SyncOutput) {
+			postCalled = true
+		},
+	})
+	assert.Equal(t, hookErr, err)
+	assert.Len(t, fs.inputs, 1)
+	assert.False(t, postCalled)
+}
+
+func TestSyncMinInterval(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		if err := tx.SaveItem(Item{UUID: "a", ContentType: "Note", Dirty: true}); err != nil {
+			return err
+		}
+
+		return tx.SaveSyncToken(SyncToken{SyncToken: "token-1"})
+	}))
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token-2"}}}
+
+	so, err := Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs, MinInterval: time.Hour})
+	assert.NoError(t, err)
+	assert.True(t, so.Skipped)
+	assert.Len(t, so.Items, 1)
+	assert.Empty(t, fs.inputs)
+
+	time.Sleep(time.Millisecond)
+
+	so, err = Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs, MinInterval: time.Millisecond})
+	assert.NoError(t, err)
+	assert.False(t, so.Skipped)
+	assert.Len(t, fs.inputs, 1)
+	assert.Len(t, fs.inputs[0].Items, 1)
+}
+
+func TestSyncIfStale(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	var last time.Time
+	last, err = LastSyncTime(db)
+	assert.NoError(t, err)
+	assert.True(t, last.IsZero())
+
+	// an interrupted paginated sync has not completed
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token-1", CursorToken: "cursor-1"}))
+	last, err = LastSyncTime(db)
+	assert.NoError(t, err)
+	assert.True(t, last.IsZero())
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token-2"}}}
+
+	so, err := SyncIfStale(SyncInput{Session: offlineSession(), DB: db, Syncer: fs}, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, so.Skipped)
+	assert.Len(t, fs.inputs, 1)
+
+	last, err = LastSyncTime(db)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), last, time.Minute)
+
+	so, err = SyncIfStale(SyncInput{Session: offlineSession(), DB: db, Syncer: fs}, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, so.Skipped)
+	assert.Len(t, fs.inputs, 1)
+}
+
+func TestSyncDebug(t *testing.T) {
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-1"},
+		{Items: gosn.EncryptedItems{{UUID: "b", ContentType: "Note"}}, SyncToken: "token-2"},
+	}}
+
+	var buf bytes.Buffer
+
+	_, err := Sync(SyncInput{Session: offlineSession(), Store: NewMemoryStore(), Syncer: fs, Logger: log.New(&buf, "", 0)})
+	assert.NoError(t, err)
+	assert.False(t, fs.inputs[0].Debug)
+	assert.NotContains(t, buf.String(), "saved Note a")
+
+	_, err = Sync(SyncInput{Session: offlineSession(), Store: NewMemoryStore(), Syncer: fs, Logger: log.New(&buf, "", 0), Debug: true})
+	assert.NoError(t, err)
+	assert.True(t, fs.inputs[1].Debug)
+	assert.Contains(t, buf.String(), "saved Note b")
+	assert.Contains(t, buf.String(), `saved sync token: "token-2"`)
+}
+
+func TestOpenLocked(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+
+	// bolt locks the file so a second open waits for the first to close, for as long as the options set
+	start := time.Now()
+	_, err = Open(tempDBPath, storm.BoltOptions(0600, &bolt.Options{Timeout: 10 * time.Millisecond}))
+	assert.True(t, errors.Is(err, ErrDBLocked))
+	assert.True(t, time.Since(start) < openTimeout/2)
+
+	var locked DBLockedError
+	assert.True(t, errors.As(err, &locked))
+	assert.Equal(t, os.Getpid(), locked.PID)
+	assert.Contains(t, err.Error(), strconv.Itoa(os.Getpid()))
+
+	assert.NoError(t, db.Close())
+
+	db, err = Open(tempDBPath)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+}
+
+func TestBoltTimeout(t *testing.T) {
+	assert.Equal(t, openTimeout, boltTimeout())
+	assert.Equal(t, openTimeout, boltTimeout(storm.Codec(GzipCodec), storm.BoltOptions(0600, nil)))
+	assert.Equal(t, time.Minute, boltTimeout(storm.BoltOptions(0600, &bolt.Options{Timeout: time.Minute}), storm.Batch()))
+	assert.Zero(t, boltTimeout(storm.BoltOptions(0600, &bolt.Options{})))
+}
+
+func TestLockHolder(t *testing.T) {
+	defer os.Remove(tempDBPath + lockFileSuffix)
+
+	assert.Zero(t, lockHolder(tempDBPath))
+
+	assert.NoError(t, writeLockFile(tempDBPath))
+	assert.Equal(t, os.Getpid(), lockHolder(tempDBPath))
+
+	// a holder that has exited is not reported
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	assert.NoError(t, exited.Run())
+	assert.NoError(t, ioutil.WriteFile(tempDBPath+lockFileSuffix, []byte(strconv.Itoa(exited.Process.Pid)), 0600))
+	assert.Zero(t, lockHolder(tempDBPath))
+
+	assert.NoError(t, ioutil.WriteFile(tempDBPath+lockFileSuffix, []byte("unknown"), 0600))
+	assert.Zero(t, lockHolder(tempDBPath))
+}
+
+func TestSyncCreatesDBDir(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "snpersist-dir-test")
+	defer os.RemoveAll(dir)
+
+	si := SyncInput{
+		Session:    offlineSession(),
+		DBPath:     filepath.Join(dir, "nested", "sn.db"),
+		DBFileMode: 0640,
+		Syncer:     &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token"}}},
+	}
+
+	// a missing directory is reported rather than created unless requested
+	_, err := Sync(si)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Contains(t, err.Error(), "DB directory")
+
+	si.CreateDBDir = true
+
+	so, err := Sync(si)
+	assert.NoError(t, err)
+	assert.NoError(t, so.DB.Close())
+
+	info, err := os.Stat(si.DBPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
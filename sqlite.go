@@ -0,0 +1,398 @@
+package snpersist
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// statements creating the SQLite schema, safe to run against an existing DB
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS items (
+		uuid TEXT PRIMARY KEY,
+		content TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		enc_item_key TEXT NOT NULL,
+		deleted INTEGER NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		dirty INTEGER NOT NULL,
+		dirtied_date INTEGER NOT NULL,
+		unsaved_count INTEGER NOT NULL,
+		conflict_of TEXT NOT NULL DEFAULT '',
+		base_content TEXT NOT NULL DEFAULT '',
+		base_enc_item_key TEXT NOT NULL DEFAULT '',
+		last_error TEXT NOT NULL DEFAULT '',
+		dirty_seq INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS items_content_type ON items (content_type)`,
+	`CREATE INDEX IF NOT EXISTS items_dirty ON items (dirty)`,
+	`CREATE TABLE IF NOT EXISTS sync_tokens (
+		sync_token TEXT PRIMARY KEY,
+		cursor_token TEXT NOT NULL,
+		saved_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS refs (
+		parent TEXT NOT NULL,
+		child TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		PRIMARY KEY (parent, child)
+	)`,
+	`CREATE INDEX IF NOT EXISTS refs_child ON refs (child)`,
+	`CREATE TABLE IF NOT EXISTS search_terms (
+		term TEXT NOT NULL,
+		uuid TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (term, uuid)
+	)`,
+	`CREATE INDEX IF NOT EXISTS search_terms_uuid ON search_terms (uuid)`,
+	`CREATE TABLE IF NOT EXISTS sequences (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS titles (
+		uuid TEXT PRIMARY KEY,
+		content_type TEXT NOT NULL,
+		title TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS quarantine (
+		uuid TEXT PRIMARY KEY,
+		item TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		at INTEGER NOT NULL
+	)`,
+}
+
+// columns added to tables created by earlier versions
+var sqliteAddedColumns = []struct {
+	table, column, definition string
+}{
+	{"items", "conflict_of", "TEXT NOT NULL DEFAULT ''"},
+	{"items", "base_content", "TEXT NOT NULL DEFAULT ''"},
+	{"items", "base_enc_item_key", "TEXT NOT NULL DEFAULT ''"},
+	{"items", "last_error", "TEXT NOT NULL DEFAULT ''"},
+	{"items", "dirty_seq", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+const sqliteItemColumns = `uuid, content, content_type, enc_item_key, deleted, created_at, updated_at, dirty, dirtied_date, unsaved_count, conflict_of, base_content, base_enc_item_key, last_error, dirty_seq`
+
+// SQLiteStore is a Store backed by a SQLite DB
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore creates the tables and indexes used to store items, if they do not already exist, and returns a Store
+// db must have been opened with a SQLite driver, e.g. github.com/mattn/go-sqlite3
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	// columns added after the items table was first created
+	for _, c := range sqliteAddedColumns {
+		if err := addSQLiteColumn(db, c.table, c.column, c.definition); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// addSQLiteColumn adds a column to a table created by an earlier version, if it is missing
+func addSQLiteColumn(db *sql.DB, table, column, definition string) (err error) {
+	var rows *sql.Rows
+
+	rows, err = db.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return
+		}
+
+		if name == column {
+			return
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+
+	return
+}
+
+// DB returns the underlying SQL DB
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLiteStore) AllItems() ([]Item, error) {
+	return querySQLiteItems(s.db, `SELECT `+sqliteItemColumns+` FROM items`)
+}
+
+func (s *SQLiteStore) DirtyItems() ([]Item, error) {
+	return querySQLiteItems(s.db, `SELECT `+sqliteItemColumns+` FROM items WHERE dirty = 1`)
+}
+
+func (s *SQLiteStore) SyncToken() (st SyncToken, err error) {
+	var savedAt int64
+
+	err = s.db.QueryRow(`SELECT sync_token, cursor_token, saved_at FROM sync_tokens ORDER BY saved_at DESC LIMIT 1`).
+		Scan(&st.SyncToken, &st.CursorToken, &savedAt)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = nil
+	case err != nil:
+		err = wrapError(ErrSyncTokenCorrupt, err)
+	default:
+		st.SavedAt = time.Unix(0, savedAt)
+	}
+
+	return
+}
+
+func (s *SQLiteStore) Quarantined() (quarantined []QuarantinedItem, err error) {
+	var rows *sql.Rows
+
+	rows, err = s.db.Query(`SELECT uuid, item, reason, at FROM quarantine`)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var q QuarantinedItem
+		var item string
+		var at int64
+
+		if err = rows.Scan(&q.UUID, &item, &q.Reason, &at); err != nil {
+			return
+		}
+
+		if err = json.Unmarshal([]byte(item), &q.Item); err != nil {
+			return
+		}
+
+		q.At = time.Unix(0, at)
+		quarantined = append(quarantined, q)
+	}
+
+	err = rows.Err()
+
+	return
+}
+
+func (s *SQLiteStore) Update(fn func(tx StoreTx) error) (err error) {
+	var tx *sql.Tx
+
+	tx, err = s.db.Begin()
+	if err != nil {
+		return
+	}
+
+	if err = fn(sqliteTx{tx: tx}); err != nil {
+		_ = tx.Rollback()
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// sqliteTx implements StoreTx for a SQL transaction
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+func (t sqliteTx) Item(uuid string) (item Item, err error) {
+	var items []Item
+
+	items, err = querySQLiteItems(t.tx, `SELECT `+sqliteItemColumns+` FROM items WHERE uuid = ?`, uuid)
+	if err != nil {
+		return
+	}
+
+	if len(items) == 0 {
+		return item, ErrItemNotFound
+	}
+
+	return items[0], nil
+}
+
+func (t sqliteTx) SaveItem(item Item) (err error) {
+	if err = item.sequence(t.nextDirtySeq); err != nil {
+		return
+	}
+
+	var dirtiedDate int64
+	if !item.DirtiedDate.IsZero() {
+		dirtiedDate = item.DirtiedDate.UnixNano()
+	}
+
+	_, err = t.tx.Exec(`INSERT OR REPLACE INTO items (`+sqliteItemColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.UUID, item.Content, item.ContentType, item.EncItemKey, item.Deleted, item.CreatedAt, item.UpdatedAt,
+		item.Dirty, dirtiedDate, item.UnsavedCount, item.ConflictOf,
+		item.BaseContent, item.BaseEncItemKey, item.LastError, item.DirtySeq)
+
+	return
+}
+
+// nextDirtySeq increments and returns the DB's dirty sequence number
+func (t sqliteTx) nextDirtySeq() (seq uint64, err error) {
+	_, err = t.tx.Exec(`INSERT INTO sequences (name, value) VALUES ('dirty', 1)
+		ON CONFLICT (name) DO UPDATE SET value = value + 1`)
+	if err != nil {
+		return
+	}
+
+	err = t.tx.QueryRow(`SELECT value FROM sequences WHERE name = 'dirty'`).Scan(&seq)
+
+	return
+}
+
+func (t sqliteTx) DeleteItem(uuid string) (err error) {
+	_, err = t.tx.Exec(`DELETE FROM items WHERE uuid = ?`, uuid)
+
+	return
+}
+
+func (t sqliteTx) SaveSyncToken(st SyncToken) (err error) {
+	if _, err = t.tx.Exec(`DELETE FROM sync_tokens`); err != nil {
+		return
+	}
+
+	_, err = t.tx.Exec(`INSERT INTO sync_tokens (sync_token, cursor_token, saved_at) VALUES (?, ?, ?)`,
+		st.SyncToken, st.CursorToken, time.Now().UnixNano())
+
+	return
+}
+
+func (t sqliteTx) SaveTitle(entry TitleEntry) (err error) {
+	_, err = t.tx.Exec(`INSERT OR REPLACE INTO titles (uuid, content_type, title) VALUES (?, ?, ?)`,
+		entry.UUID, entry.ContentType, entry.Title)
+
+	return
+}
+
+func (t sqliteTx) DeleteTitle(uuid string) (err error) {
+	_, err = t.tx.Exec(`DELETE FROM titles WHERE uuid = ?`, uuid)
+
+	return
+}
+
+func (t sqliteTx) SetReferences(parent string, refs []Reference) (err error) {
+	if _, err = t.tx.Exec(`DELETE FROM refs WHERE parent = ?`, parent); err != nil {
+		return
+	}
+
+	for _, r := range refs {
+		_, err = t.tx.Exec(`INSERT OR REPLACE INTO refs (parent, child, content_type) VALUES (?, ?, ?)`,
+			r.Parent, r.Child, r.ContentType)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (t sqliteTx) DeleteReferencesTo(child string) (err error) {
+	_, err = t.tx.Exec(`DELETE FROM refs WHERE child = ?`, child)
+
+	return
+}
+
+func (t sqliteTx) SetSearchTerms(uuid string, terms map[string]int) (err error) {
+	if _, err = t.tx.Exec(`DELETE FROM search_terms WHERE uuid = ?`, uuid); err != nil {
+		return
+	}
+
+	for term, count := range terms {
+		_, err = t.tx.Exec(`INSERT INTO search_terms (term, uuid, count) VALUES (?, ?, ?)`, term, uuid, count)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (t sqliteTx) Quarantine(q QuarantinedItem) (err error) {
+	var item []byte
+
+	if item, err = json.Marshal(q.Item); err != nil {
+		return
+	}
+
+	_, err = t.tx.Exec(`INSERT OR REPLACE INTO quarantine (uuid, item, reason, at) VALUES (?, ?, ?, ?)`,
+		q.UUID, string(item), q.Reason, q.At.UnixNano())
+
+	return
+}
+
+func (t sqliteTx) Unquarantine(uuid string) (err error) {
+	_, err = t.tx.Exec(`DELETE FROM quarantine WHERE uuid = ?`, uuid)
+
+	return
+}
+
+// sqliteQueryer is satisfied by both *sql.DB and *sql.Tx
+type sqliteQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// querySQLiteItems returns the items selected by query
+func querySQLiteItems(q sqliteQueryer, query string, args ...interface{}) (items []Item, err error) {
+	var rows *sql.Rows
+
+	rows, err = q.Query(query, args...)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var item Item
+		var dirtiedDate int64
+
+		err = rows.Scan(&item.UUID, &item.Content, &item.ContentType, &item.EncItemKey, &item.Deleted,
+			&item.CreatedAt, &item.UpdatedAt, &item.Dirty, &dirtiedDate, &item.UnsavedCount, &item.ConflictOf,
+			&item.BaseContent, &item.BaseEncItemKey, &item.LastError, &item.DirtySeq)
+		if err != nil {
+			return
+		}
+
+		if dirtiedDate != 0 {
+			item.DirtiedDate = time.Unix(0, dirtiedDate)
+		}
+
+		// the derived fields are not stored
+		item.derive()
+
+		items = append(items, item)
+	}
+
+	err = rows.Err()
+
+	return
+}
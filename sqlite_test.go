@@ -0,0 +1,61 @@
+package snpersist
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	var store *SQLiteStore
+	store, err = NewSQLiteStore(db)
+	assert.NoError(t, err)
+
+	testStore(t, store)
+
+	// creating the schema again is harmless
+	_, err = NewSQLiteStore(db)
+	assert.NoError(t, err)
+}
+
+func TestSQLiteStoreAddsColumns(t *testing.T) {
+	db, err := sql.Open("sqlite3", tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	// an items table created before conflict_of was added
+	_, err = db.Exec(`CREATE TABLE items (
+		uuid TEXT PRIMARY KEY,
+		content TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		enc_item_key TEXT NOT NULL,
+		deleted INTEGER NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		dirty INTEGER NOT NULL,
+		dirtied_date INTEGER NOT NULL,
+		unsaved_count INTEGER NOT NULL
+	)`)
+	assert.NoError(t, err)
+
+	var store *SQLiteStore
+	store, err = NewSQLiteStore(db)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveItem(Item{UUID: "b", ContentType: "Note", ConflictOf: "a"})
+	}))
+
+	var items []Item
+	items, err = store.AllItems()
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "a", items[0].ConflictOf)
+}
@@ -0,0 +1,274 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+)
+
+// Store is the storage Sync reads dirty items from and applies the results of each sync call to
+// StormStore is used by default, alternative backends can be provided with SyncInput.Store
+type Store interface {
+	// AllItems returns every stored item, including those flagged as deleted
+	AllItems() ([]Item, error)
+	// DirtyItems returns the items waiting to be pushed to SN
+	DirtyItems() ([]Item, error)
+	// SyncToken returns the token saved by the previous sync, or an empty token if there has not been one
+	SyncToken() (SyncToken, error)
+	// Quarantined returns the retrieved items set aside as they failed validation
+	Quarantined() ([]QuarantinedItem, error)
+	// Update calls fn within a single read-write transaction that is discarded if fn returns an error
+	Update(fn func(tx StoreTx) error) error
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// StoreTx is the set of operations available within a Store transaction
+type StoreTx interface {
+	// Item returns the item with the given UUID or ErrItemNotFound
+	Item(uuid string) (Item, error)
+	// SaveItem inserts or replaces an item
+	SaveItem(item Item) error
+	// DeleteItem removes an item, ignoring items that do not exist
+	DeleteItem(uuid string) error
+	// SaveSyncToken replaces the stored sync token
+	SaveSyncToken(st SyncToken) error
+	// SaveTitle inserts or replaces a title index entry
+	SaveTitle(entry TitleEntry) error
+	// DeleteTitle removes a title index entry, ignoring entries that do not exist
+	DeleteTitle(uuid string) error
+	// SetReferences replaces the reference index entries held by the parent item
+	SetReferences(parent string, refs []Reference) error
+	// DeleteReferencesTo removes the reference index entries of the items referencing the child item
+	DeleteReferencesTo(child string) error
+	// SetSearchTerms replaces the search index's terms, and their frequencies, for an item
+	SetSearchTerms(uuid string, terms map[string]int) error
+	// Quarantine inserts or replaces a quarantined item
+	Quarantine(q QuarantinedItem) error
+	// Unquarantine removes a quarantined item, ignoring items that are not quarantined
+	Unquarantine(uuid string) error
+}
+
+// StormStore is a Store backed by a storm DB
+type StormStore struct {
+	db *storm.DB
+}
+
+// NewStormStore returns a Store for the DB, migrating it to the current schema version if required
+func NewStormStore(db *storm.DB) (*StormStore, error) {
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
+	return &StormStore{db: db}, nil
+}
+
+// DB returns the underlying storm DB
+func (s *StormStore) DB() *storm.DB {
+	return s.db
+}
+
+func (s *StormStore) AllItems() (items []Item, err error) {
+	err = s.db.All(&items)
+
+	return
+}
+
+func (s *StormStore) DirtyItems() (items []Item, err error) {
+	err = s.db.Find("Dirty", true, &items)
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+func (s *StormStore) SyncToken() (SyncToken, error) {
+	return getSyncToken(s.db)
+}
+
+func (s *StormStore) Quarantined() (quarantined []QuarantinedItem, err error) {
+	err = s.db.All(&quarantined)
+
+	return
+}
+
+func (s *StormStore) Update(fn func(tx StoreTx) error) (err error) {
+	var tx storm.Node
+
+	tx, err = s.db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	if err = fn(stormTx{node: tx}); err != nil {
+		_ = tx.Rollback()
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (s *StormStore) Close() error {
+	return s.db.Close()
+}
+
+// stormTx implements StoreTx for a storm transaction
+type stormTx struct {
+	node storm.Node
+}
+
+func (t stormTx) Item(uuid string) (item Item, err error) {
+	err = t.node.One("UUID", uuid, &item)
+	if errors.Is(err, storm.ErrNotFound) {
+		err = ErrItemNotFound
+	}
+
+	return
+}
+
+func (t stormTx) SaveItem(item Item) error {
+	item.derive()
+
+	if err := item.sequence(t.nextDirtySeq); err != nil {
+		return err
+	}
+
+	return t.node.Save(&item)
+}
+
+// dirtySequence records the last dirty sequence number assigned in a storm DB
+type dirtySequence struct {
+	ID   int `storm:"id"`
+	Last uint64
+}
+
+// there is only ever one dirty sequence record per DB
+const dirtySequenceID = 1
+
+// nextDirtySeq increments and returns the DB's dirty sequence number
+func (t stormTx) nextDirtySeq() (uint64, error) {
+	seq := dirtySequence{ID: dirtySequenceID}
+
+	if err := t.node.One("ID", dirtySequenceID, &seq); err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return 0, err
+	}
+
+	seq.Last++
+
+	return seq.Last, t.node.Save(&seq)
+}
+
+func (t stormTx) DeleteItem(uuid string) (err error) {
+	err = t.node.DeleteStruct(&Item{UUID: uuid})
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+func (t stormTx) SaveSyncToken(st SyncToken) error {
+	return saveSyncToken(t.node, st)
+}
+
+func (t stormTx) Quarantine(q QuarantinedItem) error {
+	return t.node.Save(&q)
+}
+
+func (t stormTx) Unquarantine(uuid string) (err error) {
+	err = t.node.DeleteStruct(&QuarantinedItem{UUID: uuid})
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+func (t stormTx) SaveTitle(entry TitleEntry) error {
+	return t.node.Save(&entry)
+}
+
+func (t stormTx) SetReferences(parent string, refs []Reference) (err error) {
+	var existing []Reference
+
+	err = t.node.Find("Parent", parent, &existing)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	for x := range existing {
+		if err = t.node.DeleteStruct(&existing[x]); err != nil {
+			return
+		}
+	}
+
+	for x := range refs {
+		if err = t.node.Save(&refs[x]); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+func (t stormTx) DeleteReferencesTo(child string) (err error) {
+	var existing []Reference
+
+	err = t.node.Find("Child", child, &existing)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	for x := range existing {
+		if err = t.node.DeleteStruct(&existing[x]); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+func (t stormTx) SetSearchTerms(uuid string, terms map[string]int) (err error) {
+	var existing []searchPosting
+
+	err = t.node.Find("UUID", uuid, &existing)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	for x := range existing {
+		if err = t.node.DeleteStruct(&existing[x]); err != nil {
+			return
+		}
+	}
+
+	err = t.node.DeleteStruct(&searchDoc{UUID: uuid})
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return
+	}
+
+	if len(terms) == 0 {
+		return nil
+	}
+
+	var length int
+
+	for term, count := range terms {
+		length += count
+
+		if err = t.node.Save(&searchPosting{ID: term + "/" + uuid, Term: term, UUID: uuid, Count: count}); err != nil {
+			return
+		}
+	}
+
+	return t.node.Save(&searchDoc{UUID: uuid, Length: length})
+}
+
+func (t stormTx) DeleteTitle(uuid string) (err error) {
+	err = t.node.DeleteStruct(&TitleEntry{UUID: uuid})
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
@@ -0,0 +1,177 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// testStore checks the behaviour Sync relies upon is implemented by a Store
+func testStore(t *testing.T, store Store) {
+	dirtied := time.Now().Add(-time.Hour)
+
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		if err := tx.SaveItem(Item{UUID: "a", ContentType: "Note", Dirty: true, DirtiedDate: dirtied}); err != nil {
+			return err
+		}
+
+		if err := tx.SaveItem(Item{UUID: "b", ContentType: "Note", UnsavedCount: 2}); err != nil {
+			return err
+		}
+
+		return tx.SaveSyncToken(SyncToken{SyncToken: "token"})
+	}))
+
+	// changes are discarded if the transaction returns an error
+	failed := errors.New("failed")
+	assert.Equal(t, failed, store.Update(func(tx StoreTx) error {
+		if err := tx.DeleteItem("a"); err != nil {
+			return err
+		}
+
+		return failed
+	}))
+
+	all, err := store.AllItems()
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	var dirty []Item
+	dirty, err = store.DirtyItems()
+	assert.NoError(t, err)
+	assert.Len(t, dirty, 1)
+	assert.Equal(t, "a", dirty[0].UUID)
+	assert.True(t, dirtied.Equal(dirty[0].DirtiedDate))
+
+	var st SyncToken
+	st, err = store.SyncToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", st.SyncToken)
+	assert.NotZero(t, st.SavedAt)
+
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		item, err := tx.Item("b")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, item.UnsavedCount)
+		assert.Zero(t, item.DirtiedDate)
+
+		_, err = tx.Item("missing")
+		assert.True(t, errors.Is(err, ErrItemNotFound))
+
+		// removing what does not exist is not an error
+		if err = tx.DeleteItem("missing"); err != nil {
+			return err
+		}
+
+		if err = tx.SaveTitle(TitleEntry{UUID: "a", ContentType: "Note", Title: "title"}); err != nil {
+			return err
+		}
+
+		if err = tx.DeleteTitle("a"); err != nil {
+			return err
+		}
+
+		if err = tx.SetReferences("c", newReferences("c", gosn.ItemReferences{{UUID: "a", ContentType: "Note"}})); err != nil {
+			return err
+		}
+
+		// replacing references removes those no longer held
+		if err = tx.SetReferences("c", newReferences("c", gosn.ItemReferences{{UUID: "b", ContentType: "Note"}})); err != nil {
+			return err
+		}
+
+		if err = tx.DeleteReferencesTo("b"); err != nil {
+			return err
+		}
+
+		if err = tx.SetReferences("c", nil); err != nil {
+			return err
+		}
+
+		if err = tx.SetSearchTerms("a", map[string]int{"one": 1, "two": 2}); err != nil {
+			return err
+		}
+
+		if err = tx.SetSearchTerms("a", map[string]int{"three": 1}); err != nil {
+			return err
+		}
+
+		if err = tx.SetSearchTerms("a", nil); err != nil {
+			return err
+		}
+
+		return tx.DeleteTitle("missing")
+	}))
+
+	// a sync through the store clears the dirty flag of saved items and replaces the token
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{
+		Items:      gosn.EncryptedItems{{UUID: "c", ContentType: "Tag"}},
+		SavedItems: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}},
+		SyncToken:  "token-2",
+	}}}
+
+	var so SyncOutput
+	so, err = Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs})
+	assert.NoError(t, err)
+	assert.Equal(t, store, so.Store)
+	assert.Equal(t, "token", fs.inputs[0].SyncToken)
+
+	dirty, err = store.DirtyItems()
+	assert.NoError(t, err)
+	assert.Empty(t, dirty)
+
+	all, err = store.AllItems()
+	assert.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	st, err = store.SyncToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", st.SyncToken)
+
+	// a malformed item is quarantined until a valid copy is retrieved
+	fs = &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: gosn.EncryptedItems{{UUID: "d", ContentType: "SN|Component", UpdatedAt: "yesterday"}}, SyncToken: "token-3"},
+		{Items: gosn.EncryptedItems{{UUID: "d", ContentType: "SN|Component"}}, SyncToken: "token-4"},
+	}}
+
+	_, err = Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs})
+	assert.NoError(t, err)
+
+	var quarantined []QuarantinedItem
+	quarantined, err = store.Quarantined()
+	assert.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+	assert.Equal(t, "d", quarantined[0].UUID)
+	assert.Equal(t, "yesterday", quarantined[0].Item.UpdatedAt)
+	assert.NotEmpty(t, quarantined[0].Reason)
+
+	all, err = store.AllItems()
+	assert.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	_, err = Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs})
+	assert.NoError(t, err)
+
+	quarantined, err = store.Quarantined()
+	assert.NoError(t, err)
+	assert.Empty(t, quarantined)
+}
+
+func TestStormStore(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	var store *StormStore
+	store, err = NewStormStore(db)
+	assert.NoError(t, err)
+
+	testStore(t, store)
+
+	_, err = Sync(SyncInput{Session: offlineSession(), Store: store, DB: db})
+	assert.True(t, errors.Is(err, ErrConflictingDBArgs))
+}
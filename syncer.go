@@ -0,0 +1,41 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"net/http"
+	"time"
+)
+
+// limit of each request made by DefaultSyncer, matching gosn's own client
+const defaultRequestTimeout = 60 * time.Second
+
+// Syncer performs a single sync call with SN
+// it allows the call to be replaced, e.g. with a fake for testing or a wrapper adding instrumentation
+type Syncer interface {
+	Sync(input gosn.SyncInput) (gosn.SyncOutput, error)
+}
+
+// SyncerFunc allows an ordinary function to be used as a Syncer
+type SyncerFunc func(input gosn.SyncInput) (gosn.SyncOutput, error)
+
+// Sync calls f(input)
+func (f SyncerFunc) Sync(input gosn.SyncInput) (gosn.SyncOutput, error) {
+	return f(input)
+}
+
+// DefaultSyncer is used when neither SyncInput.Syncer nor HTTPClient is set
+// it retrieves a single page per call so each page is reported and checkpointed, unlike gosn.Sync which
+// follows every cursor itself and never returns one
+var DefaultSyncer Syncer = HTTPSyncer{Client: &http.Client{Timeout: defaultRequestTimeout}}
+
+// syncer returns the input's Syncer, an HTTPSyncer if it has an HTTP client, or the default
+func (si SyncInput) syncer() Syncer {
+	switch {
+	case si.Syncer != nil:
+		return si.Syncer
+	case si.HTTPClient != nil:
+		return HTTPSyncer{Client: si.HTTPClient}
+	}
+
+	return DefaultSyncer
+}
@@ -0,0 +1,569 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeSyncer returns its outputs in turn and records the inputs it was called with
+type fakeSyncer struct {
+	outputs []gosn.SyncOutput
+	errs    []error
+	inputs  []gosn.SyncInput
+}
+
+func (f *fakeSyncer) Sync(input gosn.SyncInput) (output gosn.SyncOutput, err error) {
+	call := len(f.inputs)
+	f.inputs = append(f.inputs, input)
+
+	if call < len(f.errs) && f.errs[call] != nil {
+		return output, f.errs[call]
+	}
+
+	return f.outputs[call], nil
+}
+
+// pagedServer returns an SN server serving a note on each of pages pages, linked by cursor tokens
+// the requests it receives are recorded, and failing is consulted before each page is served
+func pagedServer(t *testing.T, pages int, failing func(page int) bool) (ts *httptest.Server, requests *[]syncRequest) {
+	requests = &[]syncRequest{}
+
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req syncRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		*requests = append(*requests, req)
+
+		page := 1
+		if req.CursorToken != "" {
+			_, err := fmt.Sscanf(req.CursorToken, "cursor-%d", &page)
+			assert.NoError(t, err)
+			page++
+		}
+
+		if failing != nil && failing(page) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		resp := syncResponse{
+			Items:     gosn.EncryptedItems{{UUID: fmt.Sprintf("note-%d", page), ContentType: "Note", Content: "abc"}},
+			SyncToken: fmt.Sprintf("token-%d", page),
+		}
+
+		if page < pages {
+			resp.CursorToken = fmt.Sprintf("cursor-%d", page)
+		}
+
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+
+	return
+}
+
+func TestDefaultSyncerPaginates(t *testing.T) {
+	ts, requests := pagedServer(t, 3, nil)
+	defer ts.Close()
+
+	session := offlineSession()
+	session.Server = ts.URL
+
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveSyncToken(SyncToken{SyncToken: "token-0"})
+	}))
+
+	// neither a Syncer nor an HTTP client is set so the DefaultSyncer is used
+	so, err := Sync(SyncInput{Session: session, Store: store})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, so.Stats.Pages)
+	assert.Equal(t, 3, so.Stats.Pulled)
+
+	// each page was requested separately, from the cursor returned with the previous one
+	assert.Len(t, *requests, 3)
+	assert.Empty(t, (*requests)[0].CursorToken)
+	assert.Equal(t, "cursor-1", (*requests)[1].CursorToken)
+	assert.Equal(t, "cursor-2", (*requests)[2].CursorToken)
+
+	st, err := store.SyncToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", st.SyncToken)
+	assert.Empty(t, st.CursorToken)
+}
+
+func TestSyncWithSyncerPopulatesNewDB(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-1", Cursor: "cursor-1"},
+		{Items: gosn.EncryptedItems{{UUID: "b", ContentType: "Tag"}}, SyncToken: "token-2"},
+	}}
+
+	so, err := Sync(SyncInput{
+		Session: offlineSession(),
+		DBPath:  tempDBPath,
+		Syncer:  fs,
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, so.DB)
+	defer so.DB.Close()
+
+	assert.Len(t, fs.inputs, 2)
+	assert.Equal(t, "cursor-1", fs.inputs[1].CursorToken)
+
+	var all []Item
+	assert.NoError(t, so.DB.All(&all))
+	assert.Len(t, all, 2)
+
+	var st SyncToken
+	st, err = getSyncToken(so.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", st.SyncToken)
+	assert.Empty(t, st.CursorToken)
+}
+
+// pulledPages returns a syncer output for each of pages pages of size retrieved notes
+func pulledPages(pages, size int) (outputs []gosn.SyncOutput) {
+	for p := 1; p <= pages; p++ {
+		var items gosn.EncryptedItems
+
+		for x := 0; x < size; x++ {
+			items = append(items, gosn.EncryptedItem{UUID: fmt.Sprintf("%d-%d", p, x), ContentType: "Note", Content: "abc"})
+		}
+
+		output := gosn.SyncOutput{Items: items, SyncToken: fmt.Sprintf("token-%d", p)}
+		if p < pages {
+			output.Cursor = fmt.Sprintf("cursor-%d", p)
+		}
+
+		outputs = append(outputs, output)
+	}
+
+	return
+}
+
+func TestSyncWritesEachPageInOneTransaction(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	fs := &fakeSyncer{outputs: pulledPages(2, 500)}
+
+	so, err := Sync(SyncInput{Session: offlineSession(), DBPath: tempDBPath, Syncer: fs})
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	var all []Item
+	assert.NoError(t, so.DB.All(&all))
+	assert.Len(t, all, 1000)
+
+	// every commit writes at least a data page and a meta page, so saving the items one by one
+	// would make at least two writes per item
+	assert.Less(t, so.DB.Bolt.Stats().TxStats.Write, len(all))
+
+	// pages retrieved by later syncs are also written in one transaction each
+	store := &countingStore{Store: so.Store}
+	fs = &fakeSyncer{outputs: pulledPages(3, 100)}
+
+	_, err = Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, store.updates)
+}
+
+// countingStore counts the transactions made through a Store
+type countingStore struct {
+	Store
+	updates int
+}
+
+func (c *countingStore) Update(fn func(tx StoreTx) error) error {
+	c.updates++
+
+	return c.Store.Update(fn)
+}
+
+func BenchmarkSyncPopulation(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		fs := &fakeSyncer{outputs: pulledPages(10, 1000)}
+
+		so, err := Sync(SyncInput{Session: offlineSession(), DBPath: tempDBPath, Syncer: fs})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_ = so.DB.Close()
+		removeDB(tempDBPath)
+	}
+}
+
+func TestSyncProgress(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}, {UUID: "b", ContentType: "Note", Deleted: true}}, SyncToken: "token-1", Cursor: "cursor-1"},
+		{Items: gosn.EncryptedItems{{UUID: "c", ContentType: "Tag"}}, SyncToken: "token-2"},
+	}}
+
+	var calls [][3]int
+
+	so, err := Sync(SyncInput{
+		Session: offlineSession(),
+		DBPath:  tempDBPath,
+		Syncer:  fs,
+		Progress: func(fetched, saved, page int) {
+			calls = append(calls, [3]int{fetched, saved, page})
+		},
+	})
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	assert.Equal(t, [][3]int{{2, 1, 1}, {3, 2, 2}}, calls)
+}
+
+func TestSyncProgressWithDefaultSyncer(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	ts, _ := pagedServer(t, 3, nil)
+	defer ts.Close()
+
+	session := offlineSession()
+	session.Server = ts.URL
+
+	var calls [][3]int
+
+	so, err := Sync(SyncInput{
+		Session: session,
+		DBPath:  tempDBPath,
+		Progress: func(fetched, saved, page int) {
+			calls = append(calls, [3]int{fetched, saved, page})
+		},
+	})
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	// progress is reported as each page is saved
+	assert.Equal(t, [][3]int{{1, 1, 1}, {2, 2, 2}, {3, 3, 3}}, calls)
+}
+
+func TestSyncResumesInterruptedPopulation(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	fs := &fakeSyncer{
+		errs: []error{nil, errors.New("session is invalid")},
+		outputs: []gosn.SyncOutput{
+			{Items: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-1", Cursor: "cursor-1"},
+		},
+	}
+
+	so, err := Sync(SyncInput{Session: offlineSession(), DBPath: tempDBPath, Syncer: fs})
+	assert.Error(t, err)
+
+	st, err := getSyncToken(so.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, "cursor-1", st.CursorToken)
+	assert.NoError(t, so.DB.Close())
+
+	fs = &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: gosn.EncryptedItems{{UUID: "b", ContentType: "Tag"}}, SyncToken: "token-2"},
+	}}
+
+	so, err = Sync(SyncInput{Session: offlineSession(), DBPath: tempDBPath, Syncer: fs})
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	// only the remaining page is requested
+	assert.Len(t, fs.inputs, 1)
+	assert.Equal(t, "token-1", fs.inputs[0].SyncToken)
+	assert.Equal(t, "cursor-1", fs.inputs[0].CursorToken)
+
+	var all []Item
+	assert.NoError(t, so.DB.All(&all))
+	assert.Len(t, all, 2)
+
+	st, err = getSyncToken(so.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", st.SyncToken)
+	assert.Empty(t, st.CursorToken)
+}
+
+func TestDefaultSyncerResumesInterruptedPopulation(t *testing.T) {
+	defer removeDB(tempDBPath)
+
+	failing := true
+
+	ts, requests := pagedServer(t, 3, func(page int) bool {
+		return failing && page == 2
+	})
+	defer ts.Close()
+
+	session := offlineSession()
+	session.Server = ts.URL
+
+	// the population fails after the first page is saved
+	so, err := Sync(SyncInput{Session: session, DBPath: tempDBPath})
+	assert.Error(t, err)
+
+	st, err := getSyncToken(so.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, "cursor-1", st.CursorToken)
+	assert.NoError(t, so.DB.Close())
+
+	failing = false
+	*requests = nil
+
+	so, err = Sync(SyncInput{Session: session, DBPath: tempDBPath})
+	assert.NoError(t, err)
+	defer so.DB.Close()
+
+	// only the remaining pages are requested
+	assert.Len(t, *requests, 2)
+	assert.Equal(t, "cursor-1", (*requests)[0].CursorToken)
+	assert.Equal(t, "cursor-2", (*requests)[1].CursorToken)
+
+	var all []Item
+	assert.NoError(t, so.DB.All(&all))
+	assert.Len(t, all, 3)
+
+	st, err = getSyncToken(so.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", st.SyncToken)
+	assert.Empty(t, st.CursorToken)
+}
+
+func TestSyncResumesInterruptedPagination(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveSyncToken(SyncToken{SyncToken: "token-0"})
+	}))
+
+	fs := &fakeSyncer{
+		errs: []error{nil, errors.New("session is invalid")},
+		outputs: []gosn.SyncOutput{
+			{Items: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-1", Cursor: "cursor-1"},
+		},
+	}
+
+	_, err := Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs})
+	assert.Error(t, err)
+	assert.Len(t, fs.inputs, 2)
+	assert.Equal(t, "token-0", fs.inputs[0].SyncToken)
+	assert.Empty(t, fs.inputs[0].CursorToken)
+	assert.Equal(t, "token-1", fs.inputs[1].SyncToken)
+	assert.Equal(t, "cursor-1", fs.inputs[1].CursorToken)
+
+	// the pages committed before the failure are kept along with the cursor to resume from
+	st, err := store.SyncToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", st.SyncToken)
+	assert.Equal(t, "cursor-1", st.CursorToken)
+
+	fs = &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: gosn.EncryptedItems{{UUID: "b", ContentType: "Note"}}, SyncToken: "token-2", Cursor: "cursor-2"},
+		{Items: gosn.EncryptedItems{{UUID: "c", ContentType: "Tag"}}, SyncToken: "token-3"},
+	}}
+
+	so, err := Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, so.Stats.Pages)
+	assert.Equal(t, 2, so.Stats.Pulled)
+
+	// the remaining pages are requested from the stored cursor
+	assert.Len(t, fs.inputs, 2)
+	assert.Equal(t, "token-1", fs.inputs[0].SyncToken)
+	assert.Equal(t, "cursor-1", fs.inputs[0].CursorToken)
+	assert.Equal(t, "token-2", fs.inputs[1].SyncToken)
+	assert.Equal(t, "cursor-2", fs.inputs[1].CursorToken)
+
+	all, err := store.AllItems()
+	assert.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	// the cursor is cleared once the last page is committed
+	st, err = store.SyncToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", st.SyncToken)
+	assert.Empty(t, st.CursorToken)
+}
+
+func TestDefaultSyncerResumesInterruptedPagination(t *testing.T) {
+	failing := true
+
+	ts, requests := pagedServer(t, 3, func(page int) bool {
+		return failing && page == 3
+	})
+	defer ts.Close()
+
+	session := offlineSession()
+	session.Server = ts.URL
+
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveSyncToken(SyncToken{SyncToken: "token-0"})
+	}))
+
+	_, err := Sync(SyncInput{Session: session, Store: store})
+	assert.Error(t, err)
+
+	// the pages committed before the failure are kept along with the cursor to resume from
+	st, err := store.SyncToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", st.SyncToken)
+	assert.Equal(t, "cursor-2", st.CursorToken)
+
+	failing = false
+	*requests = nil
+
+	so, err := Sync(SyncInput{Session: session, Store: store})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, so.Stats.Pages)
+
+	// only the remaining page is requested, from the stored cursor
+	assert.Len(t, *requests, 1)
+	assert.Equal(t, "token-2", (*requests)[0].SyncToken)
+	assert.Equal(t, "cursor-2", (*requests)[0].CursorToken)
+
+	all, err := store.AllItems()
+	assert.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	st, err = store.SyncToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", st.SyncToken)
+	assert.Empty(t, st.CursorToken)
+}
+
+func TestSyncStats(t *testing.T) {
+	store := NewMemoryStore()
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		return tx.SaveItem(Item{UUID: "a", ContentType: "Note", Content: "abc", EncItemKey: "de", Dirty: true})
+	}))
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Unsaved: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-1", Cursor: "cursor-1"},
+		{Items: gosn.EncryptedItems{{UUID: "b", ContentType: "Note", Content: "xyz"}}, SyncToken: "token-2"},
+	}}
+
+	so, err := Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, so.Stats.Pushed)
+	assert.Equal(t, 1, so.Stats.Pulled)
+	assert.Equal(t, 1, so.Stats.Unsaved)
+	assert.Equal(t, 2, so.Stats.Pages)
+	assert.Equal(t, 8, so.Stats.Bytes)
+	assert.NotZero(t, so.Stats.Duration)
+}
+
+func TestSyncItemErrors(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token-1"}))
+
+	// the second item of the first page has no UUID so cannot be saved
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{
+		{Items: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}, {ContentType: "Note"}}, SyncToken: "token-2", Cursor: "cursor-2"},
+		{Items: gosn.EncryptedItems{{UUID: "b", ContentType: "Note"}}, SyncToken: "token-3"},
+	}}
+
+	var so SyncOutput
+	so, err = Sync(SyncInput{Session: offlineSession(), DB: db, Syncer: fs})
+	assert.NoError(t, err)
+	assert.Len(t, so.ItemErrors, 1)
+	assert.Equal(t, 1, so.Stats.Failed)
+
+	// the remaining pages are left for the next sync, which starts from the same token
+	assert.Len(t, fs.inputs, 1)
+	assert.Equal(t, 1, so.Stats.Pages)
+	assert.Equal(t, "token-1", so.Stats.SyncTokenOut)
+
+	var st SyncToken
+	st, err = getSyncToken(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", st.SyncToken)
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "a", &stored))
+}
+
+func TestSyncWithSyncerPushesDirty(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, saveSyncToken(db, SyncToken{SyncToken: "token-1"}))
+	assert.NoError(t, SaveItems(db, gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}))
+
+	fs := &fakeSyncer{
+		errs: []error{errors.New("unexpected end of JSON input")},
+		outputs: []gosn.SyncOutput{
+			{},
+			{SavedItems: gosn.EncryptedItems{{UUID: "a", ContentType: "Note"}}, SyncToken: "token-2"},
+		},
+	}
+
+	var so SyncOutput
+	so, err = Sync(SyncInput{
+		Session: offlineSession(),
+		DB:      db,
+		Syncer:  fs,
+		Retries: 1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, so.Stats.Pushed)
+	assert.Equal(t, 1, so.Stats.Saved)
+	assert.Equal(t, "token-1", so.Stats.SyncTokenIn)
+	assert.Equal(t, "token-2", so.Stats.SyncTokenOut)
+
+	// the first attempt failed and was retried with the same input
+	assert.Len(t, fs.inputs, 2)
+	assert.Equal(t, fs.inputs[0], fs.inputs[1])
+	assert.Len(t, fs.inputs[1].Items, 1)
+	assert.Equal(t, "token-1", fs.inputs[1].SyncToken)
+
+	var dirty []Item
+	assert.Error(t, db.Find("Dirty", true, &dirty))
+}
+
+func TestSyncPushesInDirtyOrder(t *testing.T) {
+	store := NewMemoryStore()
+
+	// items dirtied within the same instant are still pushed in the order they were made dirty
+	dirtied := time.Now()
+
+	for _, uuid := range []string{"c", "a", "b"} {
+		assert.NoError(t, store.Update(func(tx StoreTx) error {
+			return tx.SaveItem(Item{UUID: uuid, ContentType: "Note", Dirty: true, DirtiedDate: dirtied})
+		}))
+	}
+
+	// saving a dirty item again keeps its place
+	assert.NoError(t, store.Update(func(tx StoreTx) error {
+		item, err := tx.Item("c")
+		if err != nil {
+			return err
+		}
+
+		item.Content = "edited"
+
+		return tx.SaveItem(item)
+	}))
+
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token-1"}}}
+
+	_, err := Sync(SyncInput{Session: offlineSession(), Store: store, Syncer: fs})
+	assert.NoError(t, err)
+
+	var pushed []string
+	for _, i := range fs.inputs[0].Items {
+		pushed = append(pushed, i.UUID)
+	}
+
+	assert.Equal(t, []string{"c", "a", "b"}, pushed)
+}
@@ -0,0 +1,140 @@
+package snpersist
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+)
+
+// syncLock is held by the sync in progress against a DB, it is a channel so waiting can be cancelled
+type syncLock struct {
+	held chan struct{}
+	refs int // syncs holding or waiting for the lock
+}
+
+var (
+	syncLocksMu sync.Mutex
+	syncLocks   = make(map[interface{}]*syncLock)
+)
+
+// syncLockKey identifies the DB or store the input syncs, so syncs of the same one are serialised
+func (si SyncInput) syncLockKey() interface{} {
+	switch {
+	case si.DB != nil:
+		return si.DB
+	case si.Store != nil:
+		// a storm store is locked with the DB it wraps
+		if ss, ok := si.Store.(*StormStore); ok {
+			return ss.db
+		}
+
+		return si.Store
+	}
+
+	path, err := filepath.Abs(si.dbPath())
+	if err != nil {
+		path = si.dbPath()
+	}
+
+	return path
+}
+
+// lockSync waits until no other sync of the input's DB is in progress, returning a function that releases it
+// ErrSyncInProgress is returned instead of waiting if the input has FailIfSyncing set
+func (si SyncInput) lockSync(ctx context.Context) (unlock func(), err error) {
+	key := si.syncLockKey()
+
+	syncLocksMu.Lock()
+
+	l, ok := syncLocks[key]
+	if !ok {
+		l = &syncLock{held: make(chan struct{}, 1)}
+		syncLocks[key] = l
+	}
+
+	l.refs++
+
+	syncLocksMu.Unlock()
+
+	release := func() {
+		syncLocksMu.Lock()
+		defer syncLocksMu.Unlock()
+
+		l.refs--
+		if l.refs == 0 {
+			delete(syncLocks, key)
+		}
+	}
+
+	select {
+	case l.held <- struct{}{}:
+	default:
+		if si.FailIfSyncing {
+			release()
+
+			return nil, ErrSyncInProgress
+		}
+
+		select {
+		case l.held <- struct{}{}:
+		case <-ctx.Done():
+			release()
+
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		<-l.held
+		release()
+	}, nil
+}
+
+// flight is a coalesced sync in progress, its output is shared with every caller that joins it
+type flight struct {
+	done   chan struct{}
+	joined int // callers waiting for the output
+	so     SyncOutput
+	err    error
+}
+
+var (
+	flightsMu sync.Mutex
+	flights   = make(map[interface{}]*flight)
+)
+
+// coalesce calls sync unless a coalesced sync of the input's DB is already in progress,
+// in which case it waits for that sync and returns its output
+func (si SyncInput) coalesce(ctx context.Context, sync func() (SyncOutput, error)) (so SyncOutput, err error) {
+	key := si.syncLockKey()
+
+	flightsMu.Lock()
+
+	if f, ok := flights[key]; ok {
+		f.joined++
+		flightsMu.Unlock()
+
+		select {
+		case <-f.done:
+			return f.so, f.err
+		case <-ctx.Done():
+			return so, ctx.Err()
+		}
+	}
+
+	f := &flight{done: make(chan struct{})}
+	flights[key] = f
+
+	flightsMu.Unlock()
+
+	defer func() {
+		flightsMu.Lock()
+		delete(flights, key)
+		flightsMu.Unlock()
+
+		f.so, f.err = so, err
+		close(f.done)
+	}()
+
+	return sync()
+}
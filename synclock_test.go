@@ -0,0 +1,131 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSyncInProgress(t *testing.T) {
+	store := NewMemoryStore()
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	si := SyncInput{
+		Session: offlineSession(),
+		Store:   store,
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			started <- struct{}{}
+			<-release
+
+			return gosn.SyncOutput{SyncToken: "token"}, nil
+		}),
+	}
+
+	errs := make(chan error, 2)
+
+	go func() {
+		_, err := Sync(si)
+		errs <- err
+	}()
+
+	<-started
+
+	// a second sync of the same store fails immediately if requested
+	failing := si
+	failing.FailIfSyncing = true
+
+	_, err := Sync(failing)
+	assert.True(t, errors.Is(err, ErrSyncInProgress))
+
+	// otherwise it waits for the first to finish
+	go func() {
+		_, err := Sync(si)
+		errs <- err
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("second sync ran concurrently with the first")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// syncs of other stores are not affected
+	other := si
+	other.Store = NewMemoryStore()
+	other.FailIfSyncing = true
+
+	go func() {
+		_, err := Sync(other)
+		errs <- err
+	}()
+
+	<-started
+	release <- struct{}{}
+	assert.NoError(t, <-errs)
+
+	release <- struct{}{}
+	assert.NoError(t, <-errs)
+
+	<-started
+	release <- struct{}{}
+	assert.NoError(t, <-errs)
+
+	assert.Empty(t, syncLocks)
+}
+
+func TestSyncCoalesce(t *testing.T) {
+	store := NewMemoryStore()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	calls := 0
+
+	si := SyncInput{
+		Session:  offlineSession(),
+		Store:    store,
+		Coalesce: true,
+		Syncer: SyncerFunc(func(input gosn.SyncInput) (gosn.SyncOutput, error) {
+			calls++
+			started <- struct{}{}
+			<-release
+
+			return gosn.SyncOutput{SyncToken: "token"}, nil
+		}),
+	}
+
+	outputs := make(chan SyncOutput, 3)
+
+	sync := func() {
+		so, err := Sync(si)
+		assert.NoError(t, err)
+		outputs <- so
+	}
+
+	go sync()
+
+	<-started
+
+	// syncs requested whilst the first is in progress share its output
+	go sync()
+	go sync()
+
+	for joined := 0; joined < 2; {
+		time.Sleep(10 * time.Millisecond)
+
+		flightsMu.Lock()
+		joined = flights[store].joined
+		flightsMu.Unlock()
+	}
+
+	release <- struct{}{}
+
+	for i := 0; i < 3; i++ {
+		so := <-outputs
+		assert.Equal(t, "token", so.Stats.SyncTokenOut)
+	}
+
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, flights)
+}
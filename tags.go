@@ -0,0 +1,101 @@
+package snpersist
+
+import (
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+	"time"
+)
+
+// CreateTag encrypts a new tag with the session's keys and saves it, marked dirty so the next sync pushes it
+func CreateTag(db *storm.DB, session gosn.Session, title string) (tag gosn.Tag, err error) {
+	tag = gosn.NewTag()
+
+	content := gosn.NewTagContent()
+	content.Title = title
+	tag.Content = *content
+
+	err = SaveDecryptedItems(db, session, gosn.Items{&tag})
+
+	return
+}
+
+// GetTag returns the decrypted tag with the provided UUID
+func GetTag(db *storm.DB, session gosn.Session, uuid string) (tag gosn.Tag, err error) {
+	var item gosn.Item
+
+	item, err = GetItem(db, session, uuid)
+	if err != nil {
+		return
+	}
+
+	t, ok := item.(*gosn.Tag)
+	if !ok {
+		err = fmt.Errorf("item %s is a %s not a Tag", uuid, item.GetContentType())
+		return
+	}
+
+	return *t, nil
+}
+
+// TagNote adds a reference to the note to the tag and saves the tag, marked dirty so the next sync pushes it
+func TagNote(db *storm.DB, session gosn.Session, tagUUID, noteUUID string) (err error) {
+	var tag gosn.Tag
+
+	tag, err = GetTag(db, session, tagUUID)
+	if err != nil {
+		return
+	}
+
+	if _, err = GetNote(db, session, noteUUID); err != nil {
+		return
+	}
+
+	tag.Content.UpsertReferences(gosn.ItemReferences{{UUID: noteUUID, ContentType: "Note"}})
+
+	return saveTag(db, session, tag)
+}
+
+// UntagNote removes the tag's reference to the note and saves the tag, marked dirty so the next sync pushes it
+func UntagNote(db *storm.DB, session gosn.Session, tagUUID, noteUUID string) (err error) {
+	var tag gosn.Tag
+
+	tag, err = GetTag(db, session, tagUUID)
+	if err != nil {
+		return
+	}
+
+	var refs gosn.ItemReferences
+
+	for _, ref := range tag.Content.ItemReferences {
+		if ref.UUID != noteUUID {
+			refs = append(refs, ref)
+		}
+	}
+
+	if len(refs) == len(tag.Content.ItemReferences) {
+		return
+	}
+
+	tag.Content.SetReferences(refs)
+
+	return saveTag(db, session, tag)
+}
+
+// DeleteTag flags the tag as deleted and dirty so the next sync pushes the deletion
+// the notes it referenced are not affected
+func DeleteTag(db *storm.DB, session gosn.Session, uuid string) (err error) {
+	if _, err = GetTag(db, session, uuid); err != nil {
+		return
+	}
+
+	return DeleteItem(db, uuid)
+}
+
+// saveTag records the time of a local change to a tag in its content and saves it
+// updated_at is left as SN set it as SN refuses items pushed with any other
+func saveTag(db *storm.DB, session gosn.Session, tag gosn.Tag) error {
+	tag.Content.SetUpdateTime(time.Now().UTC())
+
+	return SaveDecryptedItems(db, session, gosn.Items{&tag})
+}
@@ -0,0 +1,60 @@
+package snpersist
+
+import (
+	"github.com/asdine/storm/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTagHelpers(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	tag, err := CreateTag(db, session, "tag")
+	assert.NoError(t, err)
+
+	created := tag.UpdatedAt
+
+	note, err := CreateNote(db, session, "note", "text")
+	assert.NoError(t, err)
+
+	assert.NoError(t, TagNote(db, session, tag.UUID, note.UUID))
+	// tagging twice does not duplicate the reference
+	assert.NoError(t, TagNote(db, session, tag.UUID, note.UUID))
+	assert.Equal(t, ErrItemNotFound, TagNote(db, session, tag.UUID, "missing"))
+	assert.Error(t, TagNote(db, session, note.UUID, tag.UUID))
+
+	tag, err = GetTag(db, session, tag.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "tag", tag.Content.Title)
+	// SN refuses items pushed with an updated_at other than its own
+	assert.Equal(t, created, tag.UpdatedAt)
+	assert.Len(t, tag.Content.ItemReferences, 1)
+	assert.Equal(t, note.UUID, tag.Content.ItemReferences[0].UUID)
+
+	var refs []Reference
+	refs, err = ReferencesTo(db, note.UUID)
+	assert.NoError(t, err)
+	assert.Len(t, refs, 1)
+	assert.Equal(t, tag.UUID, refs[0].Parent)
+
+	assert.NoError(t, UntagNote(db, session, tag.UUID, note.UUID))
+
+	refs, err = ReferencesFrom(db, tag.UUID)
+	assert.NoError(t, err)
+	assert.Empty(t, refs)
+
+	tag, err = GetTag(db, session, tag.UUID)
+	assert.NoError(t, err)
+	assert.Empty(t, tag.Content.ItemReferences)
+
+	assert.NoError(t, DeleteTag(db, session, tag.UUID))
+	assert.Error(t, DeleteTag(db, session, note.UUID))
+
+	_, err = GetTag(db, session, tag.UUID)
+	assert.Equal(t, ErrItemDeleted, err)
+}
@@ -0,0 +1,28 @@
+package snpersist
+
+import "context"
+
+// Tracer starts spans around the phases of a sync: sync, initialise-db, load-dirty, remote-sync, persist-items and
+// update-token
+// adapt an OpenTelemetry trace.Tracer to diagnose slow syncs in an existing tracing pipeline
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation
+type Span interface {
+	// End completes the span, recording err if the operation failed
+	End(err error)
+}
+
+// startSpan starts a span with the input's tracer and returns a function that ends it
+// nothing is traced if the input has no tracer
+func (si SyncInput) startSpan(ctx context.Context, name string) (context.Context, func(err error)) {
+	if si.Tracer == nil {
+		return ctx, func(error) {}
+	}
+
+	ctx, span := si.Tracer.Start(ctx, name)
+
+	return ctx, span.End
+}
@@ -0,0 +1,55 @@
+package snpersist
+
+import (
+	"context"
+	"errors"
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// recordingTracer records the names of started spans and the errors they ended with
+type recordingTracer struct {
+	started []string
+	ended   map[string]error
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	name   string
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.started = append(t.started, name)
+
+	return ctx, recordingSpan{tracer: t, name: name}
+}
+
+func (s recordingSpan) End(err error) {
+	if s.tracer.ended == nil {
+		s.tracer.ended = make(map[string]error)
+	}
+
+	s.tracer.ended[s.name] = err
+}
+
+func TestSyncTracing(t *testing.T) {
+	fs := &fakeSyncer{outputs: []gosn.SyncOutput{{SyncToken: "token"}}}
+
+	var tracer recordingTracer
+
+	_, err := Sync(SyncInput{Session: offlineSession(), Store: NewMemoryStore(), Syncer: fs, Tracer: &tracer})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sync", "load-dirty", "remote-sync", "persist-items", "update-token"}, tracer.started)
+	assert.Len(t, tracer.ended, 5)
+
+	failure := errors.New("session is invalid")
+	fs = &fakeSyncer{errs: []error{failure}}
+	tracer = recordingTracer{}
+
+	_, err = Sync(SyncInput{Session: offlineSession(), Store: NewMemoryStore(), Syncer: fs, Tracer: &tracer})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, failure, tracer.ended["remote-sync"])
+	assert.Equal(t, failure, tracer.ended["sync"])
+	assert.NoError(t, tracer.ended["load-dirty"])
+}
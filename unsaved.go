@@ -0,0 +1,153 @@
+package snpersist
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	"time"
+)
+
+// ChronicUnsaved returns the items that have been returned as unsaved by the server more than threshold times
+func ChronicUnsaved(db *storm.DB, threshold int) (items Items, err error) {
+	err = db.Select(q.Gt("UnsavedCount", threshold)).Find(&items)
+	if errors.Is(err, storm.ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+// recordUnsaved increments the unsaved count, and sets the last error, of each item the server failed to save
+func recordUnsaved(tx StoreTx, unsaved []string) (err error) {
+	for _, uuid := range unsaved {
+		var existing Item
+
+		existing, err = tx.Item(uuid)
+		if err != nil {
+			if errors.Is(err, ErrItemNotFound) {
+				err = nil
+				continue
+			}
+
+			return
+		}
+
+		existing.UnsavedCount++
+		existing.LastError = ErrItemUnsaved.Error()
+
+		if err = tx.SaveItem(existing); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// resetUnsaved clears the unsaved count and last error of each item the server has now saved
+func resetUnsaved(tx StoreTx, saved []string) (err error) {
+	for _, uuid := range saved {
+		var existing Item
+
+		existing, err = tx.Item(uuid)
+		if err != nil {
+			if errors.Is(err, ErrItemNotFound) {
+				err = nil
+				continue
+			}
+
+			return
+		}
+
+		if existing.UnsavedCount == 0 && existing.LastError == "" {
+			continue
+		}
+
+		existing.UnsavedCount = 0
+		existing.LastError = ""
+
+		if err = tx.SaveItem(existing); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// RequeueUnsaved marks the items with the provided UUIDs dirty so the next sync pushes them again,
+// with their updated time bumped and failure details cleared, restoring any that were moved to the dead letters
+func RequeueUnsaved(db *storm.DB, uuids ...string) (err error) {
+	var tx storm.Node
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	now := time.Now().UTC()
+
+	for _, uuid := range uuids {
+		var item Item
+
+		item, err = requeuedItem(tx, uuid)
+		if err != nil {
+			return
+		}
+
+		if !item.Dirty {
+			item.setBase(item)
+		}
+
+		item.UpdatedAt = now.Format(timeLayout)
+		item.Dirty = true
+		item.DirtiedDate = now
+		item.DirtySeq = 0
+		item.UnsavedCount = 0
+		item.LastError = ""
+
+		if err = (stormTx{node: tx}).SaveItem(item); err != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// requeuedItem returns the item to requeue, removing it from the dead letters if it was moved there
+func requeuedItem(tx storm.Node, uuid string) (item Item, err error) {
+	var letter DeadLetter
+
+	err = tx.One("UUID", uuid, &letter)
+
+	switch {
+	case err == nil:
+		item = letter.Item
+
+		// the copy reverted to when the item was moved is now the last synced copy
+		var current Item
+
+		err = tx.One("UUID", uuid, &current)
+
+		switch {
+		case err == nil:
+			item.setBase(current)
+		case !errors.Is(err, storm.ErrNotFound):
+			return
+		}
+
+		err = tx.DeleteStruct(&letter)
+	case errors.Is(err, storm.ErrNotFound):
+		err = tx.One("UUID", uuid, &item)
+		if errors.Is(err, storm.ErrNotFound) {
+			err = fmt.Errorf("%w: %s", ErrItemNotFound, uuid)
+		}
+	}
+
+	return
+}
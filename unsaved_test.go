@@ -0,0 +1,76 @@
+package snpersist
+
+import (
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChronicUnsaved(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note"}))
+	assert.NoError(t, db.Save(&Item{UUID: "b", ContentType: "Note"}))
+
+	for x := 0; x < 3; x++ {
+		assert.NoError(t, recordUnsaved(stormTx{node: db}, []string{"a", "missing"}))
+	}
+	assert.NoError(t, recordUnsaved(stormTx{node: db}, []string{"b"}))
+
+	var chronic Items
+	chronic, err = ChronicUnsaved(db, 2)
+	assert.NoError(t, err)
+	assert.Len(t, chronic, 1)
+	assert.Equal(t, "a", chronic[0].UUID)
+	assert.Equal(t, 3, chronic[0].UnsavedCount)
+
+	// once saved the item should no longer be reported
+	assert.NoError(t, resetUnsaved(stormTx{node: db}, []string{"a", "missing"}))
+	chronic, err = ChronicUnsaved(db, 0)
+	assert.NoError(t, err)
+	assert.Len(t, chronic, 1)
+	assert.Equal(t, "b", chronic[0].UUID)
+}
+
+func TestRequeueUnsaved(t *testing.T) {
+	db, err := storm.Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	old := "2020-05-01T10:00:00.000Z"
+
+	// an item still failing, and one moved to the dead letters after failing
+	assert.NoError(t, db.Save(&Item{UUID: "a", ContentType: "Note", UpdatedAt: old, Dirty: true, UnsavedCount: 2, LastError: "failed"}))
+	assert.NoError(t, db.Save(&Item{UUID: "b", ContentType: "Note", Content: "synced", UpdatedAt: old}))
+	assert.NoError(t, db.Save(&DeadLetter{
+		UUID: "b",
+		Item: Item{UUID: "b", ContentType: "Note", Content: "edited", UpdatedAt: old, Dirty: true, UnsavedCount: 3, LastError: "failed"},
+	}))
+
+	assert.True(t, errors.Is(RequeueUnsaved(db, "a", "missing"), ErrItemNotFound))
+
+	assert.NoError(t, RequeueUnsaved(db, "a", "b"))
+
+	for _, uuid := range []string{"a", "b"} {
+		var stored Item
+		assert.NoError(t, db.One("UUID", uuid, &stored))
+		assert.True(t, stored.Dirty)
+		assert.Zero(t, stored.UnsavedCount)
+		assert.Empty(t, stored.LastError)
+		assert.True(t, isNewer(stored.UpdatedAt, old))
+	}
+
+	var stored Item
+	assert.NoError(t, db.One("UUID", "b", &stored))
+	assert.Equal(t, "edited", stored.Content)
+	assert.Equal(t, "synced", stored.BaseContent)
+
+	letters, err := DeadLetters(db)
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+}
@@ -0,0 +1,68 @@
+package snpersist
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/asdine/storm/v3"
+	"github.com/jonhadfield/gosn-v2"
+)
+
+// VerifyReport is the result of checking that every item in a DB can be decrypted
+type VerifyReport struct {
+	Checked int         // items checked, deleted items have no content and are not checked
+	Failed  []ItemError // items that could not be decrypted, with the reason
+}
+
+// OK returns true if every item checked could be decrypted
+func (r VerifyReport) OK() bool {
+	return len(r.Failed) == 0
+}
+
+// FailedUUIDs returns the UUIDs of the items that could not be decrypted
+func (r VerifyReport) FailedUUIDs() (uuids []string) {
+	for _, f := range r.Failed {
+		uuids = append(uuids, f.UUID)
+	}
+
+	return
+}
+
+// Verify attempts to decrypt every item in the DB with the session's keys, and the items keys they decrypt,
+// reporting those that fail, e.g. with a corrupt item key, truncated content or keys of another account
+// so corruption is found without waiting for the broken item to be read
+func Verify(db *storm.DB, session gosn.Session) (report VerifyReport, err error) {
+	if !session.Valid() {
+		return report, ErrInvalidSession
+	}
+
+	var all Items
+
+	if err = db.All(&all); err != nil {
+		return
+	}
+
+	var keys []ItemsKey
+
+	if keys, err = ItemsKeys(db, session); err != nil {
+		return
+	}
+
+	for _, i := range all {
+		if i.Deleted {
+			continue
+		}
+
+		report.Checked++
+
+		content, dErr := decryptStored(i, session, keys)
+		if dErr == nil && !json.Valid([]byte(content)) {
+			dErr = errors.New("decrypted content is not valid JSON")
+		}
+
+		if dErr != nil {
+			report.Failed = append(report.Failed, ItemError{UUID: i.UUID, ContentType: i.ContentType, Err: dErr})
+		}
+	}
+
+	return
+}
@@ -0,0 +1,48 @@
+package snpersist
+
+import (
+	"github.com/jonhadfield/gosn-v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	db, err := Open(tempDBPath)
+	assert.NoError(t, err)
+	defer removeDB(tempDBPath)
+	defer db.Close()
+
+	session := offlineSession()
+
+	good, _ := createNote("good", "")
+	truncated, _ := createNote("truncated", "")
+	dItems := gosn.Items{&good, &truncated}
+	eItems, err := dItems.Encrypt(session.Mk, session.Ak, false)
+	assert.NoError(t, err)
+
+	eItems[1].Content = eItems[1].Content[:len(eItems[1].Content)-10]
+
+	// an item encrypted with another account's keys
+	foreign, _ := createNote("foreign", "")
+	dItems = gosn.Items{&foreign}
+	fItems, err := dItems.Encrypt(offlineSession().Mk, offlineSession().Ak, false)
+	assert.NoError(t, err)
+
+	eItems = append(eItems, fItems...)
+	eItems = append(eItems, items004(t, session)...)
+	eItems = append(eItems, gosn.EncryptedItem{UUID: "deleted", ContentType: "Note", Deleted: true})
+
+	for _, i := range ConvertItemsToPersistItems(eItems) {
+		assert.NoError(t, db.Save(&i))
+	}
+
+	report, err := Verify(db, session)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Checked)
+	assert.False(t, report.OK())
+	assert.ElementsMatch(t, []string{truncated.UUID, foreign.UUID}, report.FailedUUIDs())
+
+	for _, f := range report.Failed {
+		assert.Error(t, f.Err)
+	}
+}